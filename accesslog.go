@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const activeAccessLog = "access.log"
+
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	UserAgent  string    `json:"user_agent"`
+	Referer    string    `json:"referer"`
+	TraceID    string    `json:"trace_id,omitempty"`
+}
+
+// accessLog writes one JSON object per request to dir/access.log and
+// periodically rolls it into a gzip file that can be shipped to object
+// storage for offline analytics.
+type accessLog struct {
+	mu          sync.Mutex
+	dir         string
+	file        *os.File
+	rotate      time.Duration
+	retention   time.Duration
+	shipCommand string
+}
+
+func newAccessLog(dir string, rotate, retention time.Duration, shipCommand string) (*accessLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &accessLog{dir: dir, rotate: rotate, retention: retention, shipCommand: shipCommand}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(filepath.Join(l.dir, activeAccessLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+func (l *accessLog) write(entry accessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Write(append(line, '\n'))
+}
+
+func (l *accessLog) run() {
+	ticker := time.NewTicker(l.rotate)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := l.roll(); err != nil {
+			logger.Error("access log rotation failed", "error", err)
+		}
+		l.prune()
+	}
+}
+
+// roll closes the active log, compresses it and ships the compressed file.
+func (l *accessLog) roll() error {
+	l.mu.Lock()
+	info, err := l.file.Stat()
+	if err != nil || info.Size() == 0 {
+		l.mu.Unlock()
+		return err
+	}
+	l.file.Close()
+	rolled := filepath.Join(l.dir, fmt.Sprintf("access-%s.log", time.Now().UTC().Format("20060102T150405Z")))
+	renameErr := os.Rename(filepath.Join(l.dir, activeAccessLog), rolled)
+	openErr := l.open()
+	l.mu.Unlock()
+
+	if renameErr != nil {
+		return renameErr
+	}
+	if openErr != nil {
+		return openErr
+	}
+
+	compressed, err := gzipFile(rolled)
+	if err != nil {
+		return err
+	}
+	return l.ship(compressed)
+}
+
+// ship hands a rolled file to the configured command, e.g.
+// "aws s3 cp {} s3://bucket/logs/" or "gsutil cp {} gs://bucket/logs/".
+func (l *accessLog) ship(path string) error {
+	if l.shipCommand == "" {
+		return nil
+	}
+	command := strings.ReplaceAll(l.shipCommand, "{}", path)
+	if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+		return fmt.Errorf("shipping %s: %v: %s", path, err, out)
+	}
+	return nil
+}
+
+// prune removes compressed logs older than the retention period.
+func (l *accessLog) prune() {
+	if l.retention <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(l.dir, "access-*.log.gz"))
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > l.retention {
+			os.Remove(path)
+		}
+	}
+}
+
+func gzipFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dstPath := path + ".gz"
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return dstPath, os.Remove(path)
+}
+
+// AccessLogMiddleware records every request. Query strings are left out so
+// signatures never end up in the logs.
+func AccessLogMiddleware(l *accessLog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		l.write(accessLogEntry{
+			Time:       start.UTC(),
+			ClientIP:   c.ClientIP(),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			Status:     c.Writer.Status(),
+			Bytes:      max(c.Writer.Size(), 0),
+			DurationMs: time.Since(start).Milliseconds(),
+			UserAgent:  c.Request.UserAgent(),
+			Referer:    c.Request.Referer(),
+			TraceID:    c.GetString("traceID"),
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminRole orders admin privileges; each role includes the ones below it.
+type adminRole int
+
+const (
+	roleViewer adminRole = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var adminRoleNames = map[string]adminRole{
+	"viewer":   roleViewer,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+func (r adminRole) String() string {
+	for name, role := range adminRoleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+type adminCredential struct {
+	name  string
+	role  adminRole
+	token string
+}
+
+var adminDenials = expvar.NewInt("admin_denials_total")
+
+// parseAdminUsers parses ADMIN_USERS entries of the form name:role:token,
+// rejecting a malformed entry rather than dropping it.
+// ADMIN_TOKEN, when set, is kept as an "admin" credential.
+func parseAdminUsers(users, legacyToken string) ([]adminCredential, error) {
+	var creds []adminCredential
+	if legacyToken != "" {
+		creds = append(creds, adminCredential{name: "admin", role: roleAdmin, token: legacyToken})
+	}
+	for _, entry := range strings.Split(users, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, errors.New("ADMIN_USERS entries must be name:role:token with role viewer, operator or admin")
+		}
+		role, ok := adminRoleNames[parts[1]]
+		if !ok || parts[0] == "" || parts[2] == "" {
+			return nil, errors.New("ADMIN_USERS entries must be name:role:token with role viewer, operator or admin")
+		}
+		creds = append(creds, adminCredential{name: parts[0], role: role, token: parts[2]})
+	}
+	return creds, nil
+}
+
+func auditDenial(c *gin.Context, user string, role adminRole, reason string) {
+	adminDenials.Add(1)
+	logger.Warn("admin access denied",
+		"user", user,
+		"role", role.String(),
+		"reason", reason,
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"client_ip", c.ClientIP())
+}
+
+// authenticateAdmin records the credential matching the request's bearer
+// token for requireRole and reports whether there was one.
+func authenticateAdmin(c *gin.Context) bool {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	for _, cred := range adminUsers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cred.token)) == 1 {
+			c.Set("adminUser", cred.name)
+			c.Set("adminRole", cred.role)
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuthMiddleware authenticates operators by bearer token and records
+// the matching credential for requireRole.
+func AdminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authenticateAdmin(c) {
+			c.Next()
+			return
+		}
+
+		auditDenial(c, "", 0, "invalid token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+		c.Abort()
+	}
+}
+
+// requireRole rejects admin users whose role is below min.
+func requireRole(min adminRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, _ := c.Value("adminRole").(adminRole)
+		if role < min {
+			auditDenial(c, c.GetString("adminUser"), role, "requires "+min.String())
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient admin role"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerAdminRoutes mounts the operator-only endpoints under /admin.
+func registerAdminRoutes(router gin.IRouter) {
+	admin := router.Group("/admin", AdminAuthMiddleware())
+	viewer := admin.Group("", requireRole(roleViewer))
+	operator := admin.Group("", requireRole(roleOperator))
+
+	viewer.GET("/metrics", gin.WrapH(expvar.Handler()))
+	viewer.GET("/replays", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, replays.report())
+	})
+	viewer.GET("/pii", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, piiReport())
+	})
+	viewer.GET("/logging", getLoggingSettings)
+	operator.PUT("/logging", updateLoggingSettings)
+	viewer.GET("/config", getEffectiveConfig)
+	viewer.GET("/settings", getRuntimeSettings)
+	operator.PUT("/settings", updateRuntimeSettings)
+	viewer.GET("/images", listImageMetadata)
+	viewer.GET("/images/:filename", getImageMetadata)
+	viewer.GET("/duplicates", reportDuplicates)
+	operator.POST("/duplicates/merge", mergeDuplicates)
+	operator.POST("/watermarks/detect", detectTraceMark)
+	viewer.GET("/references", listReferences)
+	viewer.GET("/references/matches", listReferenceMatches)
+	operator.POST("/references", createReference)
+	operator.DELETE("/references/:id", removeReference)
+	viewer.GET("/cache", getTransformCache)
+	operator.DELETE("/cache", purgeTransformCache)
+	operator.DELETE("/cache/:filename", purgeTransformCache)
+	viewer.GET("/integrity", exportIntegrity)
+	viewer.POST("/integrity/verify", verifyIntegrity)
+}
+
+// registerProfiling mounts the net/http/pprof handlers under /debug/pprof for
+// admins. It is only used on the ADMIN_ADDR listener.
+func registerProfiling(router gin.IRouter) {
+	debug := router.Group("/debug/pprof", AdminAuthMiddleware(), requireRole(roleAdmin))
+	debug.GET("/", gin.WrapF(pprof.Index))
+	debug.GET("/:profile", func(c *gin.Context) {
+		switch profile := c.Param("profile"); profile {
+		case "cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			pprof.Handler(profile).ServeHTTP(c.Writer, c.Request)
+		}
+	})
+}
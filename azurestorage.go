@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// azureStorage keeps objects as block blobs in an Azure Blob Storage
+// container under a name prefix.
+type azureStorage struct {
+	client *container.Client
+	prefix string
+}
+
+// azureSettings are read from the AZURE_STORAGE_* environment variables.
+type azureSettings struct {
+	account   string
+	container string
+	prefix    string
+	endpoint  string
+	sasToken  string
+	key       string
+}
+
+// newAzureStorage creates a client for the container. A SAS token or account
+// key is used when set; otherwise DefaultAzureCredential authenticates, which
+// covers AKS workload identity and managed identities (AZURE_CLIENT_ID picks a
+// user-assigned one).
+func newAzureStorage(settings azureSettings, prefix string) (*azureStorage, error) {
+	if settings.account == "" || settings.container == "" {
+		return nil, errors.New("AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_CONTAINER are required for the azure storage backend")
+	}
+	endpoint := settings.endpoint
+	if endpoint == "" {
+		endpoint = "https://" + settings.account + ".blob.core.windows.net"
+	}
+	containerURL := strings.TrimSuffix(endpoint, "/") + "/" + settings.container
+
+	options := &container.ClientOptions{ClientOptions: policy.ClientOptions{PerCallPolicies: []policy.Policy{azureTracePolicy{}}}}
+	var client *container.Client
+	var err error
+	switch {
+	case settings.sasToken != "":
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(settings.sasToken, "?"), options)
+	case settings.key != "":
+		var cred *container.SharedKeyCredential
+		if cred, err = container.NewSharedKeyCredential(settings.account, settings.key); err == nil {
+			client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, options)
+		}
+	default:
+		var cred *azidentity.DefaultAzureCredential
+		if cred, err = azidentity.NewDefaultAzureCredential(nil); err == nil {
+			client, err = container.NewClient(containerURL, cred, options)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &azureStorage{client: client, prefix: settings.prefix + prefix}, nil
+}
+
+func (a *azureStorage) blobName(name string) (string, error) {
+	if !validObjectName(name) {
+		return "", errInvalidName
+	}
+	return a.prefix + name, nil
+}
+
+// azureNotFound maps the missing-blob error to ErrNotFound. A missing
+// container is left as is, so misconfiguration isn't reported as 404.
+func azureNotFound(err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// deref returns the value p points to, or the zero value for nil; the SDK
+// reports most response fields as pointers.
+func deref[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Put uploads r in blocks. The blob only changes when the block list is
+// committed at the end, so a failed upload leaves the previous object intact.
+func (a *azureStorage) Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error) {
+	blobName, err := a.blobName(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	options := &blockblob.UploadStreamOptions{}
+	if contentType := getMimeType(name); contentType != "" {
+		options.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: to.Ptr(contentType)}
+	}
+	counter := &countingReader{r: r}
+	out, err := a.client.NewBlockBlobClient(blobName).UploadStream(ctx, counter, options)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: counter.n, ModTime: deref(out.LastModified)}, nil
+}
+
+func (a *azureStorage) Get(ctx context.Context, name string) (io.ReadCloser, ObjectInfo, error) {
+	blobName, err := a.blobName(name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	client := a.client.NewBlobClient(blobName)
+	out, err := client.DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, azureNotFound(err)
+	}
+	info := ObjectInfo{Name: name, Size: deref(out.ContentLength), ModTime: deref(out.LastModified)}
+	return newRangedObject(out.Body, info.Size, func(offset int64) (io.ReadCloser, error) {
+		out, err := client.DownloadStream(ctx, &blob.DownloadStreamOptions{Range: blob.HTTPRange{Offset: offset}})
+		if err != nil {
+			return nil, err
+		}
+		return out.Body, nil
+	}), info, nil
+}
+
+func (a *azureStorage) Delete(ctx context.Context, name string) error {
+	blobName, err := a.blobName(name)
+	if err != nil {
+		return err
+	}
+	_, err = a.client.NewBlobClient(blobName).Delete(ctx, nil)
+	return azureNotFound(err)
+}
+
+func (a *azureStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	blobName, err := a.blobName(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	out, err := a.client.NewBlobClient(blobName).GetProperties(ctx, nil)
+	if err != nil {
+		return ObjectInfo{}, azureNotFound(err)
+	}
+	return ObjectInfo{Name: name, Size: deref(out.ContentLength), ModTime: deref(out.LastModified)}, nil
+}
+
+func (a *azureStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	pages := a.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: to.Ptr(a.prefix + prefix)})
+	for pages.More() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			object := ObjectInfo{Name: strings.TrimPrefix(deref(item.Name), a.prefix)}
+			if item.Properties != nil {
+				object.Size = deref(item.Properties.ContentLength)
+				object.ModTime = deref(item.Properties.LastModified)
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
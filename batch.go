@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// batchNamespace scopes the signatures of batch transform routes.
+const batchNamespace = "transform/batch"
+
+// maxBatchImages bounds the images named by one batch request.
+const maxBatchImages = 10000
+
+// maxBatchJobs is how many jobs are kept for their status; the oldest
+// finished jobs are forgotten beyond it.
+const maxBatchJobs = 100
+
+// maxBatchFailures bounds the failures listed in a job summary.
+const maxBatchFailures = 100
+
+// batchSlots bounds the images transformed by batch jobs at once, across
+// all jobs, so a large migration leaves CPU for serving requests.
+var batchSlots = make(chan struct{}, 2)
+
+var (
+	batchTransformsRendered = expvar.NewInt("batch_transforms_rendered_total")
+	batchTransformsFailed   = expvar.NewInt("batch_transforms_failed_total")
+)
+
+// Job states.
+const (
+	batchRunning = "running"
+	batchDone    = "done"
+)
+
+// What a job did with one image.
+const (
+	batchRendered = "rendered"
+	batchCached   = "cached"
+	batchSkipped  = "skipped"
+)
+
+type batchRequest struct {
+	Images []string `json:"images"`
+	// All transforms every stored image instead of the listed ones.
+	All bool `json:"all"`
+	// Transform is a query string as accepted by GET /images/:filename.
+	Transform string `json:"transform" binding:"required"`
+}
+
+type batchFailure struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// batchJob is the summary of a batch transform job. Rendered images were
+// converted by the job, cached ones were already in the transform cache and
+// skipped ones are left alone by the transform, such as a quality-only
+// change of a PNG.
+type batchJob struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	Transform  string         `json:"transform"`
+	Total      int            `json:"total"`
+	Rendered   int            `json:"rendered"`
+	Cached     int            `json:"cached"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Failures   []batchFailure `json:"failures,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// batchJobs keeps the jobs of this instance in memory; they don't survive
+// a restart.
+type batchJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*batchJob
+	order []string
+}
+
+var batches = &batchJobs{jobs: map[string]*batchJob{}}
+
+func (b *batchJobs) add(job *batchJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobs[job.ID] = job
+	b.order = append(b.order, job.ID)
+	for i := 0; len(b.jobs) > maxBatchJobs && i < len(b.order); {
+		if id := b.order[i]; b.jobs[id].Status == batchDone {
+			delete(b.jobs, id)
+			b.order = slices.Delete(b.order, i, i+1)
+			continue
+		}
+		i++
+	}
+}
+
+// get returns a copy of the job, safe to serialize while it runs.
+func (b *batchJobs) get(id string) (batchJob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job, ok := b.jobs[id]
+	if !ok {
+		return batchJob{}, false
+	}
+	summary := *job
+	summary.Failures = slices.Clone(job.Failures)
+	return summary, true
+}
+
+// update applies change to the job under the lock.
+func (b *batchJobs) update(job *batchJob, change func(*batchJob)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	change(job)
+}
+
+// batchOptions parses transform for filename the way a GET of
+// /images/:filename?<transform> without an Accept header would: without
+// format=, edited images keep their source format. ok is false when that
+// GET would serve the original.
+func batchOptions(transform url.Values, filename string) (opts transformOptions, ok bool, err error) {
+	query := transform
+	if transform.Get("format") == "" {
+		// Naming the format keeps parseTransformOptions from negotiating on
+		// a request that has none.
+		query = url.Values{}
+		for name, values := range transform {
+			query[name] = values
+		}
+		query.Set("format", sourceFormat(filename))
+	}
+	c := &gin.Context{Request: &http.Request{URL: &url.URL{RawQuery: query.Encode()}}}
+	if opts, ok, err = parseTransformOptions(c, filename); err != nil || !ok {
+		return opts, ok, err
+	}
+	if transform.Get("format") == "" {
+		edits := opts.reshapes() || opts.recipient != "" || transform.Get("watermark") == "1"
+		if !edits && !(transform.Get("q") != "" && isJPEG(filename)) {
+			return transformOptions{}, false, nil
+		}
+	}
+	return opts, true, nil
+}
+
+// runBatch transforms every image of the job into the transform cache.
+func (s *fileStore) runBatch(job *batchJob, images []string, transform url.Values) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for _, filename := range images {
+		batchSlots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-batchSlots
+				wg.Done()
+			}()
+			outcome, err := s.batchTransform(ctx, filename, transform)
+			if err != nil {
+				batchTransformsFailed.Add(1)
+			} else if outcome == batchRendered {
+				batchTransformsRendered.Add(1)
+			}
+			batches.update(job, func(job *batchJob) {
+				switch {
+				case err != nil:
+					job.Failed++
+					if len(job.Failures) < maxBatchFailures {
+						job.Failures = append(job.Failures, batchFailure{filename, err.Error()})
+					}
+				case outcome == batchRendered:
+					job.Rendered++
+				case outcome == batchCached:
+					job.Cached++
+				default:
+					job.Skipped++
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	batches.update(job, func(job *batchJob) {
+		finished := time.Now().UTC()
+		job.Status, job.FinishedAt = batchDone, &finished
+	})
+	logger.Info("batch transform finished", "job", job.ID, "transform", job.Transform, "total", job.Total, "failed", job.Failed)
+}
+
+// batchTransform renders one image of a job and reports what it did.
+func (s *fileStore) batchTransform(ctx context.Context, filename string, transform url.Values) (string, error) {
+	opts, ok, err := batchOptions(transform, filename)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return batchSkipped, nil
+	}
+	body, info, _, err := s.open(ctx, filename)
+	if errors.Is(err, ErrNotFound) {
+		return "", errors.New("file not found")
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	key := s.cache.key(info, opts)
+	if s.cache.has(key) {
+		return batchCached, nil
+	}
+	if _, err := s.renderTransform(ctx, body, info, opts, key); err != nil {
+		return "", err
+	}
+	return batchRendered, nil
+}
+
+// createBatch starts a job applying one transform to a list of images, or
+// to every stored image, and answers 202 with a signed URL of its status.
+// The results are the transform cache entries a GET of each image with the
+// same transform is served from.
+func (s *fileStore) createBatch(c *gin.Context) {
+	if s.cache == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Image conversions are disabled."})
+		return
+	}
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "A transform and a list of images are required."})
+		return
+	}
+	if req.All == (len(req.Images) > 0) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Give either a list of images or all, not both."})
+		return
+	}
+	if len(req.Images) > maxBatchImages {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "At most " + strconv.Itoa(maxBatchImages) + " images per batch."})
+		return
+	}
+	transform, err := url.ParseQuery(req.Transform)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "transform must be a query string."})
+		return
+	}
+	for name := range transform {
+		if !slices.Contains(transformParams, name) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Unsupported transform parameter " + strconv.Quote(name) + "."})
+			return
+		}
+	}
+	if transform.Get("format") == "original" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "format=original doesn't produce a derivative."})
+		return
+	}
+	if _, _, err := batchOptions(transform, ""); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	images := req.Images
+	if req.All {
+		objects, err := s.storage.List(c.Request.Context(), "")
+		if err != nil {
+			logger.Error("listing failed", "route", s.route, "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to list files."})
+			return
+		}
+		for _, object := range objects {
+			if !isDerivedObject(object.Name) {
+				images = append(images, object.Name)
+			}
+		}
+	}
+
+	job := &batchJob{
+		ID:        uuid.New().String(),
+		Status:    batchRunning,
+		Transform: req.Transform,
+		Total:     len(images),
+		CreatedAt: time.Now().UTC(),
+	}
+	batches.add(job)
+	go s.runBatch(job, images, transform)
+
+	expires := time.Now().Unix() + uploadURLTTL
+	summary, _ := batches.get(job.ID)
+	c.IndentedJSON(http.StatusAccepted, gin.H{
+		"job":        summary,
+		"status_url": signedGetURL(c, batchNamespace, "/"+batchNamespace+"/"+job.ID, job.ID, expires),
+	})
+}
+
+// getBatch reports the progress of a job. The job id stands in for the
+// filename in its signature.
+func getBatch(c *gin.Context) {
+	job, ok := batches.get(c.Param("filename"))
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "No such batch job."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, job)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// c2paSigner signs C2PA content credentials into derivatives, with the key
+// and certificate chain of C2PA_KEY_FILE and C2PA_CERT_FILE; nil leaves
+// them unsigned.
+var c2paSigner *contentSigner
+
+// claimGenerator names this server in the manifests it signs.
+const claimGenerator = "image-server"
+
+type contentSigner struct {
+	key         crypto.PrivateKey
+	alg         int64 // COSE algorithm identifier
+	hash        crypto.Hash
+	chain       [][]byte // DER certificates, the signer's first
+	fingerprint string   // of the signer's certificate, for cache keys
+}
+
+// loadContentSigner reads a PEM private key and the PEM certificate chain
+// it signs for.
+func loadContentSigner(keyFile, certFile string) (*contentSigner, error) {
+	s, err := loadSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			s.chain = append(s.chain, block.Bytes)
+		}
+	}
+	if len(s.chain) == 0 {
+		return nil, errors.New(certFile + ": no PEM certificates")
+	}
+	leaf, err := x509.ParseCertificate(s.chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certFile, err)
+	}
+	public := s.key.(crypto.Signer).Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !public.Equal(leaf.PublicKey) {
+		return nil, errors.New(certFile + ": the first certificate isn't for the private key")
+	}
+	sum := sha256.Sum256(s.chain[0])
+	s.fingerprint = hex.EncodeToString(sum[:])
+	return s, nil
+}
+
+// loadSigningKey reads a PEM private key into a signer without a
+// certificate chain. ECDSA keys sign with ES256, ES384 or ES512 by curve,
+// RSA keys with PS256 and Ed25519 keys with EdDSA.
+func loadSigningKey(keyFile string) (*contentSigner, error) {
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New(keyFile + ": no PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, errors.New(keyFile + ": unsupported private key")
+			}
+		}
+	}
+
+	s := &contentSigner{key: key}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			s.alg, s.hash = -7, crypto.SHA256
+		case elliptic.P384():
+			s.alg, s.hash = -35, crypto.SHA384
+		case elliptic.P521():
+			s.alg, s.hash = -36, crypto.SHA512
+		default:
+			return nil, errors.New(keyFile + ": unsupported curve")
+		}
+	case *rsa.PrivateKey:
+		s.alg, s.hash = -37, crypto.SHA256
+	case ed25519.PrivateKey:
+		s.alg = -8
+	default:
+		return nil, errors.New(keyFile + ": unsupported private key")
+	}
+	return s, nil
+}
+
+// signBytes signs message as its COSE algorithm specifies, ECDSA signatures
+// being the fixed-size concatenation of r and s.
+func (s *contentSigner) signBytes(message []byte) ([]byte, error) {
+	if key, ok := s.key.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(key, message), nil
+	}
+	h := s.hash.New()
+	h.Write(message)
+	digest := h.Sum(nil)
+	switch key := s.key.(type) {
+	case *ecdsa.PrivateKey:
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		out := make([]byte, 2*size)
+		r.FillBytes(out[:size])
+		sig.FillBytes(out[size:])
+		return out, nil
+	case *rsa.PrivateKey:
+		return rsa.SignPSS(rand.Reader, key, s.hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	}
+	return nil, errors.New("unsupported private key")
+}
+
+// coseSign returns the COSE_Sign1 signature of the claim, with the payload
+// detached and the certificate chain in the protected header.
+func (s *contentSigner) coseSign(claim []byte) ([]byte, error) {
+	var x5chain any = s.chain[0]
+	if len(s.chain) > 1 {
+		certs := make([]any, len(s.chain))
+		for i, cert := range s.chain {
+			certs[i] = cert
+		}
+		x5chain = certs
+	}
+	protected := appendCBOR(nil, cborMap{{1, s.alg}, {33, x5chain}})
+	signature, err := s.signBytes(appendCBOR(nil, []any{"Signature1", protected, []byte{}, claim}))
+	if err != nil {
+		return nil, err
+	}
+	return appendCBOR(nil, cborTag{18, []any{protected, cborMap{}, nil, signature}}), nil
+}
+
+// c2paSource describes the stored image a derivative was made from, the
+// parent ingredient of its manifest.
+type c2paSource struct {
+	title, format string
+	digest        []byte // SHA-256 of its contents
+}
+
+// c2paSource reads and hashes the stored image filename.
+func (s *fileStore) c2paSource(ctx context.Context, filename string) (c2paSource, error) {
+	body, _, _, err := s.open(ctx, filename)
+	if err != nil {
+		return c2paSource{}, err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return c2paSource{}, err
+	}
+	return c2paSource{filename, getMimeType(filename), h.Sum(nil)}, nil
+}
+
+// c2paActions lists the edits opts makes to an image stored as
+// sourceFormat, in the order transformImage applies them.
+func (o transformOptions) c2paActions(sourceFormat string) []cborMap {
+	var actions []cborMap
+	add := func(action, description string) {
+		actions = append(actions, cborMap{{"action", action}, {"parameters", cborMap{{"description", description}}}})
+	}
+	if o.rotate != 0 || o.flip != "" {
+		add("c2pa.orientation", transformOptions{rotate: o.rotate, flip: o.flip}.query(false, false))
+	}
+	if r := o.crop; r != (image.Rectangle{}) {
+		add("c2pa.cropped", fmt.Sprintf("crop=%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy()))
+	}
+	if o.gravity != "" {
+		add("c2pa.cropped", "crop="+o.gravity)
+	}
+	if o.width > 0 || o.height > 0 {
+		add("c2pa.resized", transformOptions{width: o.width, height: o.height}.query(false, false))
+	}
+	if o.watermark {
+		add("c2pa.edited", "watermark")
+	}
+	if o.recipient != "" {
+		// The recipient itself stays out of the manifest.
+		add("c2pa.watermarked", "invisible watermark")
+	}
+	if o.format != sourceFormat {
+		add("c2pa.converted", "format="+o.format)
+	}
+	return actions
+}
+
+// thumbnailActions lists the edits of a thumbnail of size.
+func thumbnailActions(size int) []cborMap {
+	description := "thumbnail " + strconv.Itoa(size)
+	actions := []cborMap{{{"action", "c2pa.resized"}, {"parameters", cborMap{{"description", description}}}}}
+	if watermarkImage != nil && watermarkMode == watermarkAlways {
+		actions = append(actions, cborMap{{"action", "c2pa.edited"}, {"parameters", cborMap{{"description", "watermark"}}}})
+	}
+	return actions
+}
+
+// sign embeds a C2PA manifest into data, a JPEG or PNG encoded here, that
+// records source as its parent and actions as the edits made to it, and
+// binds it to data with a hash of everything but the manifest. Other
+// formats are returned unchanged.
+func (s *contentSigner) sign(data []byte, source c2paSource, actions []cborMap) ([]byte, error) {
+	var contentType string
+	var pos int // where the manifest goes
+	var embed func(store []byte) []byte
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		contentType, pos, embed = "image/jpeg", jpegHeaderEnd(data), jpegJUMBFSegments
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) && len(data) > 33:
+		// After IHDR.
+		contentType, pos = "image/png", 33
+		embed = func(store []byte) []byte { return appendPNGChunk(nil, "caBX", store) }
+	default:
+		return data, nil
+	}
+
+	// The manifest is excluded from the hash, so the hash is that of data
+	// as it is. Only the length of the exclusion depends on the manifest,
+	// whose size depends in turn on how that length is encoded.
+	digest := sha256.Sum256(data)
+	label := "urn:uuid:" + uuid.NewString()
+	when := time.Now().UTC().Format(time.RFC3339)
+	for length, attempt := 0, 0; attempt < 8; attempt++ {
+		store, err := s.manifestStore(label, contentType, when, source, actions, pos, length, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		embedded := embed(store)
+		if len(embedded) == length {
+			out := make([]byte, 0, len(data)+length)
+			out = append(out, data[:pos]...)
+			out = append(out, embedded...)
+			return append(out, data[pos:]...), nil
+		}
+		length = len(embedded)
+	}
+	return nil, errors.New("c2pa: manifest size doesn't settle")
+}
+
+// manifestStore builds the JUMBF manifest store of one manifest, whose
+// data hash excludes length bytes from start.
+func (s *contentSigner) manifestStore(label, contentType, when string, source c2paSource, edits []cborMap, start, length int, digest []byte) ([]byte, error) {
+	ingredient := c2paAssertion("c2pa.ingredient", cborMap{
+		{"dc:title", source.title},
+		{"dc:format", source.format},
+		{"instanceID", "xmp:iid:" + uuid.NewSHA1(uuid.NameSpaceOID, source.digest).String()},
+		{"relationship", "parentOf"},
+	})
+	actions := []any{cborMap{
+		{"action", "c2pa.opened"},
+		{"softwareAgent", claimGenerator},
+		{"when", when},
+		{"parameters", cborMap{{"ingredient", hashedURI("c2pa.ingredient", ingredient)}}},
+	}}
+	for _, edit := range edits {
+		actions = append(actions, append(cborMap{edit[0], {"softwareAgent", claimGenerator}, {"when", when}}, edit[1:]...))
+	}
+	actionsBox := c2paAssertion("c2pa.actions", cborMap{{"actions", actions}})
+	hashBox := c2paAssertion("c2pa.hash.data", cborMap{
+		{"exclusions", []any{cborMap{{"start", start}, {"length", length}}}},
+		{"name", "jumbf manifest"},
+		{"alg", "sha256"},
+		{"hash", digest},
+		{"pad", []byte{}},
+	})
+
+	claim := appendCBOR(nil, cborMap{
+		{"claim_generator", claimGenerator},
+		{"signature", "self#jumbf=c2pa.signature"},
+		{"assertions", []any{
+			hashedURI("c2pa.ingredient", ingredient),
+			hashedURI("c2pa.actions", actionsBox),
+			hashedURI("c2pa.hash.data", hashBox),
+		}},
+		{"dc:format", contentType},
+		{"instanceID", "xmp:iid:" + uuid.NewString()},
+		{"alg", "sha256"},
+	})
+	signature, err := s.coseSign(claim)
+	if err != nil {
+		return nil, err
+	}
+	manifest := jumbfSuperbox("c2ma", label,
+		jumbfSuperbox("c2as", "c2pa.assertions", ingredient, actionsBox, hashBox),
+		jumbfSuperbox("c2cl", "c2pa.claim", jumbfBox("cbor", claim)),
+		jumbfSuperbox("c2cs", "c2pa.signature", jumbfBox("cbor", signature)),
+	)
+	return jumbfSuperbox("c2pa", "c2pa", manifest), nil
+}
+
+// c2paAssertion wraps a CBOR assertion in its JUMBF superbox.
+func c2paAssertion(label string, content cborMap) []byte {
+	return jumbfSuperbox("cbor", label, jumbfBox("cbor", appendCBOR(nil, content)))
+}
+
+// hashedURI references the assertion box by its label and the hash of its
+// contents, the superbox minus its header.
+func hashedURI(label string, box []byte) cborMap {
+	sum := sha256.Sum256(box[8:])
+	return cborMap{{"url", "self#jumbf=c2pa.assertions/" + label}, {"hash", sum[:]}}
+}
+
+// jumbfBox is an ISO BMFF style box: its length, type and payload.
+func jumbfBox(kind string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	box = append(box, kind...)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+// jumbfSuperbox is a labelled JUMBF superbox whose content type is the C2PA
+// four-character code contentType.
+func jumbfSuperbox(contentType, label string, children ...[]byte) []byte {
+	description := append([]byte(contentType), 0x00, 0x11, 0x00, 0x10, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71)
+	description = append(description, 0x03) // requestable and labelled
+	description = append(append(description, label...), 0)
+	return jumbfBox("jumb", append([][]byte{jumbfBox("jumd", description)}, children...)...)
+}
+
+// jpegHeaderEnd returns the offset after the SOI marker and the APP0 and
+// APP1 segments following it.
+func jpegHeaderEnd(data []byte) int {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF && (data[pos+1] == 0xE0 || data[pos+1] == 0xE1) {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	return min(pos, len(data))
+}
+
+// jpegJUMBFSegments splits a JUMBF box into JPEG APP11 segments, each
+// repeating the box header after its JPEG XT header.
+func jpegJUMBFSegments(box []byte) []byte {
+	const maxChunk = 0xFFFF - 2 - 8 - 8
+	header, payload := box[:8], box[8:]
+	var out []byte
+	for sequence := uint32(1); sequence == 1 || len(payload) > 0; sequence++ {
+		chunk := payload[:min(len(payload), maxChunk)]
+		payload = payload[len(chunk):]
+		out = append(out, 0xFF, 0xEB)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+8+len(header)+len(chunk)))
+		out = append(out, 'J', 'P', 0x00, 0x01) // common identifier, box instance
+		out = binary.BigEndian.AppendUint32(out, sequence)
+		out = append(out, header...)
+		out = append(out, chunk...)
+	}
+	return out
+}
+
+// A minimal CBOR encoder for manifests. Maps keep the order of their
+// entries, so encoding is deterministic.
+type (
+	cborMap   []cborEntry
+	cborEntry struct{ key, value any }
+	cborTag   struct {
+		number  uint64
+		content any
+	}
+)
+
+func appendCBOR(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xF6)
+	case bool:
+		if v {
+			return append(b, 0xF5)
+		}
+		return append(b, 0xF4)
+	case int:
+		return appendCBOR(b, int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(b, 1, uint64(-1-v))
+		}
+		return cborHead(b, 0, uint64(v))
+	case []byte:
+		return append(cborHead(b, 2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(b, 3, uint64(len(v))), v...)
+	case []any:
+		b = cborHead(b, 4, uint64(len(v)))
+		for _, item := range v {
+			b = appendCBOR(b, item)
+		}
+		return b
+	case cborMap:
+		b = cborHead(b, 5, uint64(len(v)))
+		for _, entry := range v {
+			b = appendCBOR(appendCBOR(b, entry.key), entry.value)
+		}
+		return b
+	case cborTag:
+		return appendCBOR(cborHead(b, 6, v.number), v.content)
+	}
+	panic(fmt.Sprintf("cbor: unsupported type %T", v))
+}
+
+// cborHead encodes a major type and its argument in the shortest form.
+func cborHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= 0xFF:
+		return append(b, major|24, byte(n))
+	case n <= 0xFFFF:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= 0xFFFFFFFF:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache-Control values sent with images (CACHE_CONTROL_ORIGINALS) and their
+// conversions, thumbnails and icons (CACHE_CONTROL_VARIANTS). Empty sends
+// none.
+var (
+	originalsCacheControl string
+	variantsCacheControl  string
+)
+
+// cacheDirectives lists the response directives accepted in the settings,
+// and whether each takes a number of seconds.
+var cacheDirectives = map[string]bool{
+	"public":                 false,
+	"private":                false,
+	"no-cache":               false,
+	"no-store":               false,
+	"no-transform":           false,
+	"must-revalidate":        false,
+	"proxy-revalidate":       false,
+	"immutable":              false,
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+// parseCacheControl normalizes a Cache-Control setting, rejecting unknown
+// directives and malformed durations so typos don't reach the caches.
+func parseCacheControl(key, value string) (string, error) {
+	var directives []string
+	for _, directive := range strings.Split(value, ",") {
+		if directive = strings.ToLower(strings.TrimSpace(directive)); directive == "" {
+			continue
+		}
+		name, seconds, hasSeconds := strings.Cut(directive, "=")
+		takesSeconds, known := cacheDirectives[name]
+		if !known {
+			return "", errors.New(key + ": unknown directive " + name)
+		}
+		if takesSeconds != hasSeconds {
+			return "", errors.New(key + ": " + name + " must be given as " + name + "=<seconds>")
+		}
+		if _, err := strconv.ParseUint(seconds, 10, 32); hasSeconds && err != nil {
+			return "", errors.New(key + ": " + name + " must be a number of seconds")
+		}
+		directives = append(directives, directive)
+	}
+	return strings.Join(directives, ", "), nil
+}
+
+// setCacheControl sets value as the Cache-Control of the response. On a
+// signed URL, max-age and s-maxage are capped at the time left until the URL
+// expires, so caches don't keep serving it past its expiry.
+func setCacheControl(c *gin.Context, value string) {
+	if value == "" {
+		return
+	}
+	expires, ok := parseExpires(c.Query("expires"))
+	if !ok || c.Query("signature") == "" {
+		c.Header("Cache-Control", value)
+		return
+	}
+	remaining := max(expires-time.Now().Unix(), 0)
+	directives := strings.Split(value, ", ")
+	for i, directive := range directives {
+		name, seconds, _ := strings.Cut(directive, "=")
+		if name != "max-age" && name != "s-maxage" {
+			continue
+		}
+		if n, _ := strconv.ParseInt(seconds, 10, 64); n > remaining {
+			directives[i] = name + "=" + strconv.FormatInt(remaining, 10)
+		}
+	}
+	c.Header("Cache-Control", strings.Join(directives, ", "))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errChaosWrite = errors.New("chaos: injected partial write")
+
+// chaosConfig controls test-only fault injection. It is zero, and therefore
+// inert, unless CHAOS_ENABLED=true.
+type chaosConfig struct {
+	maxLatency       time.Duration
+	latencyRate      float64
+	errorRate        float64
+	partialWriteRate float64
+}
+
+var chaos chaosConfig
+
+func hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// ChaosMiddleware injects artificial latency and storage errors on image
+// routes so clients and their retries can be validated against failures.
+func ChaosMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if hit(chaos.latencyRate) && chaos.maxLatency > 0 {
+			time.Sleep(rand.N(chaos.maxLatency))
+		}
+		if hit(chaos.errorRate) {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Injected storage error."})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+type chaosReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// chaosWrap returns r, or with probability partialWriteRate a reader that
+// fails after a random number of bytes, so the storage write it feeds is
+// aborted part way.
+func chaosWrap(r io.Reader) io.Reader {
+	if !hit(chaos.partialWriteRate) {
+		return r
+	}
+	return &chaosReader{r: r, remaining: rand.Int64N(8 << 10)}
+}
+
+func (cr *chaosReader) Read(p []byte) (int, error) {
+	if cr.remaining <= 0 {
+		return 0, errChaosWrite
+	}
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// collectionsNamespace scopes the signatures of collection routes; the
+// collection id stands in for the filename.
+const collectionsNamespace = "collections"
+
+// Bounds of a collection's name and of the images it holds.
+const (
+	maxCollectionName   = 200
+	maxCollectionImages = 1000
+)
+
+var errCollectionFull = fmt.Errorf("a collection holds at most %d images", maxCollectionImages)
+
+// collection groups stored images, such as all photos of one product.
+type collection struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Count     int       `json:"count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type collectionImage struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+// collectionChange is the body of a PATCH of a collection; images already
+// in it, or not in it, are ignored.
+type collectionChange struct {
+	Name   *string  `json:"name"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// addCollection stores a new collection with its images.
+func (m *metadataStore) addCollection(ctx context.Context, col collection, images []string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.rebind("INSERT INTO collections (id, name, created_at, updated_at) VALUES (?, ?, ?, ?)"),
+		col.ID, col.Name, col.CreatedAt.UnixMilli(), col.UpdatedAt.UnixMilli()); err != nil {
+		return err
+	}
+	if err := m.addCollectionImages(ctx, tx, col.ID, images, col.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *metadataStore) addCollectionImages(ctx context.Context, tx *sql.Tx, id string, images []string, added time.Time) error {
+	for _, filename := range images {
+		if _, err := tx.ExecContext(ctx, m.rebind(
+			"INSERT INTO collection_images (collection_id, filename, added_at) VALUES (?, ?, ?) ON CONFLICT (collection_id, filename) DO NOTHING"),
+			id, filename, added.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collection returns the collection id, or ErrNotFound.
+func (m *metadataStore) collection(ctx context.Context, id string) (collection, error) {
+	col := collection{ID: id}
+	var created, updated int64
+	err := m.db.QueryRowContext(ctx, m.rebind(`
+		SELECT c.name, c.created_at, c.updated_at, (SELECT COUNT(*) FROM collection_images i WHERE i.collection_id = c.id)
+		FROM collections c WHERE c.id = ?`), id).Scan(&col.Name, &created, &updated, &col.Count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return col, ErrNotFound
+	}
+	col.CreatedAt, col.UpdatedAt = time.UnixMilli(created).UTC(), time.UnixMilli(updated).UTC()
+	return col, err
+}
+
+// collectionImages returns the images of collection id in the order they
+// were added.
+func (m *metadataStore) collectionImages(ctx context.Context, id string) ([]collectionImage, error) {
+	rows, err := m.db.QueryContext(ctx, m.rebind(
+		"SELECT filename, added_at FROM collection_images WHERE collection_id = ? ORDER BY added_at, filename"), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := []collectionImage{}
+	for rows.Next() {
+		var image collectionImage
+		var added int64
+		if err := rows.Scan(&image.Filename, &added); err != nil {
+			return nil, err
+		}
+		image.ContentType, image.AddedAt = getMimeType(image.Filename), time.UnixMilli(added).UTC()
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// changeCollection applies change to collection id, or returns
+// errCollectionFull when it would hold too many images.
+func (m *metadataStore) changeCollection(ctx context.Context, id string, change collectionChange) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	if change.Name != nil {
+		if _, err := tx.ExecContext(ctx, m.rebind("UPDATE collections SET name = ? WHERE id = ?"), *change.Name, id); err != nil {
+			return err
+		}
+	}
+	for _, filename := range change.Remove {
+		if _, err := tx.ExecContext(ctx, m.rebind("DELETE FROM collection_images WHERE collection_id = ? AND filename = ?"), id, filename); err != nil {
+			return err
+		}
+	}
+	if err := m.addCollectionImages(ctx, tx, id, change.Add, now); err != nil {
+		return err
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, m.rebind("SELECT COUNT(*) FROM collection_images WHERE collection_id = ?"), id).Scan(&count); err != nil {
+		return err
+	}
+	if count > maxCollectionImages {
+		return errCollectionFull
+	}
+	if _, err := tx.ExecContext(ctx, m.rebind("UPDATE collections SET updated_at = ? WHERE id = ?"), now.UnixMilli(), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteCollection removes collection id, not its images, or returns
+// ErrNotFound.
+func (m *metadataStore) deleteCollection(ctx context.Context, id string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, m.rebind("DELETE FROM collections WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, m.rebind("DELETE FROM collection_images WHERE collection_id = ?"), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// collectable checks that every one of images is stored, answering for c
+// with the first that isn't. Read-only assets can't be collected: the
+// metadata store doesn't follow them.
+func (s *fileStore) collectable(c *gin.Context, images []string) bool {
+	for _, filename := range images {
+		if _, err := s.storage.Stat(c.Request.Context(), filename); err != nil {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found: " + filename})
+			return false
+		}
+	}
+	return true
+}
+
+// collectionsEnabled answers 501 for c when there is no metadata store to
+// keep collections in.
+func (s *fileStore) collectionsEnabled(c *gin.Context) bool {
+	if s.metadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return false
+	}
+	return true
+}
+
+// validCollectionName returns a message for the client when name can't
+// name a collection.
+func validCollectionName(name string) string {
+	if strings.TrimSpace(name) == "" || len(name) > maxCollectionName {
+		return "name must be 1 to " + strconv.Itoa(maxCollectionName) + " bytes"
+	}
+	return ""
+}
+
+// createCollection creates a collection from a JSON body such as
+// {"name": "Product 42", "images": ["a.jpg", "b.jpg"]} and answers 201
+// with it and a signed URL of its contents.
+func (s *fileStore) createCollection(c *gin.Context) {
+	if !s.collectionsEnabled(c) {
+		return
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		Images []string `json:"images"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "A name and a list of images are required."})
+		return
+	}
+	if problem := validCollectionName(req.Name); problem != "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": problem})
+		return
+	}
+	images := req.Images
+	if len(images) > maxCollectionImages {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": errCollectionFull.Error()})
+		return
+	}
+	if !s.collectable(c, images) {
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	col := collection{ID: uuid.New().String(), Name: req.Name, CreatedAt: now, UpdatedAt: now}
+	if err := s.metadata.addCollection(c.Request.Context(), col, images); err != nil {
+		logger.Error("failed to create collection", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to create the collection."})
+		return
+	}
+	col, err := s.metadata.collection(c.Request.Context(), col.ID)
+	if err != nil {
+		logger.Error("collection lookup failed", "collection", col.ID, "error", err)
+	}
+	expires := time.Now().Unix() + uploadURLTTL
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"collection": col,
+		"url":        signedGetURL(c, collectionsNamespace, "/"+collectionsNamespace+"/"+col.ID, col.ID, expires),
+	})
+}
+
+// getCollection serves a collection with its images. The images aren't
+// signed for: anyone allowed to change a collection can add any stored
+// image to it, so reading it mustn't grant reading them.
+func (s *fileStore) getCollection(c *gin.Context) {
+	if !s.collectionsEnabled(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	id := c.Param("filename")
+	col, err := s.metadata.collection(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "No such collection."})
+		return
+	}
+	if err != nil {
+		logger.Error("collection lookup failed", "collection", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the collection."})
+		return
+	}
+	images, err := s.metadata.collectionImages(ctx, id)
+	if err != nil {
+		logger.Error("collection lookup failed", "collection", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the collection."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"collection": col, "images": images})
+}
+
+// patchCollection renames a collection or adds and removes images, and
+// answers with the collection.
+func (s *fileStore) patchCollection(c *gin.Context) {
+	if !s.collectionsEnabled(c) {
+		return
+	}
+	var change collectionChange
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid collection change."})
+		return
+	}
+	if change.Name != nil {
+		if problem := validCollectionName(*change.Name); problem != "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": problem})
+			return
+		}
+	}
+	ctx := c.Request.Context()
+	id := c.Param("filename")
+	col, err := s.metadata.collection(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "No such collection."})
+		return
+	}
+	if err != nil {
+		logger.Error("collection lookup failed", "collection", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the collection."})
+		return
+	}
+	if len(change.Add) > maxCollectionImages {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": errCollectionFull.Error()})
+		return
+	}
+	if !s.collectable(c, change.Add) {
+		return
+	}
+	err = s.metadata.changeCollection(ctx, id, change)
+	if errors.Is(err, errCollectionFull) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("failed to change collection", "collection", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to change the collection."})
+		return
+	}
+	if col, err = s.metadata.collection(ctx, id); err != nil {
+		logger.Error("collection lookup failed", "collection", id, "error", err)
+	}
+	c.IndentedJSON(http.StatusOK, col)
+}
+
+// removeCollection deletes a collection; its images are kept.
+func (s *fileStore) removeCollection(c *gin.Context) {
+	if !s.collectionsEnabled(c) {
+		return
+	}
+	id := c.Param("filename")
+	err := s.metadata.deleteCollection(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "No such collection."})
+		return
+	}
+	if err != nil {
+		logger.Error("failed to delete collection", "collection", id, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to delete the collection."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Collection removed"})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// responseCompression enables compressing text responses for clients that
+// accept it (RESPONSE_COMPRESSION). It can be toggled at runtime.
+var responseCompression atomic.Bool
+
+// compressibleTypes are the Content-Type prefixes worth compressing; the
+// images and other binary formats served are compressed already.
+var compressibleTypes = []string{"image/svg+xml", "application/json", "text/"}
+
+// maxPrecompressSize bounds the SVGs compressed ahead of time on upload.
+const maxPrecompressSize = 16 << 20
+
+// contentEncodings lists the supported encodings in order of preference
+// with their file extensions for pre-compressed copies.
+var contentEncodings = []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+func compressible(contentType string) bool {
+	return slices.ContainsFunc(compressibleTypes, func(prefix string) bool {
+		return strings.HasPrefix(contentType, prefix)
+	})
+}
+
+// acceptedEncoding returns the preferred encoding the client lists in
+// Accept-Encoding, or "" when it accepts none of them.
+func acceptedEncoding(c *gin.Context) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(c.GetHeader("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(name)] = true
+	}
+	for _, encoding := range contentEncodings {
+		if accepted[encoding.name] {
+			return encoding.name
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses the body when the response turns out to be of
+// a compressible type. The decision waits for the first write, since gin
+// renderers set Content-Type after the status.
+type compressWriter struct {
+	gin.ResponseWriter
+	method   string
+	encoding string
+	decided  bool
+	encoder  io.WriteCloser
+}
+
+func (w *compressWriter) decide(status int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	header := w.Header()
+	if !compressible(header.Get("Content-Type")) || header.Get("Content-Encoding") != "" {
+		return
+	}
+	header.Add("Vary", "Accept-Encoding")
+	// Ranges address the stored bytes, and bodiless responses have nothing
+	// to compress.
+	if w.encoding == "" || w.method == http.MethodHead || status == http.StatusPartialContent ||
+		status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	}
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", w.encoding)
+	// The encoded body is a different representation from the one the
+	// content hash describes.
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	if w.encoding == "br" {
+		w.encoder = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+	} else {
+		w.encoder, _ = gzip.NewWriterLevel(w.ResponseWriter, gzip.DefaultCompression)
+	}
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	w.decide(w.Status())
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	w.decide(w.Status())
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.encoder.Write(p)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// CompressionMiddleware compresses SVG, JSON and text responses with brotli
+// or gzip, whichever the client prefers of those it accepts.
+func CompressionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !responseCompression.Load() {
+			c.Next()
+			return
+		}
+		w := &compressWriter{ResponseWriter: c.Writer, method: c.Request.Method, encoding: acceptedEncoding(c)}
+		c.Writer = w
+		defer func() {
+			if w.encoder != nil {
+				w.encoder.Close()
+			}
+		}()
+		c.Next()
+	}
+}
+
+// precompressedName is the object name of a pre-compressed copy of
+// filename, stored in a dot-directory beside the originals like thumbnails.
+func precompressedName(filename, ext string) string {
+	return ".compressed/" + filename + ext
+}
+
+func isSVG(filename string) bool {
+	return strings.EqualFold(getMimeType(filename), "image/svg+xml")
+}
+
+// precompress stores brotli and gzip copies of an SVG so it can be served
+// compressed without compressing it on every request.
+func (s *fileStore) precompress(ctx context.Context, filename string) {
+	if !responseCompression.Load() || !isSVG(filename) {
+		return
+	}
+	body, info, err := s.storage.Get(ctx, filename)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	if info.Size > maxPrecompressSize {
+		return
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return
+	}
+	for _, encoding := range contentEncodings {
+		var buf bytes.Buffer
+		var encoder io.WriteCloser
+		if encoding.name == "br" {
+			encoder = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+		} else {
+			encoder, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		}
+		encoder.Write(data)
+		encoder.Close()
+		name := precompressedName(filename, encoding.ext)
+		stored, err := s.storage.Put(ctx, name, &buf)
+		if err != nil {
+			logger.Error("failed to store pre-compressed copy", "file", filename, "encoding", encoding.name, "error", err)
+			continue
+		}
+		s.metadata.recordDerivative(ctx, derivative{
+			Source:      filename,
+			Name:        name,
+			Kind:        derivedCompressed,
+			Variant:     encoding.name,
+			ContentType: getMimeType(filename),
+			Size:        stored.Size,
+		})
+	}
+}
+
+// removePrecompressed deletes the pre-compressed copies of filename.
+func (s *fileStore) removePrecompressed(ctx context.Context, filename string) {
+	if !isSVG(filename) {
+		return
+	}
+	for _, encoding := range contentEncodings {
+		s.storage.Delete(ctx, precompressedName(filename, encoding.ext))
+	}
+}
+
+// servePrecompressed serves the pre-compressed copy of an SVG in the
+// client's preferred encoding, and reports whether there was one.
+func (s *fileStore) servePrecompressed(c *gin.Context, filename string) bool {
+	if !responseCompression.Load() || !isSVG(filename) {
+		return false
+	}
+	encoding := acceptedEncoding(c)
+	for _, e := range contentEncodings {
+		if e.name != encoding {
+			continue
+		}
+		body, info, err := s.storage.Get(c.Request.Context(), precompressedName(filename, e.ext))
+		if err != nil {
+			return false
+		}
+		defer body.Close()
+		contentType := getMimeType(filename)
+		c.Header("Content-Disposition", s.disposition(contentType)+"; filename="+filename)
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Encoding", e.name)
+		c.Header("Vary", "Accept-Encoding")
+		c.Header("X-Content-Type-Options", "nosniff")
+		setCacheControl(c, s.cacheControl)
+		writeObject(c, filename, contentType, body, info)
+		return true
+	}
+	return false
+}
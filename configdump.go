@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const redacted = "[redacted]"
+
+// resolvedSettings records every setting read from the environment with the
+// value in effect, defaults included, for the startup banner and
+// GET /admin/config. Secrets are recorded redacted.
+var (
+	resolvedMu       sync.Mutex
+	resolvedSettings = map[string]string{}
+)
+
+func recordSetting(key, value string) {
+	resolvedMu.Lock()
+	resolvedSettings[key] = redactSetting(key, value)
+	resolvedMu.Unlock()
+}
+
+// recordSecret records that the secret key is set, and where it was read
+// from, without its value.
+func recordSecret(key, value, source string) {
+	if value != "" {
+		value = redacted
+		if source != "" {
+			value += " (" + source + ")"
+		}
+	}
+	resolvedMu.Lock()
+	resolvedSettings[key] = value
+	resolvedMu.Unlock()
+}
+
+// redactSetting hides values that look secret even when read as plain
+// settings: those named like credentials, and passwords in URLs.
+func redactSetting(key, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, marker := range []string{"SECRET", "TOKEN", "PASSWORD"} {
+		if strings.Contains(key, marker) {
+			return redacted
+		}
+	}
+	if strings.HasSuffix(key, "_KEY") {
+		return redacted
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// activeModules summarizes which storage, authentication and processing
+// features the configuration turns on.
+func activeModules() gin.H {
+	storage := []string{storageBackend}
+	if len(storageTimeouts) > 0 && storageBackend != storageLocal {
+		storage = append(storage, "timeouts")
+	}
+	if hotCacheMaxBytes > 0 {
+		storage = append(storage, "hot_cache")
+	}
+
+	auth := []string{"signed_urls"}
+	for _, module := range []struct {
+		name string
+		on   bool
+	}{
+		{"one_time_urls", oneTimeURLs.Load()},
+		{"host_binding", requireHostBinding},
+		{"token_exchange", apiKey.Get() != ""},
+		{"email_ingest", emailIngestToken.Get() != ""},
+		{"admin_api", len(adminUsers) > 0},
+		{"admin_listener", adminAddr != ""},
+		{"secrets_refresh", secretsRefresh > 0 && slices.ContainsFunc(rotatingSecrets, func(s *secret) bool { return s.external })},
+	} {
+		if module.on {
+			auth = append(auth, module.name)
+		}
+	}
+
+	var processing []string
+	for _, module := range []struct {
+		name string
+		on   bool
+	}{
+		{"strip_exif", stripExif.Load()},
+		{"copyright_metadata", copyrightMetadata},
+		{"c2pa", c2paSigner != nil},
+		{"integrity_exports", integritySigner != nil},
+		{"invisible_watermark", traceKey != nil},
+		{"reference_alerts", referenceWebhookURL != ""},
+		{"auto_orient", autoOrient.Load()},
+		{"placeholders", uploadPlaceholders},
+		{"pii_" + piiPolicy, piiPolicy != piiOff},
+		{"watermark_" + watermarkMode, watermarkImage != nil},
+		{"response_compression", responseCompression.Load()},
+		{"canonical_redirects", canonicalRedirects.Load()},
+		{"chaos", chaos != (chaosConfig{})},
+	} {
+		if module.on {
+			processing = append(processing, module.name)
+		}
+	}
+	return gin.H{"storage": storage, "auth": auth, "processing": processing}
+}
+
+// effectiveConfig is the resolved configuration with secrets redacted.
+func effectiveConfig() gin.H {
+	resolvedMu.Lock()
+	settings := make(map[string]string, len(resolvedSettings))
+	for key, value := range resolvedSettings {
+		settings[key] = value
+	}
+	resolvedMu.Unlock()
+	return gin.H{"modules": activeModules(), "settings": settings}
+}
+
+// logStartupBanner logs the effective configuration once at boot, so a
+// misconfiguration shows in the first lines of the log.
+func logStartupBanner() {
+	config := effectiveConfig()
+	modules := config["modules"].(gin.H)
+	logger.Info("image server starting", "port", serverPort,
+		"storage", modules["storage"], "auth", modules["auth"], "processing", modules["processing"])
+
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	args := make([]any, 0, 2*len(resolvedSettings))
+	for _, key := range sortedKeys(resolvedSettings) {
+		args = append(args, key, resolvedSettings[key])
+	}
+	logger.Info("effective configuration", args...)
+}
+
+// getEffectiveConfig serves the redacted configuration for debugging.
+func getEffectiveConfig(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, effectiveConfig())
+}
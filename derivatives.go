@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of derivatives. Every kind but derivedTransform is an object in
+// the storage beside its source; transforms live in the transform cache.
+const (
+	derivedThumbnail   = "thumbnail"
+	derivedPlaceholder = "placeholder"
+	derivedCompressed  = "compressed"
+	derivedTransform   = "transform"
+)
+
+// derivative is a file generated from a stored image. Variant tells
+// derivatives of one kind apart: the size of a thumbnail, the encoding of a
+// compressed copy, the query of a transform.
+type derivative struct {
+	Source      string    `json:"-"`
+	Name        string    `json:"name"`
+	Kind        string    `json:"kind"`
+	Variant     string    `json:"variant,omitempty"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	// URL is where the derivative is served, with the source's GET
+	// signature; compressed copies are served in place of the source.
+	URL string `json:"url,omitempty"`
+}
+
+// recordDerivative registers a derivative of its source, replacing the
+// entry of the same name. Like record, a failure is only logged.
+func (m *metadataStore) recordDerivative(ctx context.Context, d derivative) {
+	if m == nil {
+		return
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	_, err := m.db.ExecContext(ctx, m.rebind(`
+		INSERT INTO derivatives (source, name, kind, variant, content_type, size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (source, name) DO UPDATE SET
+			content_type = excluded.content_type, size = excluded.size, created_at = excluded.created_at`),
+		d.Source, d.Name, d.Kind, d.Variant, d.ContentType, d.Size, d.CreatedAt.UnixMilli())
+	if err != nil {
+		logger.Error("failed to record derivative", "file", d.Source, "derivative", d.Name, "error", err)
+	}
+}
+
+// derivatives returns the registered derivatives of source by kind and
+// variant.
+func (m *metadataStore) derivatives(ctx context.Context, source string) ([]derivative, error) {
+	rows, err := m.db.QueryContext(ctx, m.rebind(`
+		SELECT source, name, kind, variant, content_type, size, created_at FROM derivatives
+		WHERE source = ? ORDER BY kind, variant, name`), source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	derivatives := []derivative{}
+	for rows.Next() {
+		var d derivative
+		var created int64
+		if err := rows.Scan(&d.Source, &d.Name, &d.Kind, &d.Variant, &d.ContentType, &d.Size, &created); err != nil {
+			return nil, err
+		}
+		d.CreatedAt = time.UnixMilli(created).UTC()
+		derivatives = append(derivatives, d)
+	}
+	return derivatives, rows.Err()
+}
+
+// forgetDerivative drops one registry entry.
+func (m *metadataStore) forgetDerivative(ctx context.Context, source, name string) {
+	if _, err := m.db.ExecContext(ctx, m.rebind("DELETE FROM derivatives WHERE source = ? AND name = ?"), source, name); err != nil {
+		logger.Error("failed to forget derivative", "file", source, "derivative", name, "error", err)
+	}
+}
+
+// parseDerivedName recognizes the storage objects generated from an image
+// by their names, for registering those stored before the registry was.
+func parseDerivedName(object ObjectInfo) (derivative, bool) {
+	d := derivative{Name: object.Name, ContentType: getMimeType(object.Name), Size: object.Size, CreatedAt: object.ModTime}
+	switch {
+	case strings.HasPrefix(object.Name, ".thumbs/"):
+		source, file, ok := cutLast(strings.TrimPrefix(object.Name, ".thumbs/"), "/")
+		size := strings.TrimSuffix(file, filepath.Ext(file))
+		if _, err := strconv.Atoi(size); !ok || err != nil {
+			return d, false
+		}
+		d.Source, d.Kind, d.Variant = source, derivedThumbnail, size
+	case strings.HasPrefix(object.Name, ".placeholders/") && strings.HasSuffix(object.Name, ".json"):
+		d.Source, d.Kind = strings.TrimSuffix(strings.TrimPrefix(object.Name, ".placeholders/"), ".json"), derivedPlaceholder
+	case strings.HasPrefix(object.Name, ".compressed/"):
+		for _, encoding := range contentEncodings {
+			if source, ok := strings.CutSuffix(strings.TrimPrefix(object.Name, ".compressed/"), encoding.ext); ok {
+				d.Source, d.Kind, d.Variant = source, derivedCompressed, encoding.name
+				d.ContentType = getMimeType(source)
+				return d, !isDerivedObject(source)
+			}
+		}
+		return d, false
+	default:
+		return d, false
+	}
+	return d, d.Source != "" && !isDerivedObject(d.Source)
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// derivedPrefixes are the dot-directories derivatives are stored in.
+var derivedPrefixes = []string{".thumbs/", ".placeholders/", ".compressed/"}
+
+// reconcileDerivatives registers the derived objects in storage the
+// registry doesn't know and drops entries of those that are gone. objects
+// are the originals listed at listed; entries written since are kept.
+func (m *metadataStore) reconcileDerivatives(ctx context.Context, storage Storage, objects []ObjectInfo, listed time.Time) error {
+	var derived []ObjectInfo
+	for _, prefix := range derivedPrefixes {
+		found, err := storage.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		derived = append(derived, found...)
+	}
+	rows, err := m.db.QueryContext(ctx, m.rebind("SELECT source, name, created_at FROM derivatives WHERE kind <> ?"), derivedTransform)
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		source  string
+		created int64
+	}
+	known := map[string]entry{}
+	for rows.Next() {
+		var source, name string
+		var created int64
+		if err := rows.Scan(&source, &name, &created); err != nil {
+			rows.Close()
+			return err
+		}
+		known[name] = entry{source, created}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stored := map[string]bool{}
+	for _, object := range objects {
+		stored[object.Name] = true
+	}
+	var added, dropped int
+	for _, object := range derived {
+		if _, ok := known[object.Name]; ok {
+			delete(known, object.Name)
+			continue
+		}
+		// Leftovers of deleted images aren't adopted.
+		if d, ok := parseDerivedName(object); ok && stored[d.Source] {
+			m.recordDerivative(ctx, d)
+			added++
+		}
+	}
+	for name, e := range known {
+		if e.created < listed.UnixMilli() {
+			m.forgetDerivative(ctx, e.source, name)
+			dropped++
+		}
+	}
+	if added > 0 || dropped > 0 {
+		logger.Info("derivatives reconciled", "added", added, "dropped", dropped)
+	}
+	return nil
+}
+
+// removeDerivatives deletes every registered derivative of filename, such
+// as thumbnails of sizes no longer configured, and their entries. Cached
+// transforms are dropped by purgeTransforms.
+func (s *fileStore) removeDerivatives(ctx context.Context, filename string) {
+	if s.metadata == nil {
+		return
+	}
+	derivatives, err := s.metadata.derivatives(ctx, filename)
+	if err != nil {
+		logger.Error("derivative lookup failed", "file", filename, "error", err)
+		return
+	}
+	for _, d := range derivatives {
+		if d.Kind != derivedTransform {
+			if err := s.storage.Delete(ctx, d.Name); err != nil && !errors.Is(err, ErrNotFound) {
+				logger.Warn("failed to delete derivative", "file", filename, "derivative", d.Name, "error", err)
+				continue
+			}
+		}
+		s.metadata.forgetDerivative(ctx, filename, d.Name)
+	}
+}
+
+// listDerivatives serves the registered derivatives of an image. Cached
+// transforms evicted or purged since they were rendered are dropped from
+// the registry on the way.
+func (s *fileStore) listDerivatives(c *gin.Context) {
+	filename := c.Param("filename")
+	if s.metadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	ctx := c.Request.Context()
+	if _, _, err := s.stat(ctx, filename); err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	derivatives, err := s.metadata.derivatives(ctx, filename)
+	if err != nil {
+		logger.Error("derivative lookup failed", "file", filename, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read derivatives."})
+		return
+	}
+	listed := []derivative{}
+	for _, d := range derivatives {
+		path := s.route + "/" + filename
+		switch d.Kind {
+		case derivedTransform:
+			if s.cache == nil || !s.cache.has(d.Name) {
+				s.metadata.forgetDerivative(ctx, filename, d.Name)
+				continue
+			}
+			d.URL = publicPath(path) + "?" + d.Variant
+		case derivedThumbnail:
+			// Sizes no longer configured aren't served.
+			if size, _ := strconv.Atoi(d.Variant); slices.Contains(s.thumbnailSizes, size) {
+				d.URL = publicPath(path + "/thumb/" + url.PathEscape(d.Variant))
+			}
+		case derivedPlaceholder:
+			d.URL = publicPath(path + "/placeholder")
+		}
+		listed = append(listed, d)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"filename": filename, "derivatives": listed, "count": len(listed)})
+}
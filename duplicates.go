@@ -0,0 +1,230 @@
+package main
+
+import (
+	"image"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type storedFile struct {
+	name     string
+	path     string
+	size     int64
+	modTime  time.Time
+	checksum string
+	hash     uint64
+	hashed   bool
+}
+
+type duplicateCluster struct {
+	Kind      string   `json:"kind"`
+	Canonical string   `json:"canonical"`
+	Members   []string `json:"members"`
+	Refcount  int      `json:"refcount"`
+	Bytes     int64    `json:"reclaimable_bytes"`
+}
+
+// dHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its
+// right neighbour. Near-identical images differ in only a few bits.
+func dHash(path string) (uint64, error) {
+	img, _, err := decodeImage(path)
+	if err != nil {
+		return 0, err
+	}
+	return imageDHash(img), nil
+}
+
+// imageDHash computes the difference hash of a decoded image.
+func imageDHash(img image.Image) uint64 {
+	small := resizeImage(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luminance(small, x, y) > luminance(small, x+1, y) {
+				hash |= 1 << (y*8 + x)
+			}
+		}
+	}
+	return hash
+}
+
+// scanStoredFiles checksums and hashes every regular file in dir.
+func scanStoredFiles(dir string) ([]*storedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*storedFile
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		checksum, _, err := fileChecksum(path)
+		if err != nil {
+			continue
+		}
+		f := &storedFile{name: entry.Name(), path: path, size: info.Size(), modTime: info.ModTime(), checksum: checksum}
+		if f.hash, err = dHash(path); err == nil {
+			f.hashed = true
+		}
+		files = append(files, f)
+	}
+
+	// The oldest upload of a cluster becomes its canonical object.
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, nil
+}
+
+// findDuplicates groups byte-identical files, then clusters the remaining
+// images whose perceptual hashes are within maxDistance bits.
+func findDuplicates(files []*storedFile, maxDistance int) []duplicateCluster {
+	var clusters []duplicateCluster
+	clustered := make(map[string]bool)
+
+	byChecksum := make(map[string][]*storedFile)
+	var order []string
+	for _, f := range files {
+		if _, seen := byChecksum[f.checksum]; !seen {
+			order = append(order, f.checksum)
+		}
+		byChecksum[f.checksum] = append(byChecksum[f.checksum], f)
+	}
+	for _, checksum := range order {
+		group := byChecksum[checksum]
+		if len(group) < 2 {
+			continue
+		}
+		cluster := duplicateCluster{Kind: "exact", Canonical: group[0].name, Refcount: len(group)}
+		for _, f := range group {
+			cluster.Members = append(cluster.Members, f.name)
+			clustered[f.name] = true
+		}
+		cluster.Bytes = group[0].size * int64(len(group)-1)
+		clusters = append(clusters, cluster)
+	}
+
+	for i, a := range files {
+		if !a.hashed || clustered[a.name] {
+			continue
+		}
+		cluster := duplicateCluster{Kind: "perceptual", Canonical: a.name, Members: []string{a.name}}
+		for _, b := range files[i+1:] {
+			if b.hashed && !clustered[b.name] && bits.OnesCount64(a.hash^b.hash) <= maxDistance {
+				cluster.Members = append(cluster.Members, b.name)
+				cluster.Bytes += b.size
+				clustered[b.name] = true
+			}
+		}
+		if len(cluster.Members) > 1 {
+			clustered[a.name] = true
+			cluster.Refcount = len(cluster.Members)
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters
+}
+
+// mergeCluster turns every member into a hard link to the canonical object,
+// so all existing names keep working while the data is stored once.
+func mergeCluster(dir string, cluster duplicateCluster) error {
+	canonical := filepath.Join(dir, cluster.Canonical)
+	canonicalInfo, err := os.Stat(canonical)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range cluster.Members {
+		path := filepath.Join(dir, member)
+		if info, err := os.Stat(path); err == nil && os.SameFile(info, canonicalInfo) {
+			continue
+		}
+		tmp := filepath.Join(dir, ".merge-"+member)
+		if err := os.Link(canonical, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+func duplicateDistance(c *gin.Context) int {
+	if d, err := strconv.Atoi(c.Query("distance")); err == nil && d >= 0 {
+		return d
+	}
+	return duplicateHashDistance
+}
+
+func reportDuplicates(c *gin.Context) {
+	if storageBackend != storageLocal {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Duplicate cleanup requires the local storage backend."})
+		return
+	}
+	files, err := scanStoredFiles(uploadDirPath)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to scan uploads."})
+		return
+	}
+	clusters := findDuplicates(files, duplicateDistance(c))
+	c.IndentedJSON(http.StatusOK, gin.H{"scanned": len(files), "clusters": clusters})
+}
+
+// mergeDuplicates aliases exact duplicates to their canonical object;
+// perceptual clusters are only merged with ?perceptual=true because their
+// members' content is replaced by the canonical image.
+func mergeDuplicates(c *gin.Context) {
+	if storageBackend != storageLocal {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Duplicate cleanup requires the local storage backend."})
+		return
+	}
+	files, err := scanStoredFiles(uploadDirPath)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to scan uploads."})
+		return
+	}
+	includePerceptual := c.Query("perceptual") == "true"
+
+	merged := []duplicateCluster{}
+	var reclaimed int64
+	for _, cluster := range findDuplicates(files, duplicateDistance(c)) {
+		if cluster.Kind == "perceptual" && !includePerceptual {
+			continue
+		}
+		if err := mergeCluster(uploadDirPath, cluster); err != nil {
+			logger.Error("failed to merge duplicates", "canonical", cluster.Canonical, "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to merge duplicates.", "merged": merged})
+			return
+		}
+		logger.Info("merged duplicates", "kind", cluster.Kind, "canonical", cluster.Canonical, "members", cluster.Members)
+		// Members of a perceptual cluster now hold the canonical image.
+		if cluster.Kind == "perceptual" && imageMetadata != nil {
+			if canonical, err := imageMetadata.get(c.Request.Context(), cluster.Canonical); err == nil {
+				for _, member := range cluster.Members {
+					imageMetadata.record(c.Request.Context(), imageRecord{Filename: member, ContentType: canonical.ContentType, Size: canonical.Size, SHA256: canonical.SHA256})
+				}
+			}
+		}
+		merged = append(merged, cluster)
+		reclaimed += cluster.Bytes
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"merged": merged, "reclaimed_bytes": reclaimed})
+}
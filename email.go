@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// emailSender returns the sender of an inbound email webhook. SendGrid's
+// Inbound Parse posts "from"; Mailgun routes post "sender" as well.
+func emailSender(c *gin.Context) string {
+	if sender := c.PostForm("sender"); sender != "" {
+		return sender
+	}
+	return c.PostForm("from")
+}
+
+// ingestEmail stores the image attachments of an inbound email webhook in
+// SendGrid or Mailgun format, enabling "email your photo to..." workflows.
+func ingestEmail(c *gin.Context) {
+	token := c.Query("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(emailIngestToken.Get())) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid ingest token"})
+		return
+	}
+
+	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid email payload."})
+		return
+	}
+	sender := emailSender(c)
+
+	stored := []gin.H{}
+	for _, headers := range c.Request.MultipartForm.File {
+		for _, header := range headers {
+			contentType := header.Header.Get("Content-Type")
+			if contentType == "" || contentType == "application/octet-stream" {
+				contentType = getMimeType(header.Filename)
+			}
+			if !strings.HasPrefix(contentType, "image/") {
+				continue
+			}
+
+			attachment, err := header.Open()
+			if err != nil {
+				continue
+			}
+			findings, err := checkPII(attachment)
+			if len(findings) > 0 {
+				recordPIIFindings("/ingest/email", header.Filename, findings)
+			}
+			if err != nil {
+				// Rejected or unreadable; the rest of the email is still processed.
+				attachment.Close()
+				continue
+			}
+			newFileName := newImageName(header.Filename)
+			h := sha256.New()
+			body := uploadReader(attachment, findings)
+			info, err := imageStorage.Put(c.Request.Context(), newFileName, io.TeeReader(body, h))
+			body.Close()
+			attachment.Close()
+			if err != nil {
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to save file."})
+				return
+			}
+			imageMetadata.record(c.Request.Context(), imageRecord{
+				Filename:         newFileName,
+				OriginalFilename: header.Filename,
+				ContentType:      getMimeType(newFileName),
+				Size:             info.Size,
+				SHA256:           hex.EncodeToString(h.Sum(nil)),
+				Uploader:         sender,
+				Source:           sourceEmail,
+			})
+			go imageMetadata.screen(context.Background(), newFileName)
+
+			logger.Info("ingested email attachment",
+				"sender", sender,
+				"original_filename", header.Filename,
+				"filename", newFileName,
+				"size", header.Size)
+			stored = append(stored, gin.H{
+				"filename":          newFileName,
+				"original_filename": header.Filename,
+				"size":              header.Size,
+			})
+		}
+	}
+
+	// Providers retry on non-2xx, so an email without images is still accepted.
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"message": "Email processed",
+		"sender":  sender,
+		"files":   stored,
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxETagMemo bounds the remembered content hashes; the memo starts over
+// when it fills up.
+const maxETagMemo = 1 << 16
+
+// etagKey identifies one version of a stored object.
+type etagKey struct {
+	name    string
+	size    int64
+	modTime int64
+}
+
+var (
+	etagMu   sync.Mutex
+	etagMemo = map[etagKey]string{}
+)
+
+func etagKeyOf(info ObjectInfo) etagKey {
+	return etagKey{name: info.Name, size: info.Size, modTime: info.ModTime.UnixNano()}
+}
+
+// formatETag turns a hex SHA-256 digest into a strong ETag.
+func formatETag(checksum string) string {
+	return `"` + checksum[:32] + `"`
+}
+
+// dataETag is the ETag of an in-memory response body.
+func dataETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return formatETag(hex.EncodeToString(sum[:]))
+}
+
+// rememberETag records the content hash of an object just written, so its
+// first download needn't read it twice.
+func rememberETag(info ObjectInfo, checksum string) {
+	etagMu.Lock()
+	defer etagMu.Unlock()
+	if len(etagMemo) >= maxETagMemo {
+		clear(etagMemo)
+	}
+	etagMemo[etagKeyOf(info)] = formatETag(checksum)
+}
+
+// knownETag returns the remembered ETag of a stored object without reading
+// it.
+func knownETag(info ObjectInfo) (string, bool) {
+	etagMu.Lock()
+	defer etagMu.Unlock()
+	etag, ok := etagMemo[etagKeyOf(info)]
+	return etag, ok
+}
+
+// versionETag is the ETag of a stored object whose content hash isn't
+// known: its size and modification time, which change whenever it is
+// replaced. It is weak, as a rewrite within the clock's resolution or a copy
+// keeping the time needn't change it. It is empty when the modification time
+// is unknown.
+func versionETag(info ObjectInfo) string {
+	if info.ModTime.IsZero() || info.ModTime.Equal(time.Unix(0, 0)) {
+		return ""
+	}
+	return `W/"` + strconv.FormatInt(info.Size, 16) + "-" + strconv.FormatInt(info.ModTime.UnixNano(), 16) + `"`
+}
+
+// storedETag returns the ETag of a stored object without reading it: its
+// remembered content hash, or else its versionETag.
+func storedETag(info ObjectInfo) string {
+	if etag, ok := knownETag(info); ok {
+		return etag
+	}
+	return versionETag(info)
+}
+
+// etag returns the ETag of a stored object without reading it. The content
+// hash recorded in the metadata store is used when the record is of this
+// version of the object: as large, and written after it.
+func (s *fileStore) etag(ctx context.Context, info ObjectInfo) string {
+	if etag, ok := knownETag(info); ok {
+		return etag
+	}
+	if s.metadata != nil && !isDerivedObject(info.Name) {
+		record, err := s.metadata.get(ctx, info.Name)
+		if err == nil && record.Size == info.Size && !record.UpdatedAt.Before(info.ModTime.Truncate(time.Millisecond)) {
+			rememberETag(info, record.SHA256)
+			return formatETag(record.SHA256)
+		}
+	}
+	return versionETag(info)
+}
+
+// contentETag returns the ETag of a local file, a hash of its content.
+// Hashes are remembered per name, size and modification time, so each
+// version is read for it once; body is rewound afterwards. Stored objects,
+// which may be remote, use etag instead.
+func contentETag(info ObjectInfo, body io.ReadSeeker) (string, error) {
+	if etag, ok := knownETag(info); ok {
+		return etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	rememberETag(info, checksum)
+	return formatETag(checksum), nil
+}
+
+// etagMatches reports whether the list of entity tags in an If-Match or
+// If-None-Match header holds etag, as RFC 9110 section 13.1 compares them:
+// "*" matches any current version, and with weak comparison a W/ prefix on
+// either side is ignored, while strong comparison never matches a weak tag.
+// A malformed list matches nothing.
+func etagMatches(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for header = strings.TrimLeft(header, " \t"); header != ""; header = strings.TrimLeft(header, " \t") {
+		switch {
+		case header[0] == ',':
+			header = header[1:]
+			continue
+		case header[0] == '*':
+			return true
+		}
+		tag, rest, ok := scanETag(header)
+		if !ok {
+			return false
+		}
+		if weak && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") ||
+			!weak && tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+		header = rest
+	}
+	return false
+}
+
+// scanETag splits the entity tag at the start of s from the rest.
+func scanETag(s string) (tag, rest string, ok bool) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", "", false
+	}
+	for i := start + 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return s[:i+1], s[i+1:], true
+		case c == 0x21 || c >= 0x23 && c != 0x7F:
+		default:
+			return "", "", false
+		}
+	}
+	return "", "", false
+}
+
+// setLastModified sets the Last-Modified header, unless modTime is unknown.
+func setLastModified(c *gin.Context, modTime time.Time) {
+	if !modTime.IsZero() && !modTime.Equal(time.Unix(0, 0)) {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModifiedSince reports whether a GET or HEAD request's If-Modified-Since
+// shows the client already has the version last modified at modTime. As in
+// http.ServeContent, an If-None-Match header takes precedence and makes it
+// ignored.
+func notModifiedSince(r *http.Request, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.IsZero() || modTime.Equal(time.Unix(0, 0)) {
+		return false
+	}
+	// Header dates have whole seconds.
+	return !modTime.Truncate(time.Second).After(since)
+}
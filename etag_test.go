@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestETagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header, etag string
+		weak, want   bool
+	}{
+		{`"a"`, `"a"`, true, true},
+		{`"b"`, `"a"`, true, false},
+		{`"b", "a"`, `"a"`, true, true},
+		{`"b" ,"a"`, `"a"`, true, true},
+		{`"b",,	"a"`, `"a"`, true, true},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`W/"a"`, `W/"a"`, true, true},
+		{`*`, `"a"`, true, true},
+		{`*`, ``, true, false},
+		{`"a,b"`, `"a,b"`, true, true},
+		{`"a,b"`, `"a"`, true, false},
+		{`a`, `"a"`, true, false},
+		{`"a`, `"a"`, true, false},
+		{``, `"a"`, true, false},
+		{`"a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`"a"`, `W/"a"`, false, false},
+		{`W/"a"`, `W/"a"`, false, false},
+		{`"b", "a"`, `"a"`, false, true},
+	} {
+		if got := etagMatches(tc.header, tc.etag, tc.weak); got != tc.want {
+			t.Errorf("etagMatches(%q, %q, %v) = %v, want %v", tc.header, tc.etag, tc.weak, got, tc.want)
+		}
+	}
+}
+
+func TestHeadIfNoneMatch(t *testing.T) {
+	l := newLocalStorage(t.TempDir())
+	info, err := l.Put(t.Context(), "a.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rememberETag(info, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	s := &fileStore{route: "/files", storage: l}
+	for header, want := range map[string]int{
+		``:                                   http.StatusOK,
+		`"2cf24dba5fb0a30e26e83b2ac5b9e29e"`: http.StatusNotModified,
+		`"x", "2cf24dba5fb0a30e26e83b2ac5b9e29e"`: http.StatusNotModified,
+		`W/"2cf24dba5fb0a30e26e83b2ac5b9e29e"`:    http.StatusNotModified,
+		`*`:                                       http.StatusNotModified,
+		`"x"`:                                     http.StatusOK,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodHead, "/files/a.txt", nil)
+		c.Request.Header.Set("If-None-Match", header)
+		c.Params = gin.Params{{Key: "filename", Value: "a.txt"}}
+		s.head(c)
+		if got := c.Writer.Status(); got != want {
+			t.Errorf("If-None-Match %s: status %d, want %d", header, got, want)
+		}
+	}
+}
+
+func TestVersionETagIsWeak(t *testing.T) {
+	l := newLocalStorage(t.TempDir())
+	info, err := l.Put(t.Context(), "b.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := versionETag(info)
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("versionETag = %q, want a weak ETag", etag)
+	}
+	if !etagMatches(etag, etag, true) || etagMatches(etag, etag, false) {
+		t.Errorf("versionETag %q compares strongly", etag)
+	}
+	if got := versionETag(ObjectInfo{Name: "b.txt", Size: 5}); got != "" {
+		t.Errorf("versionETag without a modification time = %q, want none", got)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stripExif enables removing EXIF and XMP metadata from uploaded JPEGs
+// (STRIP_EXIF). It can be toggled at runtime.
+var stripExif atomic.Bool
+
+var exifStripped = expvar.NewInt("exif_stripped_total")
+
+// autoOrient enables turning decoded images upright according to their EXIF
+// orientation before they are transformed or thumbnailed (AUTO_ORIENT). It
+// can be toggled at runtime.
+var autoOrient atomic.Bool
+
+// exifOrientationTag is the IFD0 tag describing how the image is rotated
+// and mirrored.
+const exifOrientationTag = 0x0112
+
+// exifOrder returns the byte order of a TIFF-structured EXIF block.
+func exifOrder(tiff []byte) (binary.ByteOrder, bool) {
+	if len(tiff) < 8 {
+		return nil, false
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian, true
+	case "MM":
+		return binary.BigEndian, true
+	}
+	return nil, false
+}
+
+// exifOrientation returns the orientation (1-8) recorded in IFD0 of an EXIF
+// block, or 1 when it has none.
+func exifOrientation(tiff []byte) int {
+	order, ok := exifOrder(tiff)
+	if !ok {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orientationExif builds a minimal EXIF segment body holding only the
+// orientation tag, so stripped images still display the right way up.
+func orientationExif(orientation int) []byte {
+	tiff := []byte("MM\x00\x2a")
+	tiff = binary.BigEndian.AppendUint32(tiff, 8)
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+	return append([]byte(exifHeader), tiff...)
+}
+
+// stripExifMetadata copies r to w without the EXIF and XMP segments of a
+// JPEG, which carry GPS coordinates, timestamps and device details. A
+// non-default orientation is kept in a minimal EXIF segment. Other formats
+// are copied unchanged.
+func stripExifMetadata(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(2); !bytes.Equal(head, []byte{0xFF, 0xD8}) {
+		_, err := io.Copy(w, br)
+		return err
+	}
+	out := &metadataWriter{w: w}
+	soi := make([]byte, 2)
+	io.ReadFull(br, soi)
+	out.write(soi)
+
+	stripped := false
+	defer func() {
+		if stripped {
+			exifStripped.Add(1)
+		}
+	}()
+	for {
+		header := make([]byte, 4)
+		n, err := io.ReadFull(br, header)
+		code := header[1]
+		// Anything but a plain segment ends the metadata: pass the rest
+		// through untouched.
+		if err != nil || header[0] != 0xFF || code == 0xDA || code == 0xD9 || code == 0x01 || code >= 0xD0 && code <= 0xD7 {
+			return out.finish(br, header[:n])
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return out.finish(br, header)
+		}
+		body := make([]byte, length-2)
+		if n, err := io.ReadFull(br, body); err != nil {
+			return out.finish(br, append(header, body[:n]...))
+		}
+
+		switch {
+		case code == 0xE1 && bytes.HasPrefix(body, []byte(exifHeader)):
+			stripped = true
+			if orientation := exifOrientation(body[len(exifHeader):]); orientation != 1 {
+				segment := orientationExif(orientation)
+				out.write([]byte{0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(segment)+2)), segment)
+			}
+		case code == 0xE1 && bytes.HasPrefix(body, []byte(xmpHeader)):
+			stripped = true
+		default:
+			out.write(header, body)
+		}
+		if out.err != nil {
+			return out.err
+		}
+	}
+}
+
+// exifField is a raw IFD entry value.
+type exifField struct {
+	kind  uint16
+	value []byte
+}
+
+// readIFD returns the entries of the IFD at offset, keyed by tag.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]exifField {
+	fields := map[uint16]exifField{}
+	if int(offset)+2 > len(tiff) {
+		return fields
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	first := int(offset) + 2
+	if first+count*12 > len(tiff) {
+		count = (len(tiff) - first) / 12
+	}
+	for i := range count {
+		entry := first + i*12
+		if start, size, ok := exifValue(tiff, order, entry); ok {
+			fields[order.Uint16(tiff[entry:])] = exifField{order.Uint16(tiff[entry+2:]), tiff[start : start+size]}
+		}
+	}
+	return fields
+}
+
+// exifInfo is the EXIF metadata reported by GET /images/:filename/exif.
+type exifInfo struct {
+	Make         string   `json:"make,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Lens         string   `json:"lens,omitempty"`
+	Software     string   `json:"software,omitempty"`
+	Artist       string   `json:"artist,omitempty"`
+	Copyright    string   `json:"copyright,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	TakenAt      string   `json:"taken_at,omitempty"`
+	Orientation  int      `json:"orientation"`
+	ExposureTime string   `json:"exposure_time,omitempty"`
+	FNumber      float64  `json:"f_number,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focal_length,omitempty"`
+	GPS          *exifGPS `json:"gps,omitempty"`
+}
+
+type exifGPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// parseExif decodes the commonly indexed fields of a TIFF-structured EXIF
+// block. Missing or malformed fields are left empty.
+func parseExif(tiff []byte) exifInfo {
+	info := exifInfo{Orientation: exifOrientation(tiff)}
+	order, ok := exifOrder(tiff)
+	if !ok {
+		return info
+	}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	info.Make = exifString(ifd0[0x010F])
+	info.Model = exifString(ifd0[0x0110])
+	info.Software = exifString(ifd0[0x0131])
+	info.Artist = exifString(ifd0[exifArtistTag])
+	info.Copyright = exifString(ifd0[exifCopyrightTag])
+	info.Description = exifString(ifd0[exifDescriptionTag])
+	info.TakenAt = exifTime(exifString(ifd0[0x0132]))
+
+	if pointer, ok := ifd0[0x8769]; ok && len(pointer.value) == 4 {
+		sub := readIFD(tiff, order, order.Uint32(pointer.value))
+		if taken := exifTime(exifString(sub[0x9003])); taken != "" {
+			info.TakenAt = taken
+		}
+		info.Lens = exifString(sub[0xA434])
+		if num, den, ok := exifRational(order, sub[0x829A], 0); ok && num > 0 {
+			if num < den {
+				info.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+			} else {
+				info.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+			}
+		}
+		if num, den, ok := exifRational(order, sub[0x829D], 0); ok {
+			info.FNumber = math.Round(float64(num)/float64(den)*10) / 10
+		}
+		if num, den, ok := exifRational(order, sub[0x920A], 0); ok {
+			info.FocalLength = math.Round(float64(num)/float64(den)*10) / 10
+		}
+		if iso := sub[0x8827]; iso.kind == 3 && len(iso.value) >= 2 {
+			info.ISO = int(order.Uint16(iso.value))
+		}
+	}
+
+	if pointer, ok := ifd0[0x8825]; ok && len(pointer.value) == 4 {
+		gps := readIFD(tiff, order, order.Uint32(pointer.value))
+		lat, latOK := exifDegrees(order, gps[0x0002], exifString(gps[0x0001]))
+		lon, lonOK := exifDegrees(order, gps[0x0004], exifString(gps[0x0003]))
+		if latOK && lonOK {
+			info.GPS = &exifGPS{Latitude: lat, Longitude: lon}
+			if num, den, ok := exifRational(order, gps[0x0006], 0); ok {
+				altitude := float64(num) / float64(den)
+				if ref := gps[0x0005].value; len(ref) > 0 && ref[0] == 1 {
+					altitude = -altitude
+				}
+				info.GPS.Altitude = &altitude
+			}
+		}
+	}
+	return info
+}
+
+// exifString returns an ASCII field without its NUL padding.
+func exifString(field exifField) string {
+	if field.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(field.value), "\x00"))
+}
+
+// exifTime converts an EXIF "2006:01:02 15:04:05" time, which carries no
+// zone, to ISO 8601.
+func exifTime(value string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+// exifRational returns the i-th unsigned rational of field.
+func exifRational(order binary.ByteOrder, field exifField, i int) (num, den uint32, ok bool) {
+	if field.kind != 5 || len(field.value) < (i+1)*8 {
+		return 0, 0, false
+	}
+	num, den = order.Uint32(field.value[i*8:]), order.Uint32(field.value[i*8+4:])
+	return num, den, den != 0
+}
+
+// exifDegrees converts a GPS degrees/minutes/seconds triple to signed
+// decimal degrees; ref is N, S, E or W.
+func exifDegrees(order binary.ByteOrder, field exifField, ref string) (float64, bool) {
+	var degrees float64
+	for i, scale := range []float64{1, 60, 3600} {
+		num, den, ok := exifRational(order, field, i)
+		if !ok {
+			return 0, false
+		}
+		degrees += float64(num) / float64(den) / scale
+	}
+	if ref == "S" || ref == "W" {
+		degrees = -degrees
+	}
+	return math.Round(degrees*1e6) / 1e6, true
+}
+
+// readExif returns the EXIF block of a JPEG (APP1) or PNG (eXIf chunk),
+// reading no further than the metadata that precedes the image data. It
+// returns nil when there is none.
+func readExif(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(8)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		br.Discard(2)
+		for {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(br, header); err != nil || header[0] != 0xFF || header[1] == 0xDA || header[1] == 0xD9 {
+				return nil, nil
+			}
+			length := int(binary.BigEndian.Uint16(header[2:]))
+			if length < 2 {
+				return nil, nil
+			}
+			body := make([]byte, length-2)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return nil, err
+			}
+			if header[1] == 0xE1 && bytes.HasPrefix(body, []byte(exifHeader)) {
+				return body[len(exifHeader):], nil
+			}
+		}
+	case bytes.Equal(head, []byte("\x89PNG\r\n\x1a\n")):
+		br.Discard(8)
+		for {
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(br, header); err != nil {
+				return nil, nil
+			}
+			length := int64(binary.BigEndian.Uint32(header))
+			switch kind := string(header[4:]); {
+			case kind == "eXIf" && length <= maxPNGMetadataChunk:
+				data := make([]byte, length)
+				if _, err := io.ReadFull(br, data); err != nil {
+					return nil, err
+				}
+				return data, nil
+			case kind == "IDAT" || kind == "IEND":
+				return nil, nil
+			}
+			if _, err := br.Discard(int(length) + 4); err != nil {
+				return nil, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// decodeOriented decodes an image and, with AUTO_ORIENT on, applies its EXIF
+// orientation to the pixels. Encoded output carries no EXIF, so the result
+// displays upright with the tag effectively reset to 1.
+func decodeOriented(r io.Reader) (image.Image, string, error) {
+	if !autoOrient.Load() {
+		return image.Decode(r)
+	}
+	img, format, _, err := decodeWithExif(r)
+	return img, format, err
+}
+
+// decodeWithExif is decodeOriented that also returns the EXIF block of the
+// image, nil when it has none.
+func decodeWithExif(r io.Reader) (image.Image, string, []byte, error) {
+	var head bytes.Buffer
+	tiff, _ := readExif(io.TeeReader(r, &head))
+	img, format, err := image.Decode(io.MultiReader(&head, r))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if autoOrient.Load() {
+		img = orientImage(img, exifOrientation(tiff))
+	}
+	return img, format, tiff, nil
+}
+
+// exif reports the EXIF metadata of an image. Uploads are stored without
+// EXIF while STRIP_EXIF is on, so this mostly serves imported, ingested and
+// unstripped files; images without EXIF report only their orientation.
+func (s *fileStore) exif(c *gin.Context) {
+	filename := c.Param("filename")
+	body, _, _, err := s.open(c.Request.Context(), filename)
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	defer body.Close()
+	tiff, err := readExif(body)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read file."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"filename": filename,
+		"has_exif": tiff != nil,
+		"exif":     parseExif(tiff),
+	})
+}
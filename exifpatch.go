@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IFD0 tags written by PATCH /images/:filename/exif.
+const (
+	exifDescriptionTag = 0x010E
+	exifArtistTag      = 0x013B
+	exifCopyrightTag   = 0x8298
+)
+
+// maxExifField bounds the length of a patched field.
+const maxExifField = 2000
+
+// maxExifPatchSize bounds the images whose metadata can be patched, as they
+// are rewritten in memory.
+const maxExifPatchSize = 128 << 20
+
+// metadataVersions is how many earlier versions of an image PATCH
+// .../exif keeps (METADATA_VERSIONS); 0 keeps none.
+var metadataVersions int
+
+// exifPatchMu serializes metadata patches, so concurrent ones can't lose
+// each other's changes.
+var exifPatchMu sync.Mutex
+
+var errExifTooLarge = errors.New("EXIF block would exceed 64 KiB")
+
+// exifPatch is the body of PATCH /images/:filename/exif. Fields left out are
+// kept; an empty string removes the field.
+type exifPatch struct {
+	Copyright   *string `json:"copyright"`
+	Artist      *string `json:"artist"`
+	Description *string `json:"description"`
+}
+
+func (p exifPatch) fields() map[uint16]*string {
+	return map[uint16]*string{
+		exifCopyrightTag:   p.Copyright,
+		exifArtistTag:      p.Artist,
+		exifDescriptionTag: p.Description,
+	}
+}
+
+// patchTIFF returns a copy of the EXIF block tiff, or of a new empty one when
+// tiff is nil, with the IFD0 fields set. The new IFD0 is appended and the
+// header pointed at it, so the sub-IFDs and values it doesn't change stay
+// where they are; values of the fields it keeps are copied along, so an IFD0
+// appended by an earlier patch is replaced rather than piled up.
+func patchTIFF(tiff []byte, set map[uint16]*string) ([]byte, error) {
+	if tiff == nil {
+		tiff = []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00")
+	}
+	order, ok := exifOrder(tiff)
+	if !ok {
+		return nil, errors.New("malformed EXIF block")
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return nil, errors.New("malformed EXIF block")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	end := offset + 2 + count*12 + 4
+	if end > len(tiff) {
+		return nil, errors.New("malformed EXIF block")
+	}
+	next := order.Uint32(tiff[end-4:])
+
+	type entry struct {
+		tag   uint16
+		raw   []byte // the 12 bytes of the entry
+		value []byte // an out-of-line value, nil when inline
+	}
+	// An IFD0 that ends the block, followed only by its own values and
+	// pointing nowhere past its start, was appended by an earlier patch and
+	// is dropped rather than left behind.
+	var entries []entry
+	regionEnd := end
+	appended := offset >= 8 && int(next) < offset
+	for i := range count {
+		at := offset + 2 + i*12
+		tag := order.Uint16(tiff[at:])
+		start, size, ok := exifValue(tiff, order, at)
+		switch {
+		case !ok:
+			appended = false
+		case size > 4:
+			appended = appended && start == regionEnd
+			regionEnd += size + size%2
+		case tag == 0x8769 || tag == 0x8825 || tag == 0xA005:
+			appended = appended && int(order.Uint32(tiff[at+8:])) < offset
+		}
+		if set[tag] != nil {
+			continue
+		}
+		e := entry{tag: tag, raw: slices.Clone(tiff[at : at+12])}
+		if ok && size > 4 {
+			e.value = tiff[start : start+size]
+		}
+		entries = append(entries, e)
+	}
+	for tag, value := range set {
+		if value == nil || *value == "" {
+			continue
+		}
+		raw := make([]byte, 12)
+		order.PutUint16(raw, tag)
+		order.PutUint16(raw[2:], 2) // ASCII
+		text := append([]byte(*value), 0)
+		order.PutUint32(raw[4:], uint32(len(text)))
+		e := entry{tag: tag, raw: raw}
+		if len(text) <= 4 {
+			copy(raw[8:], text)
+		} else {
+			e.value = text
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return int(a.tag) - int(b.tag) })
+
+	base := tiff
+	if appended && regionEnd == len(tiff) {
+		base = tiff[:offset]
+	}
+	out := slices.Clone(base)
+	if len(out)%2 != 0 {
+		out = append(out, 0)
+	}
+	ifd := len(out)
+	out = append(out, 0, 0)
+	order.PutUint16(out[ifd:], uint16(len(entries)))
+	values := ifd + 2 + len(entries)*12 + 4
+	var data []byte
+	for _, e := range entries {
+		if e.value != nil {
+			order.PutUint32(e.raw[8:], uint32(values+len(data)))
+			data = append(data, e.value...)
+			if len(data)%2 != 0 {
+				data = append(data, 0)
+			}
+		}
+		out = append(out, e.raw...)
+	}
+	out = append(out, 0, 0, 0, 0)
+	order.PutUint32(out[len(out)-4:], next)
+	out = append(out, data...)
+	order.PutUint32(out[4:], uint32(ifd))
+	if len(out)+len(exifHeader)+2 > 0xFFFF {
+		return nil, errExifTooLarge
+	}
+	return out, nil
+}
+
+// writeExif copies the JPEG or PNG in data with its EXIF block replaced by
+// tiff; everything else, XMP included, is kept byte for byte.
+func writeExif(data, tiff []byte) ([]byte, error) {
+	var out bytes.Buffer
+	r := bufio.NewReader(bytes.NewReader(data))
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		segment := append([]byte(exifHeader), tiff...)
+		app1 := append([]byte{0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(segment)+2))...)
+		app1 = append(app1, segment...)
+		out.Write(data[:2])
+		r.Discard(2)
+		written := false
+		for {
+			header, err := r.Peek(4)
+			if err != nil || header[0] != 0xFF {
+				return nil, errors.New("malformed JPEG")
+			}
+			code := header[1]
+			// The EXIF segment goes after any JFIF APP0 and before the rest.
+			if code != 0xE0 && !written {
+				out.Write(app1)
+				written = true
+			}
+			if code == 0xDA || code < 0xE0 || code > 0xEF {
+				io.Copy(&out, r)
+				return out.Bytes(), nil
+			}
+			length := int(binary.BigEndian.Uint16(header[2:]))
+			if length < 2 {
+				return nil, errors.New("malformed JPEG")
+			}
+			body := make([]byte, length+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return nil, errors.New("malformed JPEG")
+			}
+			if code == 0xE1 && bytes.HasPrefix(body[4:], []byte(exifHeader)) {
+				continue
+			}
+			out.Write(body)
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		out.Write(data[:8])
+		r.Discard(8)
+		written := false
+		for {
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(r, header); err != nil {
+				return nil, errors.New("malformed PNG")
+			}
+			kind := string(header[4:])
+			if kind == "IDAT" && !written {
+				crc := crc32.NewIEEE()
+				crc.Write([]byte("eXIf"))
+				crc.Write(tiff)
+				out.Write(binary.BigEndian.AppendUint32(nil, uint32(len(tiff))))
+				out.WriteString("eXIf")
+				out.Write(tiff)
+				out.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+				written = true
+			}
+			length := int64(binary.BigEndian.Uint32(header))
+			if kind == "eXIf" {
+				if _, err := r.Discard(int(length) + 4); err != nil {
+					return nil, errors.New("malformed PNG")
+				}
+				continue
+			}
+			out.Write(header)
+			if _, err := io.CopyN(&out, r, length+4); err != nil {
+				return nil, errors.New("malformed PNG")
+			}
+			if kind == "IEND" {
+				return out.Bytes(), nil
+			}
+		}
+	}
+	return nil, errors.New("unsupported format")
+}
+
+// versionName names an earlier version of filename, kept in a dot-directory
+// beside the originals. Names sort by age.
+func versionName(filename string, t time.Time) string {
+	return ".versions/" + filename + "/" + t.UTC().Format("20060102T150405.000000000Z") + filepath.Ext(filename)
+}
+
+// keepVersion stores data as an earlier version of filename and deletes the
+// oldest beyond metadataVersions. It returns the version's name.
+func (s *fileStore) keepVersion(ctx context.Context, filename string, data []byte) (string, error) {
+	name := versionName(filename, time.Now())
+	if _, err := s.storage.Put(ctx, name, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	versions, err := s.storage.List(ctx, ".versions/"+filename+"/")
+	if err != nil {
+		return name, nil
+	}
+	slices.SortFunc(versions, func(a, b ObjectInfo) int { return strings.Compare(b.Name, a.Name) })
+	for _, old := range versions[min(metadataVersions, len(versions)):] {
+		s.storage.Delete(ctx, old.Name)
+	}
+	return name, nil
+}
+
+// removeVersions deletes the earlier versions of a removed file.
+func (s *fileStore) removeVersions(ctx context.Context, filename string) {
+	versions, _ := s.storage.List(ctx, ".versions/"+filename+"/")
+	for _, version := range versions {
+		s.storage.Delete(ctx, version.Name)
+	}
+}
+
+// patchExif sets the copyright, artist and description EXIF fields of a
+// stored JPEG or PNG. The image is rewritten whole, after checking that the
+// result still decodes, and the previous version is kept. If-Match guards
+// against overwriting a version the client hasn't seen.
+func (s *fileStore) patchExif(c *gin.Context) {
+	filename := c.Param("filename")
+	var patch exifPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid metadata."})
+		return
+	}
+	for name, value := range map[string]*string{"copyright": patch.Copyright, "artist": patch.Artist, "description": patch.Description} {
+		if value != nil && (len(*value) > maxExifField || strings.ContainsRune(*value, 0)) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("%s must be at most %d bytes without NUL characters.", name, maxExifField)})
+			return
+		}
+	}
+
+	exifPatchMu.Lock()
+	defer exifPatchMu.Unlock()
+	ctx := c.Request.Context()
+	body, info, readOnly, err := s.open(ctx, filename)
+	if readOnly {
+		body.Close()
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "File is read-only."})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File Not found."})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxExifPatchSize+1))
+	body.Close()
+	if err != nil {
+		storageFailed(c, err, "Failed to read file.")
+		return
+	}
+	if len(data) > maxExifPatchSize {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "File is too large to rewrite."})
+		return
+	}
+	// If-Match compares strongly, so only the content hash matches; the weak
+	// version ETag of a file whose hash wasn't known never does.
+	if match := c.GetHeader("If-Match"); match != "" && !etagMatches(match, dataETag(data), false) {
+		c.IndentedJSON(http.StatusPreconditionFailed, gin.H{"message": "File has changed."})
+		return
+	}
+
+	tiff, _ := readExif(bytes.NewReader(data))
+	tiff, err = patchTIFF(slices.Clone(tiff), patch.fields())
+	var patched []byte
+	if err == nil {
+		patched, err = writeExif(data, tiff)
+	}
+	if err == nil {
+		_, _, err = image.DecodeConfig(bytes.NewReader(patched))
+	}
+	if err != nil {
+		message := "Only the metadata of JPEG and PNG images can be changed."
+		if errors.Is(err, errExifTooLarge) {
+			message = "Metadata is too large."
+		}
+		logger.Warn("failed to patch EXIF", "file", filename, "size", info.Size, "error", err)
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": message})
+		return
+	}
+
+	response := gin.H{"message": "Metadata updated"}
+	if metadataVersions > 0 {
+		version, err := s.keepVersion(ctx, filename, data)
+		if err != nil {
+			storageFailed(c, err, "Failed to keep the previous version.")
+			return
+		}
+		response["previous_version"] = version
+	}
+	info, err = s.storage.Put(ctx, filename, bytes.NewReader(patched))
+	if err != nil {
+		storageFailed(c, err, "Failed to save file.")
+		return
+	}
+	sum := sha256.Sum256(patched)
+	rememberETag(info, hex.EncodeToString(sum[:]))
+	s.metadata.record(ctx, imageRecord{Filename: filename, ContentType: getMimeType(filename), Size: info.Size, SHA256: hex.EncodeToString(sum[:])})
+	s.purgeTransforms(filename)
+
+	logger.Info("EXIF patched", "file", filename, "size", len(patched))
+	c.Header("ETag", formatETag(hex.EncodeToString(sum[:])))
+	response["exif"] = parseExif(tiff)
+	c.IndentedJSON(http.StatusOK, response)
+}
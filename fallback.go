@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fallbackImage is served instead of a JSON error on image routes, so a
+// broken <img> shows a placeholder rather than the browser's broken icon.
+type fallbackImage struct {
+	data        []byte
+	contentType string
+}
+
+// fallbackImages maps a status code to its configured fallback image.
+var fallbackImages = map[int]*fallbackImage{}
+
+// Size of the generated placeholder.
+const placeholderWidth, placeholderHeight = 400, 300
+
+// loadFallbackImage reads the image at path, or generates a neutral
+// placeholder when path is "placeholder".
+func loadFallbackImage(path string) (*fallbackImage, error) {
+	if path == "placeholder" {
+		data, err := encodePNG(placeholderImage(placeholderWidth, placeholderHeight))
+		if err != nil {
+			return nil, err
+		}
+		return &fallbackImage{data: data, contentType: "image/png"}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contentType := getMimeType(path)
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return &fallbackImage{data: data, contentType: contentType}, nil
+}
+
+// placeholderImage draws a light grey box crossed by two darker diagonals.
+func placeholderImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	background := color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	line := color.RGBA{0xbd, 0xbd, 0xbd, 0xff}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, background)
+		}
+	}
+	for x := 0; x < w; x++ {
+		y := x * h / w
+		for d := -1; d <= 1; d++ {
+			img.Set(x, y+d, line)
+			img.Set(x, h-1-y+d, line)
+		}
+	}
+	return img
+}
+
+// loadFallbackImages reads FALLBACK_404_IMAGE and FALLBACK_403_IMAGE.
+func loadFallbackImages() []error {
+	var errs []error
+	for _, setting := range []struct {
+		status int
+		key    string
+	}{
+		{http.StatusNotFound, "FALLBACK_404_IMAGE"},
+		{http.StatusForbidden, "FALLBACK_403_IMAGE"},
+	} {
+		path := getEnv(setting.key, "")
+		if path == "" {
+			continue
+		}
+		fallback, err := loadFallbackImage(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", setting.key, err))
+			continue
+		}
+		fallbackImages[setting.status] = fallback
+	}
+	return errs
+}
+
+// useFallbackImages marks a route as one that answers errors with the
+// configured fallback images.
+func useFallbackImages(c *gin.Context) {
+	c.Set("fallbackImages", true)
+	c.Next()
+}
+
+// serveFallbackImage writes the fallback image for status if the route uses
+// fallbacks and one is configured, and reports whether it did.
+func serveFallbackImage(c *gin.Context, status int) bool {
+	fallback := fallbackImages[status]
+	if fallback == nil || !c.GetBool("fallbackImages") {
+		return false
+	}
+	// The placeholder must not be cached in place of a file that may exist
+	// later, or once the URL is re-signed.
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(status, fallback.contentType, fallback.data)
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// faviconSizes are the PNG icons generated from a source image.
+var faviconSizes = []struct {
+	name string
+	size int
+}{
+	{"favicon-16x16.png", 16},
+	{"favicon-32x32.png", 32},
+	{"favicon-48x48.png", 48},
+	{"apple-touch-icon.png", 180},
+	{"android-chrome-192x192.png", 192},
+	{"android-chrome-512x512.png", 512},
+}
+
+// icoSizes are embedded in favicon.ico.
+var icoSizes = []int{16, 32, 48}
+
+// buildFavicons renders the full icon set for src, keyed by file name.
+func buildFavicons(src image.Image, background color.Color) (map[string][]byte, error) {
+	square := cropSquare(src)
+	icons := make(map[string][]byte)
+
+	for _, icon := range faviconSizes {
+		data, err := encodePNG(resizeImage(square, icon.size, icon.size))
+		if err != nil {
+			return nil, err
+		}
+		icons[icon.name] = data
+	}
+
+	// Maskable icons keep the artwork inside the central 80% safe zone.
+	maskable, err := encodePNG(padImage(square, 512, 0.8, background))
+	if err != nil {
+		return nil, err
+	}
+	icons["maskable-512x512.png"] = maskable
+
+	var entries [][]byte
+	for _, size := range icoSizes {
+		data, err := encodePNG(resizeImage(square, size, size))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, data)
+	}
+	icons["favicon.ico"] = encodeICO(icoSizes, entries)
+
+	manifest, err := json.MarshalIndent(gin.H{
+		"icons": []gin.H{
+			{"src": "/android-chrome-192x192.png", "sizes": "192x192", "type": "image/png"},
+			{"src": "/android-chrome-512x512.png", "sizes": "512x512", "type": "image/png"},
+			{"src": "/maskable-512x512.png", "sizes": "512x512", "type": "image/png", "purpose": "maskable"},
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	icons["site.webmanifest"] = manifest
+
+	return icons, nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeICO packs PNG-compressed entries into an ICO container.
+func encodeICO(sizes []int, entries [][]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, 1, uint16(len(entries))})
+
+	offset := 6 + 16*len(entries)
+	for i, data := range entries {
+		// A dimension of 0 means 256 pixels.
+		dim := uint8(sizes[i] % 256)
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Width, Height, Colors, Reserved uint8
+			Planes, BitCount                uint16
+			Size, Offset                    uint32
+		}{dim, dim, 0, 0, 1, 32, uint32(len(data)), uint32(offset)})
+		offset += len(data)
+	}
+	for _, data := range entries {
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// iconContentType maps icon file names to types missing from many mime tables.
+func iconContentType(name string) string {
+	switch filepath.Ext(name) {
+	case ".ico":
+		return "image/x-icon"
+	case ".webmanifest":
+		return "application/manifest+json"
+	}
+	return getMimeType(name)
+}
+
+// parseHexColor parses "#rrggbb" into an opaque color.
+func parseHexColor(s string) (color.RGBA, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+// favicons returns the icon set generated from an image as a zip, or a single
+// icon when the :icon parameter names one (e.g. favicon.ico).
+func (s *fileStore) favicons(c *gin.Context) {
+	src, _, err := s.decode(c.Request.Context(), c.Param("filename"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Image not found or not decodable"})
+		return
+	}
+
+	icons, err := buildFavicons(src, faviconBackground)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate icons."})
+		return
+	}
+
+	if name := c.Param("icon"); name != "" {
+		data, ok := icons[name]
+		if !ok {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Icon not found"})
+			return
+		}
+		setCacheControl(c, s.variantCacheControl)
+		c.Data(http.StatusOK, iconContentType(name), data)
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range sortedKeys(icons) {
+		w, err := zw.Create(name)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate icons."})
+			return
+		}
+		w.Write(icons[name])
+	}
+	if err := zw.Close(); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate icons."})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=favicons.zip")
+	setCacheControl(c, s.variantCacheControl)
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
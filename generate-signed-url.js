@@ -12,38 +12,146 @@ function generateSignedUrl(method, filename, validForSeconds) {
 
     // Create the data string to sign: "METHOD:filename:expires" (empty filename for POST)
     // Including method prevents token reuse across different HTTP methods
-    const data = `${method}:${filename || ''}:${expires}`;
+    let data = `${method}:${signedName(filename)}:${expires}`;
+    const nonce = once ? crypto.randomBytes(16).toString('hex') : null;
+    if (nonce) {
+        data += field('nonce', nonce);
+    }
+    data += hostData + recipientData;
 
     // Create HMAC-SHA256 signature
     const hmac = crypto.createHmac('sha256', secretKey);
     hmac.update(data);
     const signature = hmac.digest('hex');
+    const nonceParam = (nonce ? `&nonce=${nonce}` : '') + hostParam + recipientParam;
 
     // Construct the signed URL
     if (filename) {
         // GET/PUT/DELETE requests with filename
-        const signedUrl = `${baseUrl}/images/${filename}?expires=${expires}&signature=${signature}`;
+        const signedUrl = `${baseUrl}${route}/${filename}?expires=${expires}${nonceParam}&signature=${signature}`;
         return signedUrl;
     } else {
-        // POST request without filename
-        const signedUrl = `${baseUrl}/images?expires=${expires}&signature=${signature}`;
+        // POST or listing request without filename
+        const signedUrl = `${baseUrl}${route}?expires=${expires}${nonceParam}&signature=${signature}`;
         return signedUrl;
     }
 }
 
-// Get command line arguments
-const args = process.argv.slice(2);
+function generateScopedUrl(methods, filename, validForSeconds) {
+    const expires = Math.floor(Date.now() / 1000) + parseInt(validForSeconds);
+
+    // v2 signatures sign a method scope: "v2:GET,HEAD:filename:expires" ("*" allows any method)
+    let data = `v2:${methods}:${signedName(filename)}:${expires}`;
+    const nonce = once ? crypto.randomBytes(16).toString('hex') : null;
+    if (nonce) {
+        data += field('nonce', nonce);
+    }
+    data += hostData + recipientData;
+
+    const hmac = crypto.createHmac('sha256', secretKey);
+    hmac.update(data);
+    const signature = hmac.digest('hex');
+
+    const path = filename ? `${route}/${filename}` : route;
+    const nonceParam = (nonce ? `&nonce=${nonce}` : '') + hostParam + recipientParam;
+    return `${baseUrl}${path}?v=2&methods=${encodeURIComponent(methods)}&expires=${expires}${nonceParam}&signature=${signature}`;
+}
+
+function generateTagsUrl(filename, validForSeconds) {
+    const expires = Math.floor(Date.now() / 1000) + parseInt(validForSeconds);
+
+    // Tag changes are signed in the "tags" namespace for POST and DELETE, so the
+    // URL can't delete the image itself: "v2:POST,DELETE:tags/filename:expires"
+    const methods = 'POST,DELETE';
+    let data = `v2:${methods}:tags/${filename}:${expires}`;
+    const nonce = once ? crypto.randomBytes(16).toString('hex') : null;
+    if (nonce) {
+        data += field('nonce', nonce);
+    }
+    data += hostData;
+
+    const hmac = crypto.createHmac('sha256', secretKey);
+    hmac.update(data);
+    const signature = hmac.digest('hex');
+
+    const nonceParam = (nonce ? `&nonce=${nonce}` : '') + hostParam;
+    return `${baseUrl}/images/${filename}/tags?v=2&methods=${encodeURIComponent(methods)}&expires=${expires}${nonceParam}&signature=${signature}`;
+}
+
+function generateSignedCookies(pathPrefix, validForSeconds) {
+    const expires = Math.floor(Date.now() / 1000) + parseInt(validForSeconds);
+
+    // Cookies sign "COOKIE:prefix:expires" and grant GET access to every path under the prefix
+    const data = `COOKIE:${pathPrefix}:${expires}`;
+
+    const hmac = crypto.createHmac('sha256', secretKey);
+    hmac.update(data);
+    const signature = hmac.digest('hex');
+
+    return [
+        `Image-Policy-Prefix=${pathPrefix}; Path=/; HttpOnly; Secure`,
+        `Image-Policy-Expires=${expires}; Path=/; HttpOnly; Secure`,
+        `Image-Policy-Signature=${signature}; Path=/; HttpOnly; Secure`,
+    ];
+}
+
+// Get command line arguments; --once adds a nonce so the URL can be used a single time,
+// --namespace <name> targets a namespaced route such as /files or /sprites instead of /images
+// (--files is short for --namespace files), --host binds the signature to the scheme and host of BASE_URL,
+// --recipient <id> marks the served image with an invisible watermark tracing it to <id>
+const once = process.argv.includes('--once');
+const bindHost = process.argv.includes('--host');
+let namespace = process.argv.includes('--files') ? 'files' : null;
+const rawArgs = process.argv.slice(2).filter((arg) => arg !== '--once' && arg !== '--files' && arg !== '--host');
+const namespaceIndex = rawArgs.indexOf('--namespace');
+if (namespaceIndex !== -1) {
+    namespace = rawArgs[namespaceIndex + 1];
+    rawArgs.splice(namespaceIndex, 2);
+}
+let recipient = null;
+const recipientIndex = rawArgs.indexOf('--recipient');
+if (recipientIndex !== -1) {
+    recipient = rawArgs[recipientIndex + 1];
+    rawArgs.splice(recipientIndex, 2);
+}
+const args = rawArgs;
+
+// Optional fields are appended as ":key=<byte length>:value", so no value can pass for another field
+const field = (key, value) => `:${key}=${Buffer.byteLength(value)}:${value}`;
+
+// Host-bound signatures append the "host" field, the scheme and host, and are marked with host=1
+const hostData = bindHost ? field('host', new URL(baseUrl).origin) : '';
+const hostParam = bindHost ? '&host=1' : '';
+
+// Recipient-bound signatures append the "recipient" field
+const recipientData = recipient ? field('recipient', recipient) : '';
+const recipientParam = recipient ? `&recipient=${encodeURIComponent(recipient)}` : '';
+
+// Namespaced signatures sign "<namespace>/<name>" so they can't be replayed on /images
+const route = namespace ? `/${namespace}` : '/images';
+const signedName = (filename) => (namespace ? `${namespace}/${filename || ''}` : filename || '');
 
 if (args.length < 1) {
     console.error('Usage:');
     console.error('  For GET:  node generate-signed-url.js --get <image-name> <time-in-seconds>');
     console.error('  For PUT:  node generate-signed-url.js --put <image-name> <time-in-seconds>');
     console.error('  For DELETE: node generate-signed-url.js --delete <image-name> <time-in-seconds>');
+    console.error('  For PATCH (metadata): node generate-signed-url.js --patch <image-name> <time-in-seconds>');
     console.error('  For POST: node generate-signed-url.js --post <time-in-seconds>');
-    console.error('  Short forms: -g (GET), -u (PUT), -d (DELETE), -p (POST)');
+    console.error('  For a listing: node generate-signed-url.js --list <time-in-seconds>');
+    console.error('  For tag changes: node generate-signed-url.js --tags <image-name> <time-in-seconds>');
+    console.error('  For cookies: node generate-signed-url.js --cookie <path-prefix> <time-in-seconds>');
+    console.error('  For a method scope: node generate-signed-url.js --scope <GET,HEAD|*> <image-name> <time-in-seconds>');
+    console.error('  Short forms: -g (GET), -u (PUT), -d (DELETE), -p (POST), -l (list), -c (cookie), -s (scope)');
+    console.error('  Add --once to generate a one-time URL (requires ONE_TIME_URLS=true on the server)');
+    console.error('  Add --files (or --namespace <name>) to sign for /files (or /<name>) instead of /images');
+    console.error('  Add --host to bind the URL to the scheme and host of BASE_URL');
+    console.error('  Add --recipient <id> to trace the served image to <id> (requires INVISIBLE_WATERMARK_KEY on the server)');
     process.exit(1);
 }
 
+let scope;
+
 let method, imageName, timeInSeconds;
 
 // Parse method flag
@@ -59,6 +167,17 @@ switch (methodFlag) {
         imageName = null;
         timeInSeconds = args[1];
         break;
+    case '--list':
+    case '-l':
+        // Listings sign a GET of the collection, with an empty filename like uploads
+        method = 'GET';
+        if (args.length < 2) {
+            console.error('Usage: node generate-signed-url.js --list <time-in-seconds>');
+            process.exit(1);
+        }
+        imageName = null;
+        timeInSeconds = args[1];
+        break;
     case '--get':
     case '-g':
         method = 'GET';
@@ -89,9 +208,48 @@ switch (methodFlag) {
         imageName = args[1];
         timeInSeconds = args[2];
         break;
+    case '--patch':
+        method = 'PATCH';
+        if (args.length < 3) {
+            console.error('Usage: node generate-signed-url.js --patch <image-name> <time-in-seconds>');
+            process.exit(1);
+        }
+        imageName = args[1];
+        timeInSeconds = args[2];
+        break;
+    case '--tags':
+        method = 'TAGS';
+        if (args.length < 3) {
+            console.error('Usage: node generate-signed-url.js --tags <image-name> <time-in-seconds>');
+            process.exit(1);
+        }
+        imageName = args[1];
+        timeInSeconds = args[2];
+        break;
+    case '--cookie':
+    case '-c':
+        method = 'COOKIE';
+        if (args.length < 3) {
+            console.error('Usage: node generate-signed-url.js --cookie <path-prefix> <time-in-seconds>');
+            process.exit(1);
+        }
+        imageName = args[1];
+        timeInSeconds = args[2];
+        break;
+    case '--scope':
+    case '-s':
+        method = 'SCOPE';
+        if (args.length < 4) {
+            console.error('Usage: node generate-signed-url.js --scope <GET,HEAD|*> <image-name> <time-in-seconds>');
+            process.exit(1);
+        }
+        scope = args[1].toUpperCase();
+        imageName = args[2];
+        timeInSeconds = args[3];
+        break;
     default:
-        console.error('Error: Invalid method flag. Use --get, --put, --delete, or --post');
-        console.error('  Short forms: -g (GET), -u (PUT), -d (DELETE), -p (POST)');
+        console.error('Error: Invalid method flag. Use --get, --put, --delete, --patch, --post, --list, --tags, --cookie, or --scope');
+        console.error('  Short forms: -g (GET), -u (PUT), -d (DELETE), -p (POST), -l (list), -c (cookie), -s (scope)');
         process.exit(1);
 }
 
@@ -101,6 +259,22 @@ if (isNaN(timeInSeconds) || parseInt(timeInSeconds) <= 0) {
     process.exit(1);
 }
 
+// Signed cookies are printed as Set-Cookie values, one per line
+if (method === 'COOKIE') {
+    generateSignedCookies(imageName, timeInSeconds).forEach((cookie) => console.log(cookie));
+    process.exit(0);
+}
+
+if (method === 'TAGS') {
+    console.log(generateTagsUrl(imageName, timeInSeconds));
+    process.exit(0);
+}
+
+if (method === 'SCOPE') {
+    console.log(generateScopedUrl(scope, imageName, timeInSeconds));
+    process.exit(0);
+}
+
 // Generate and output the signed URL
 const signedUrl = generateSignedUrl(method, imageName, timeInSeconds);
 console.log(signedUrl);
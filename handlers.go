@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fileStore serves one family of routes (e.g. /images or /files) backed by
+// a Storage, with the same signing used for every family.
+type fileStore struct {
+	route   string
+	storage Storage
+	// assets, when set, holds read-only pre-baked files served when storage
+	// has no object of the same name.
+	assets Storage
+
+	// inlineTypes lists Content-Type prefixes served inline; everything else
+	// is served as an attachment. The empty prefix matches every type.
+	inlineTypes []string
+
+	// fallbacks enables the configured fallback images when a GET of a file
+	// is refused or the file is missing.
+	fallbacks bool
+
+	// thumbnailSizes lists the thumbnails generated when a file is uploaded
+	// or replaced.
+	thumbnailSizes []int
+	// previewSize, when set, adds a data: URI preview of that size to
+	// upload responses.
+	previewSize int
+	// stripMetadata stores uploads with the metadata removed that PII_POLICY
+	// and STRIP_EXIF ask for; otherwise they are stored byte for byte.
+	stripMetadata bool
+
+	// placeholders computes a BlurHash of every uploaded image, returned in
+	// the upload response and served at /:filename/placeholder.
+	placeholders bool
+
+	// vanityHosts serves GETs on VANITY_HOSTS hostnames unsigned, with the
+	// host's locked transform preset.
+	vanityHosts bool
+
+	// cache holds images converted with ?format=; nil disables conversion.
+	cache *transformCache
+
+	// metadata records the stored files; nil records nothing.
+	metadata *metadataStore
+
+	// cacheControl and variantCacheControl are the Cache-Control values of
+	// stored files and of what is derived from them; empty sends none.
+	cacheControl        string
+	variantCacheControl string
+}
+
+// uploadReader returns the content of an upload as s stores it. The caller
+// must close it.
+func (s *fileStore) uploadReader(r io.Reader, findings []piiFinding) io.ReadCloser {
+	if !s.stripMetadata {
+		return io.NopCloser(r)
+	}
+	return uploadReader(r, findings)
+}
+
+// register mounts the CRUD routes of s on router.
+func (s *fileStore) register(router gin.IRouter, handlers ...gin.HandlerFunc) {
+	group := router.Group(s.route, handlers...)
+	var get []gin.HandlerFunc
+	if s.fallbacks {
+		get = append(get, useFallbackImages)
+	}
+	if s.vanityHosts {
+		get = append(get, VanityHostMiddleware())
+	}
+	group.GET("/:filename", append(get, SignedURLMiddleware(), ChaosMiddleware(), s.serve)...)
+	group.HEAD("/:filename", append(get, SignedURLMiddleware(), ChaosMiddleware(), s.head)...)
+	group.GET("/:filename/info", SignedURLMiddleware(), ChaosMiddleware(), s.info)
+	group.GET("/:filename/manifest", SignedURLMiddleware(), ChaosMiddleware(), s.manifest)
+	group.GET("/:filename/derivatives", SignedURLMiddleware(), ChaosMiddleware(), s.listDerivatives)
+	group.GET("", SignedOrAdminMiddleware(), ChaosMiddleware(), s.list)
+	group.POST("", SignedURLMiddleware(), ChaosMiddleware(), s.upload)
+	group.PUT("/:filename", SignedURLMiddleware(), ChaosMiddleware(), s.update)
+	group.DELETE("/:filename", SignedURLMiddleware(), ChaosMiddleware(), s.remove)
+}
+
+// open returns the object named filename, falling back to the read-only
+// assets. readOnly reports whether it was found only among the assets.
+func (s *fileStore) open(ctx context.Context, filename string) (body io.ReadCloser, info ObjectInfo, readOnly bool, err error) {
+	body, info, err = s.storage.Get(ctx, filename)
+	if errors.Is(err, ErrNotFound) && s.assets != nil {
+		body, info, err = s.assets.Get(ctx, filename)
+		readOnly = err == nil
+	}
+	return body, info, readOnly, err
+}
+
+// stat is like open without reading the object.
+func (s *fileStore) stat(ctx context.Context, filename string) (info ObjectInfo, readOnly bool, err error) {
+	info, err = s.storage.Stat(ctx, filename)
+	if errors.Is(err, ErrNotFound) && s.assets != nil {
+		info, err = s.assets.Stat(ctx, filename)
+		readOnly = err == nil
+	}
+	return info, readOnly, err
+}
+
+// decode decodes the stored image filename in any registered format.
+func (s *fileStore) decode(ctx context.Context, filename string) (image.Image, string, error) {
+	body, _, _, err := s.open(ctx, filename)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+	return decodeOriented(body)
+}
+
+func (s *fileStore) disposition(contentType string) string {
+	for _, prefix := range s.inlineTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return "inline"
+		}
+	}
+	return "attachment"
+}
+
+func (s *fileStore) serve(c *gin.Context) {
+	filename := c.Param("filename")
+	var opts transformOptions
+	var transform bool
+	if s.cache != nil {
+		var err error
+		if opts, transform, err = parseTransformOptions(c, filename); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	} else if c.Query("recipient") != "" {
+		// Without conversions there is no way to mark the copy.
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "recipient needs image conversions"})
+		return
+	}
+	// Vanity hosts are unsigned, so they serve the preset or nothing.
+	vanity := c.GetBool("vanityPreset")
+	if vanity && !transform {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "The preset of this host doesn't apply to this file."})
+		return
+	}
+
+	if transform && canonicalRedirects.Load() && !vanity {
+		if query := canonicalQuery(c, opts); query != c.Request.URL.RawQuery {
+			c.Redirect(http.StatusMovedPermanently, publicPath(routePath(c.Request.URL.Path))+"?"+query)
+			return
+		}
+	}
+
+	if !transform && s.servePrecompressed(c, filename) {
+		return
+	}
+
+	body, info, _, err := s.open(c.Request.Context(), filename)
+	if errors.Is(err, ErrStorageTimeout) {
+		storageFailed(c, err, "Failed to read file.")
+		return
+	}
+	if err != nil {
+		if !serveFallbackImage(c, http.StatusNotFound) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		}
+		return
+	}
+	defer body.Close()
+
+	if transform {
+		err := s.serveTransformed(c, body, info, opts)
+		if err == nil {
+			return
+		}
+		// A transform the client asked for explicitly is an error to report;
+		// a negotiated format falls back to the original.
+		if vanity || opts.reshapes() || c.Query("format") != "" || c.Query("watermark") == "1" || opts.recipient != "" {
+			message := "File can't be converted."
+			switch {
+			case errors.Is(err, errTransformTooLarge):
+				message = "Converted image would exceed the size limits."
+			case errors.Is(err, errSourceTooLarge):
+				message = "Image is too large to convert."
+			case errors.Is(err, errCropOutside):
+				message = "Crop region lies outside the image."
+			case errors.Is(err, errTraceTooSmall):
+				message = "Image is too small for an invisible watermark."
+			}
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": message})
+			return
+		}
+		body.Close()
+		if body, info, _, err = s.open(c.Request.Context(), filename); err != nil {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+			return
+		}
+		defer body.Close()
+	}
+
+	contentType := getMimeType(filename)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", s.disposition(contentType)+"; filename="+filename)
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	setCacheControl(c, s.cacheControl)
+	if etag := s.etag(c.Request.Context(), info); etag != "" {
+		c.Header("ETag", etag)
+	}
+	writeObject(c, filename, contentType, body, info)
+}
+
+// writeObject sends a stored object, with range and conditional request
+// support when the backend's reader can seek. Seekable objects get the
+// storedETag unless the caller set one, so If-None-Match is answered with
+// 304 without reading the object; all objects get Last-Modified for
+// If-Modified-Since.
+func writeObject(c *gin.Context, name, contentType string, body io.Reader, info ObjectInfo) {
+	if content, ok := body.(io.ReadSeeker); ok {
+		if c.Writer.Header().Get("ETag") == "" {
+			if etag := storedETag(info); etag != "" {
+				c.Header("ETag", etag)
+			}
+		}
+		http.ServeContent(c.Writer, c.Request, name, info.ModTime, content)
+		return
+	}
+	setLastModified(c, info.ModTime)
+	if notModifiedSince(c.Request, info.ModTime) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.DataFromReader(http.StatusOK, info.Size, contentType, body, nil)
+}
+
+func (s *fileStore) manifest(c *gin.Context) {
+	filename := c.Param("filename")
+	body, _, _, err := s.open(c.Request.Context(), filename)
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	checksum, size, err := readerChecksum(body)
+	body.Close()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read file."})
+		return
+	}
+
+	// Thumbnails not generated yet are left out; they appear once requested.
+	variants := []gin.H{}
+	for _, size := range s.thumbnailSizes {
+		name := thumbnailName(filename, size)
+		body, _, err := s.storage.Get(c.Request.Context(), name)
+		if err != nil {
+			continue
+		}
+		checksum, length, err := readerChecksum(body)
+		body.Close()
+		if err != nil {
+			continue
+		}
+		variants = append(variants, gin.H{
+			"name":         "thumb-" + strconv.Itoa(size),
+			"url":          publicPath(s.route + "/" + filename + "/thumb/" + strconv.Itoa(size)),
+			"size":         length,
+			"sha256":       checksum,
+			"integrity":    integrity(checksum),
+			"content_type": getMimeType(name),
+		})
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"filename": filename,
+		"original": gin.H{
+			"url":          publicPath(s.route + "/" + filename),
+			"size":         size,
+			"sha256":       checksum,
+			"integrity":    integrity(checksum),
+			"content_type": getMimeType(filename),
+		},
+		"variants": variants,
+	})
+}
+
+func (s *fileStore) upload(c *gin.Context) {
+	maxSize, capped := uploadSizeLimit(c)
+	if capped {
+		// Leave headroom for the multipart envelope around the file itself.
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1<<20)
+	}
+
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "File not found in the request"})
+		return
+	}
+	defer file.Close()
+
+	if capped && fileHeader.Size > maxSize {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "File exceeds the size allowed by this URL."})
+		return
+	}
+
+	tags, err := parseTags(c.PostFormArray("tags"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if len(tags) > 0 && s.metadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Tags need the metadata store."})
+		return
+	}
+
+	findings, err := checkPII(file)
+	if len(findings) > 0 {
+		recordPIIFindings(s.route, fileHeader.Filename, findings)
+	}
+	if errors.Is(err, errPIIRejected) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "File metadata contains personal data.", "pii_findings": findings})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Failed to read file."})
+		return
+	}
+
+	newFileName := newImageName(fileHeader.Filename)
+
+	h := sha256.New()
+	body := s.uploadReader(file, findings)
+	defer body.Close()
+	content := io.TeeReader(chaosWrap(body), h)
+	info, err := s.storage.Put(c.Request.Context(), newFileName, content)
+	if err != nil {
+		storageFailed(c, err, "Failed to save file.")
+		return
+	}
+	rememberETag(info, hex.EncodeToString(h.Sum(nil)))
+	s.metadata.record(c.Request.Context(), imageRecord{
+		Filename:         newFileName,
+		OriginalFilename: fileHeader.Filename,
+		ContentType:      getMimeType(newFileName),
+		Size:             info.Size,
+		SHA256:           hex.EncodeToString(h.Sum(nil)),
+		Uploader:         c.ClientIP(),
+		Source:           sourceUpload,
+	})
+	if len(tags) > 0 {
+		if err := s.metadata.addTags(c.Request.Context(), newFileName, tags); err != nil {
+			logger.Error("failed to tag image", "file", newFileName, "error", err)
+		}
+	}
+	go s.metadata.screen(context.Background(), newFileName)
+	src := s.generateThumbnails(c.Request.Context(), newFileName)
+	s.precompress(c.Request.Context(), newFileName)
+
+	response := gin.H{
+		"message":           "File uploaded",
+		"filename":          newFileName,
+		"original_filename": fileHeader.Filename,
+		"size":              fileHeader.Size,
+		"integrity":         integrity(hex.EncodeToString(h.Sum(nil))),
+	}
+	if len(tags) > 0 {
+		response["tags"] = tags
+	}
+	if publicBaseURL != "" {
+		response["urls"] = s.signedURLs(c, newFileName, src != nil)
+	}
+	if src != nil {
+		if len(s.thumbnailSizes) > 0 {
+			response["variants"] = s.thumbnailVariants(newFileName)
+		}
+		if s.previewSize > 0 {
+			if preview, err := s.previewDataURI(src, newFileName); err == nil {
+				response["preview"] = preview
+			} else {
+				logger.Error("failed to render preview", "file", newFileName, "error", err)
+			}
+		}
+		if s.placeholders {
+			if p, err := s.storePlaceholder(c.Request.Context(), src, newFileName); err == nil {
+				response["blurhash"] = p.BlurHash
+			} else {
+				logger.Error("failed to store placeholder", "file", newFileName, "error", err)
+			}
+		}
+	}
+	if len(findings) > 0 {
+		response["pii_findings"] = findings
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+func (s *fileStore) update(c *gin.Context) {
+	filename := c.Param("filename")
+	_, readOnly, err := s.stat(c.Request.Context(), filename)
+	if readOnly {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "File is read-only."})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File Not found."})
+		return
+	}
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "File not found in the request"})
+		return
+	}
+	defer file.Close()
+
+	findings, err := checkPII(file)
+	if len(findings) > 0 {
+		recordPIIFindings(s.route, filename, findings)
+	}
+	if errors.Is(err, errPIIRejected) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "File metadata contains personal data.", "pii_findings": findings})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Failed to read file."})
+		return
+	}
+
+	h := sha256.New()
+	body := s.uploadReader(file, findings)
+	defer body.Close()
+	content := io.TeeReader(chaosWrap(body), h)
+	info, err := s.storage.Put(c.Request.Context(), filename, content)
+	if err != nil {
+		storageFailed(c, err, "Failed to save file.")
+		return
+	}
+	rememberETag(info, hex.EncodeToString(h.Sum(nil)))
+	s.metadata.record(c.Request.Context(), imageRecord{
+		Filename:         filename,
+		OriginalFilename: header.Filename,
+		ContentType:      getMimeType(filename),
+		Size:             info.Size,
+		SHA256:           hex.EncodeToString(h.Sum(nil)),
+		Uploader:         c.ClientIP(),
+		Source:           sourceUpload,
+	})
+	go s.metadata.screen(context.Background(), filename)
+	s.purgeTransforms(filename)
+	if src := s.generateThumbnails(c.Request.Context(), filename); src != nil && s.placeholders {
+		if _, err := s.storePlaceholder(c.Request.Context(), src, filename); err != nil {
+			logger.Error("failed to store placeholder", "file", filename, "error", err)
+		}
+	} else {
+		s.removePlaceholder(c.Request.Context(), filename)
+	}
+	s.precompress(c.Request.Context(), filename)
+
+	response := gin.H{
+		"message":   "File updated",
+		"size":      header.Size,
+		"integrity": integrity(hex.EncodeToString(h.Sum(nil))),
+	}
+	if len(findings) > 0 {
+		response["pii_findings"] = findings
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+func (s *fileStore) remove(c *gin.Context) {
+	filename := c.Param("filename")
+	if _, readOnly, _ := s.stat(c.Request.Context(), filename); readOnly {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "File is read-only."})
+		return
+	}
+
+	err := s.storage.Delete(c.Request.Context(), filename)
+	if errors.Is(err, ErrNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File Not found."})
+		return
+	}
+	if err != nil {
+		storageFailed(c, err, "Failed to remove file.")
+		return
+	}
+	s.removeDerivatives(c.Request.Context(), filename)
+	s.removeThumbnails(c.Request.Context(), filename)
+	s.removePlaceholder(c.Request.Context(), filename)
+	s.removePrecompressed(c.Request.Context(), filename)
+	s.removeVersions(c.Request.Context(), filename)
+	s.metadata.forget(c.Request.Context(), filename)
+	s.purgeTransforms(filename)
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "File removed"})
+}
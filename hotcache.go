@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+// Settings of the in-memory cache of small objects; hotCacheMaxBytes 0
+// disables it.
+var (
+	hotCacheMaxBytes       int64
+	hotCacheMaxObjectBytes int64
+	hotCacheTTL            time.Duration
+)
+
+var (
+	hotCacheHits   = expvar.NewInt("hot_cache_hits_total")
+	hotCacheMisses = expvar.NewInt("hot_cache_misses_total")
+)
+
+// hotCache keeps the contents of small, frequently read objects in memory,
+// in least-recently-used order within maxBytes, so serving them touches
+// neither the disk nor a remote backend. Writes through the cache drop the
+// entries they replace; changes made around it, such as duplicate merges,
+// show once an entry is older than the TTL.
+type hotCache struct {
+	backend Storage
+
+	mu         sync.Mutex
+	order      *list.List // of *hotEntry, most recently used first
+	entries    map[string]*list.Element
+	bytes      int64
+	generation uint64 // bumped by every write, to drop reads that raced one
+}
+
+type hotEntry struct {
+	info    ObjectInfo
+	data    []byte
+	fetched time.Time
+}
+
+// withHotCache wraps backend in a hot cache when one is configured.
+func withHotCache(backend Storage) Storage {
+	if hotCacheMaxBytes <= 0 {
+		return backend
+	}
+	return &hotCache{backend: backend, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// lookup returns the fresh entry of name, marking it as recently used.
+func (h *hotCache) lookup(name string) (*hotEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	element, ok := h.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*hotEntry)
+	if hotCacheTTL > 0 && time.Since(entry.fetched) > hotCacheTTL {
+		h.remove(name)
+		return nil, false
+	}
+	h.order.MoveToFront(element)
+	return entry, true
+}
+
+// remove drops name; h.mu must be held.
+func (h *hotCache) remove(name string) {
+	if element, ok := h.entries[name]; ok {
+		h.bytes -= int64(len(element.Value.(*hotEntry).data))
+		h.order.Remove(element)
+		delete(h.entries, name)
+	}
+}
+
+// invalidate drops name before or after a write to it.
+func (h *hotCache) invalidate(name string) {
+	h.mu.Lock()
+	h.remove(name)
+	h.generation++
+	h.mu.Unlock()
+}
+
+// store adds an entry read at generation, unless a write happened since,
+// and evicts the least recently used entries beyond maxBytes.
+func (h *hotCache) store(entry *hotEntry, generation uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if generation != h.generation {
+		return
+	}
+	h.remove(entry.info.Name)
+	h.entries[entry.info.Name] = h.order.PushFront(entry)
+	h.bytes += int64(len(entry.data))
+	for h.bytes > hotCacheMaxBytes && h.order.Len() > 0 {
+		h.remove(h.order.Back().Value.(*hotEntry).info.Name)
+	}
+}
+
+func (h *hotCache) Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error) {
+	h.invalidate(name)
+	defer h.invalidate(name)
+	return h.backend.Put(ctx, name, r)
+}
+
+// Get serves cached objects from memory. Misses of objects up to
+// hotCacheMaxObjectBytes are read in full and cached; larger ones stream
+// from the backend as before.
+func (h *hotCache) Get(ctx context.Context, name string) (io.ReadCloser, ObjectInfo, error) {
+	if entry, ok := h.lookup(name); ok {
+		hotCacheHits.Add(1)
+		return nopSeekCloser{bytes.NewReader(entry.data)}, entry.info, nil
+	}
+	hotCacheMisses.Add(1)
+
+	h.mu.Lock()
+	generation := h.generation
+	h.mu.Unlock()
+	body, info, err := h.backend.Get(ctx, name)
+	if err != nil || info.Size > hotCacheMaxObjectBytes {
+		return body, info, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, hotCacheMaxObjectBytes+1))
+	if err != nil {
+		body.Close()
+		return nil, info, err
+	}
+	if int64(len(data)) > hotCacheMaxObjectBytes {
+		// Larger than reported; serve it uncached.
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, info, nil
+	}
+	body.Close()
+	h.store(&hotEntry{info: info, data: data, fetched: time.Now()}, generation)
+	return nopSeekCloser{bytes.NewReader(data)}, info, nil
+}
+
+func (h *hotCache) Delete(ctx context.Context, name string) error {
+	h.invalidate(name)
+	defer h.invalidate(name)
+	return h.backend.Delete(ctx, name)
+}
+
+func (h *hotCache) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	if entry, ok := h.lookup(name); ok {
+		return entry.info, nil
+	}
+	return h.backend.Stat(ctx, name)
+}
+
+func (h *hotCache) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return h.backend.List(ctx, prefix)
+}
+
+// nopSeekCloser serves cached bytes with range support.
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
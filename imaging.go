@@ -0,0 +1,253 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// decodeImage decodes the image at path in any registered format.
+func decodeImage(path string) (image.Image, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	return image.Decode(file)
+}
+
+// resizeImage scales src to exactly w x h.
+func resizeImage(src image.Image, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// luminance returns the Rec. 601 luma of the pixel at (x, y) in 16-bit range.
+func luminance(img image.Image, x, y int) uint32 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (299*r + 587*g + 114*b) / 1000
+}
+
+// cropSquare returns the largest centered square of src.
+func cropSquare(src image.Image) image.Image {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	return cropImage(src, gravityRect(b, side, side, "center"))
+}
+
+// cropImage copies the region rect of src into a new image.
+func cropImage(src image.Image, rect image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, rect.Min, draw.Src)
+	return dst
+}
+
+// rotateImage turns src clockwise by degrees, a multiple of 90.
+func rotateImage(src image.Image, degrees int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var dst *image.RGBA
+	if degrees == 180 {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := range h {
+		for x := range w {
+			c := src.At(b.Min.X+x, b.Min.Y+y)
+			switch degrees {
+			case 90:
+				dst.Set(h-1-y, x, c)
+			case 180:
+				dst.Set(w-1-x, h-1-y, c)
+			case 270:
+				dst.Set(y, w-1-x, c)
+			}
+		}
+	}
+	return dst
+}
+
+// flipImage mirrors src left to right when horizontal is set, otherwise top
+// to bottom.
+func flipImage(src image.Image, horizontal bool) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := src.At(b.Min.X+x, b.Min.Y+y)
+			if horizontal {
+				dst.Set(w-1-x, y, c)
+			} else {
+				dst.Set(x, h-1-y, c)
+			}
+		}
+	}
+	return dst
+}
+
+// orientImage applies an EXIF orientation (1-8) to src, returning it as it
+// is meant to be displayed.
+func orientImage(src image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return flipImage(src, true)
+	case 3:
+		return rotateImage(src, 180)
+	case 4:
+		return flipImage(src, false)
+	case 5:
+		return flipImage(rotateImage(src, 90), true)
+	case 6:
+		return rotateImage(src, 90)
+	case 7:
+		return flipImage(rotateImage(src, 270), true)
+	case 8:
+		return rotateImage(src, 270)
+	}
+	return src
+}
+
+// gravityRect places a w x h region inside bounds, pushed toward gravity:
+// center, top, bottom, left or right.
+func gravityRect(bounds image.Rectangle, w, h int, gravity string) image.Rectangle {
+	x := bounds.Min.X + (bounds.Dx()-w)/2
+	y := bounds.Min.Y + (bounds.Dy()-h)/2
+	switch gravity {
+	case "top":
+		y = bounds.Min.Y
+	case "bottom":
+		y = bounds.Max.Y - h
+	case "left":
+		x = bounds.Min.X
+	case "right":
+		x = bounds.Max.X - w
+	}
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// smartRect places a w x h region inside src where the image is busiest,
+// measured by the entropy of its luminance. Subjects such as faces carry
+// more detail than the sky or walls around them, so this keeps them in
+// frame where a center crop may cut them off. The region spans src along
+// one axis, so only its offset along the other is searched, on a coarse
+// grid to keep large images cheap.
+func smartRect(src image.Image, w, h int) image.Rectangle {
+	b := src.Bounds()
+	step := max(1, max(b.Dx(), b.Dy())/128)
+	gw, gh := b.Dx()/step, b.Dy()/step
+	grid := make([]uint8, gw*gh)
+	for y := range gh {
+		for x := range gw {
+			grid[y*gw+x] = uint8(luminance(src, b.Min.X+x*step, b.Min.Y+y*step) >> 10)
+		}
+	}
+
+	horizontal := w < b.Dx()
+	span, free := b.Dy()-h, h/step
+	if horizontal {
+		span, free = b.Dx()-w, w/step
+	}
+	if span <= 0 || free == 0 {
+		return gravityRect(b, w, h, "center")
+	}
+	// Entropy of a window of the grid starting at offset cells along the
+	// free axis.
+	entropy := func(offset int) float64 {
+		var histogram [64]int
+		x0, y0, x1, y1 := 0, offset, gw, offset+free
+		if horizontal {
+			x0, y0, x1, y1 = offset, 0, offset+free, gh
+		}
+		for y := y0; y < min(y1, gh); y++ {
+			for x := x0; x < min(x1, gw); x++ {
+				histogram[grid[y*gw+x]]++
+			}
+		}
+		total := float64((min(x1, gw) - x0) * (min(y1, gh) - y0))
+		var e float64
+		for _, n := range histogram {
+			if n > 0 {
+				p := float64(n) / total
+				e -= p * math.Log2(p)
+			}
+		}
+		return e
+	}
+
+	const candidates = 32
+	cells := span / step
+	best, bestScore := span/2, math.Inf(-1)
+	for i := range candidates + 1 {
+		offset := cells * i / candidates
+		// A slight pull toward the center breaks ties between flat regions.
+		score := entropy(offset) - 0.1*math.Abs(float64(offset*2-cells))/float64(max(cells, 1))
+		if score > bestScore {
+			best, bestScore = min(offset*step, span), score
+		}
+	}
+	if horizontal {
+		return image.Rect(b.Min.X+best, b.Min.Y, b.Min.X+best+w, b.Min.Y+h)
+	}
+	return image.Rect(b.Min.X, b.Min.Y+best, b.Min.X+w, b.Min.Y+best+h)
+}
+
+// fillImage covers a w x h box with src and crops the overflow toward
+// gravity, or around the busiest region for "smart". Smaller sources are cropped to the box's aspect ratio but not
+// enlarged.
+func fillImage(src image.Image, w, h int, gravity string) image.Image {
+	b := src.Bounds()
+	// The largest region of src with the box's aspect ratio.
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	cw, ch = max(cw, 1), max(ch, 1)
+	rect := gravityRect(b, cw, ch, gravity)
+	if gravity == "smart" {
+		rect = smartRect(src, cw, ch)
+	}
+	img := cropImage(src, rect)
+	if cw <= w {
+		return img
+	}
+	return resizeImage(img, w, h)
+}
+
+// fitImage scales src to fit within a w x h box, keeping its aspect ratio.
+// A zero dimension is unbounded, and images already inside the box are
+// returned unchanged.
+func fitImage(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	scale := 1.0
+	if w > 0 && b.Dx() > w {
+		scale = float64(w) / float64(b.Dx())
+	}
+	if h > 0 && b.Dy() > h {
+		scale = min(scale, float64(h)/float64(b.Dy()))
+	}
+	if scale == 1 {
+		return src
+	}
+	return resizeImage(src, max(int(float64(b.Dx())*scale+0.5), 1), max(int(float64(b.Dy())*scale+0.5), 1))
+}
+
+// padImage centers src, scaled to scale of side, on a side x side canvas filled with bg.
+func padImage(src image.Image, side int, scale float64, bg color.Color) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	inner := int(float64(side) * scale)
+	offset := (side - inner) / 2
+	draw.CatmullRom.Scale(dst, image.Rect(offset, offset, offset+inner, offset+inner), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
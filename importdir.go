@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importRecord describes one imported file. The journal is a JSON-lines file
+// of these records, which doubles as the import manifest and lets an
+// interrupted run resume where it stopped.
+type importRecord struct {
+	Source   string `json:"source"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+// runImportDir implements the import-dir command: it copies every regular
+// file under a directory into the image storage, optionally renaming it to
+// the UUID scheme, and records checksums and dimensions in the journal.
+func runImportDir(args []string) int {
+	flags := flag.NewFlagSet("import-dir", flag.ExitOnError)
+	rename := flags.Bool("rename", false, "store files under new UUID-based names instead of their own")
+	journalPath := flags.String("journal", filepath.Join(uploadDirPath, ".import-journal"), "JSON-lines journal used to resume an interrupted import")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: image-server import-dir [--rename] [--journal path] <dir>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	root := flags.Arg(0)
+
+	if err := os.MkdirAll(filepath.Dir(*journalPath), 0755); err != nil {
+		logger.Error("failed to create journal directory", "journal", *journalPath, "error", err)
+		return 1
+	}
+	done, err := readImportJournal(*journalPath)
+	if err != nil {
+		logger.Error("failed to read import journal", "journal", *journalPath, "error", err)
+		return 1
+	}
+	journal, err := os.OpenFile(*journalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("failed to open import journal", "journal", *journalPath, "error", err)
+		return 1
+	}
+	defer journal.Close()
+
+	var imported, skipped, failed int
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && path != root && strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if done[rel] {
+			skipped++
+			return nil
+		}
+
+		filename := entry.Name()
+		if *rename {
+			filename = newImageName(filename)
+		}
+		record, err := importFile(context.Background(), path, filename)
+		if err != nil {
+			logger.Error("failed to import file", "file", rel, "error", err)
+			failed++
+			return nil
+		}
+		record.Source = rel
+
+		line, _ := json.Marshal(record)
+		if _, err := journal.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		fmt.Println(string(line))
+		imported++
+		return nil
+	})
+	if err != nil {
+		logger.Error("import stopped", "error", err)
+		return 1
+	}
+
+	logger.Info("import finished", "imported", imported, "skipped", skipped, "failed", failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readImportJournal returns the source paths already recorded in the journal.
+func readImportJournal(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record importRecord
+		// A run killed mid-write can leave a truncated last line; that file is
+		// simply imported again.
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Source != "" {
+			done[record.Source] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// importFile stores src in the image storage as filename, hashing it on the
+// way. Put is atomic, so an interrupted import never leaves a partial object
+// under its final name.
+func importFile(ctx context.Context, src, filename string) (importRecord, error) {
+	record := importRecord{Filename: filename}
+	if _, err := imageStorage.Stat(ctx, filename); err == nil {
+		return record, fmt.Errorf("%s is already stored", filename)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return record, err
+	}
+	defer in.Close()
+
+	if cfg, _, err := image.DecodeConfig(in); err == nil {
+		record.Width, record.Height = cfg.Width, cfg.Height
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return record, err
+	}
+
+	findings, err := checkPII(in)
+	if len(findings) > 0 {
+		recordPIIFindings(sourceImport, filepath.Base(src), findings)
+	}
+	if err != nil {
+		return record, err
+	}
+
+	h := sha256.New()
+	body := uploadReader(in, findings)
+	defer body.Close()
+	info, err := imageStorage.Put(ctx, filename, io.TeeReader(body, h))
+	if err != nil {
+		return record, err
+	}
+	record.Size = info.Size
+	record.SHA256 = hex.EncodeToString(h.Sum(nil))
+	imageMetadata.record(ctx, imageRecord{
+		Filename:         filename,
+		OriginalFilename: filepath.Base(src),
+		ContentType:      getMimeType(filename),
+		Size:             info.Size,
+		SHA256:           record.SHA256,
+		Source:           sourceImport,
+	})
+	imageMetadata.screen(ctx, filename)
+	return record, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// head answers HEAD requests with the headers a GET of the original would
+// send, from the object's metadata alone so backends aren't asked for its
+// content. Conversions, precompressed copies and missing files are served
+// as for GET, net/http dropping the body.
+func (s *fileStore) head(c *gin.Context) {
+	filename := c.Param("filename")
+	if c.GetBool("vanityPreset") || responseCompression.Load() && isSVG(filename) {
+		s.serve(c)
+		return
+	}
+	if s.cache != nil {
+		if _, transform, err := parseTransformOptions(c, filename); err != nil || transform {
+			s.serve(c)
+			return
+		}
+	}
+	info, _, err := s.stat(c.Request.Context(), filename)
+	if err != nil {
+		s.serve(c)
+		return
+	}
+
+	contentType := getMimeType(filename)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", s.disposition(contentType)+"; filename="+filename)
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	setCacheControl(c, s.cacheControl)
+	setLastModified(c, info.ModTime)
+	etag := s.etag(c.Request.Context(), info)
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	if etagMatches(c.GetHeader("If-None-Match"), etag, true) || notModifiedSince(c.Request, info.ModTime) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+// info describes a stored file in JSON: its type, size and checksum and,
+// for images, their format and dimensions as displayed. The file is read
+// once, and images only as far as their header.
+func (s *fileStore) info(c *gin.Context) {
+	filename := c.Param("filename")
+	body, object, _, err := s.open(c.Request.Context(), filename)
+	if errors.Is(err, ErrStorageTimeout) {
+		storageFailed(c, err, "Failed to read file.")
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	content := io.TeeReader(body, h)
+	var head bytes.Buffer
+	tiff, _ := readExif(io.TeeReader(content, &head))
+	config, format, decodeErr := image.DecodeConfig(io.MultiReader(&head, content))
+	// The rest of the file is only read for its checksum.
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		storageFailed(c, err, "Failed to read file.")
+		return
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	rememberETag(object, checksum)
+
+	contentType := getMimeType(filename)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	response := gin.H{
+		"filename":     filename,
+		"content_type": contentType,
+		"size":         object.Size,
+		"sha256":       checksum,
+		"integrity":    integrity(checksum),
+		"etag":         formatETag(checksum),
+		"modified_at":  object.ModTime.UTC().Truncate(time.Second),
+	}
+	if decodeErr == nil {
+		width, height := config.Width, config.Height
+		// Orientations 5 to 8 turn the image a quarter, so it displays with
+		// its sides swapped.
+		if autoOrient.Load() && exifOrientation(tiff) >= 5 {
+			width, height = height, width
+		}
+		response["format"], response["width"], response["height"] = format, width, height
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
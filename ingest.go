@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchDropDir polls dir and moves every settled file into the upload
+// directory under a new image name. It serves legacy systems that can only
+// push files via FTP/SFTP into a shared directory.
+func watchDropDir(dir string, interval, settle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			logger.Error("failed to read ingest directory", "dir", dir, "error", err)
+			continue
+		}
+
+		for _, entry := range entries {
+			// Dotfiles are usually partial uploads of FTP/rsync clients.
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < settle {
+				continue
+			}
+
+			newFileName, err := ingestFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				logger.Error("failed to ingest file", "file", entry.Name(), "error", err)
+				continue
+			}
+			logger.Info("ingested file",
+				"original_filename", entry.Name(),
+				"filename", newFileName,
+				"size", info.Size(),
+				"modified", info.ModTime())
+		}
+	}
+}
+
+// ingestFile stores src in the image storage under a new image name and
+// removes it from the drop directory. A file PII_POLICY rejects is renamed
+// to a dotfile, which is kept for review but no longer picked up.
+func ingestFile(src string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	findings, err := checkPII(in)
+	if len(findings) > 0 {
+		recordPIIFindings(sourceIngest, filepath.Base(src), findings)
+	}
+	if errors.Is(err, errPIIRejected) {
+		if renameErr := os.Rename(src, filepath.Join(filepath.Dir(src), "."+filepath.Base(src))); renameErr != nil {
+			return "", renameErr
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	newFileName := newImageName(filepath.Base(src))
+	h := sha256.New()
+	body := uploadReader(in, findings)
+	defer body.Close()
+	info, err := imageStorage.Put(context.Background(), newFileName, io.TeeReader(body, h))
+	if err != nil {
+		return "", err
+	}
+	imageMetadata.record(context.Background(), imageRecord{
+		Filename:         newFileName,
+		OriginalFilename: filepath.Base(src),
+		ContentType:      getMimeType(newFileName),
+		Size:             info.Size,
+		SHA256:           hex.EncodeToString(h.Sum(nil)),
+		Source:           sourceIngest,
+	})
+	go imageMetadata.screen(context.Background(), newFileName)
+	return newFileName, os.Remove(src)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// integritySigner signs integrity exports with the key of
+// INTEGRITY_KEY_FILE; nil disables them.
+var integritySigner *contentSigner
+
+// integrityExportVersion names the layout of the signed statement and of
+// the Merkle tree, for verifiers.
+const integrityExportVersion = 1
+
+// maxIntegrityExport bounds the body of a verification request.
+const maxIntegrityExport = 256 << 20
+
+// coseAlgorithms names the COSE algorithm identifiers of contentSigner.
+var coseAlgorithms = map[int64]string{-7: "ES256", -35: "ES384", -36: "ES512", -37: "PS256", -8: "EdDSA"}
+
+type integrityObject struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+type integritySignature struct {
+	Algorithm string `json:"alg"`
+	// PublicKey is the DER SubjectPublicKeyInfo of the signing key.
+	PublicKey string `json:"public_key"`
+	Value     string `json:"value"`
+}
+
+// integrityExport is a signed statement of the content of every stored
+// image at GeneratedAt. Root is the RFC 6962 Merkle tree hash of the
+// objects sorted by filename, each leaf hashing the filename, a NUL byte
+// and the object's SHA-256; the signature covers statement().
+type integrityExport struct {
+	Version     int                `json:"version"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Count       int                `json:"count"`
+	Root        string             `json:"root"`
+	Signature   integritySignature `json:"signature"`
+	Objects     []integrityObject  `json:"objects"`
+}
+
+// statement is the text an export's signature covers.
+func (e integrityExport) statement() string {
+	return fmt.Sprintf("image-server integrity export\nversion:%d\ngenerated_at:%s\ncount:%d\nroot:%s\n",
+		e.Version, e.GeneratedAt.UTC().Format(time.RFC3339), e.Count, e.Root)
+}
+
+func merkleLeaf(object integrityObject) ([]byte, error) {
+	sum, err := hex.DecodeString(object.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("invalid sha256 of " + object.Filename)
+	}
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write([]byte(object.Filename))
+	h.Write([]byte{0})
+	h.Write(sum)
+	return h.Sum(nil), nil
+}
+
+// merkleRoot returns the RFC 6962 tree hash of leaves: the left subtree
+// holds the largest power of two leaves smaller than all of them.
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(merkleRoot(leaves[:k]))
+	h.Write(merkleRoot(leaves[k:]))
+	return h.Sum(nil)
+}
+
+// objectsRoot returns the hex Merkle root of objects, which must be
+// sorted by filename.
+func objectsRoot(objects []integrityObject) (string, error) {
+	leaves := make([][]byte, len(objects))
+	for i, object := range objects {
+		leaf, err := merkleLeaf(object)
+		if err != nil {
+			return "", err
+		}
+		leaves[i] = leaf
+	}
+	return hex.EncodeToString(merkleRoot(leaves)), nil
+}
+
+// hashStoredImages reads every stored image, not trusting the checksums of
+// the metadata store, and returns them sorted by filename. Images removed
+// while it runs are left out.
+func hashStoredImages(ctx context.Context) ([]integrityObject, error) {
+	listed, err := imageStorage.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	listed = slices.DeleteFunc(listed, func(object ObjectInfo) bool { return isDerivedObject(object.Name) })
+	slices.SortFunc(listed, func(a, b ObjectInfo) int { return strings.Compare(a.Name, b.Name) })
+	objects := make([]integrityObject, 0, len(listed))
+	for _, object := range listed {
+		body, _, err := imageStorage.Get(ctx, object.Name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", object.Name, err)
+		}
+		objects = append(objects, integrityObject{Filename: object.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+	}
+	return objects, nil
+}
+
+// verifySignature checks sig over message with the DER public key of an
+// export, as contentSigner.signBytes signs with alg.
+func verifySignature(alg, publicKey, sig string, message []byte) bool {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return false
+	}
+	value, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+	hashes := map[string]crypto.Hash{"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512, "PS256": crypto.SHA256}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, message, value)
+	case *ecdsa.PublicKey:
+		hash, ok := hashes[alg]
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !ok || !strings.HasPrefix(alg, "ES") || len(value) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(message)
+		r, s := new(big.Int).SetBytes(value[:size]), new(big.Int).SetBytes(value[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	case *rsa.PublicKey:
+		if alg != "PS256" {
+			return false
+		}
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPSS(key, crypto.SHA256, digest[:], value, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+	return false
+}
+
+// exportIntegrity hashes every stored image and answers with the signed
+// export, for auditors to keep and verify at the next audit.
+func exportIntegrity(c *gin.Context) {
+	if integritySigner == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Integrity exports need INTEGRITY_KEY_FILE."})
+		return
+	}
+	objects, err := hashStoredImages(c.Request.Context())
+	if err != nil {
+		logger.Error("integrity export failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the stored images."})
+		return
+	}
+	root, err := objectsRoot(objects)
+	if err != nil {
+		logger.Error("integrity export failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to hash the stored images."})
+		return
+	}
+	export := integrityExport{
+		Version:     integrityExportVersion,
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		Count:       len(objects),
+		Root:        root,
+		Objects:     objects,
+	}
+	sig, err := integritySigner.signBytes([]byte(export.statement()))
+	if err != nil {
+		logger.Error("integrity export failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to sign the export."})
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(integritySigner.key.(crypto.Signer).Public())
+	if err != nil {
+		logger.Error("integrity export failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to sign the export."})
+		return
+	}
+	export.Signature = integritySignature{
+		Algorithm: coseAlgorithms[integritySigner.alg],
+		PublicKey: base64.StdEncoding.EncodeToString(der),
+		Value:     base64.StdEncoding.EncodeToString(sig),
+	}
+	logger.Info("integrity export generated", "count", export.Count, "root", root, "user", c.GetString("adminUser"))
+	c.IndentedJSON(http.StatusOK, export)
+}
+
+// verifyIntegrity checks an export against its signature and the stored
+// images now. Images replaced since, legitimately or not, are reported as
+// modified; the export can't tell the two apart. Only an export signed with
+// the server's key can be intact: anyone able to rewrite the storage can
+// sign an export of it with a key of their own.
+func verifyIntegrity(c *gin.Context) {
+	var export integrityExport
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxIntegrityExport)
+	if err := c.ShouldBindJSON(&export); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "An integrity export is required."})
+		return
+	}
+	if export.Version != integrityExportVersion {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Only version %d exports can be verified.", integrityExportVersion)})
+		return
+	}
+	sig := export.Signature
+	signed := verifySignature(sig.Algorithm, sig.PublicKey, sig.Value, []byte(export.statement()))
+	currentKey := false
+	if integritySigner != nil {
+		der, err := x509.MarshalPKIXPublicKey(integritySigner.key.(crypto.Signer).Public())
+		key, _ := base64.StdEncoding.DecodeString(sig.PublicKey)
+		currentKey = err == nil && bytes.Equal(der, key)
+	}
+	sorted := slices.IsSortedFunc(export.Objects, func(a, b integrityObject) int { return strings.Compare(a.Filename, b.Filename) })
+	root, err := objectsRoot(export.Objects)
+	consistent := err == nil && sorted && root == export.Root && len(export.Objects) == export.Count
+
+	current, err := hashStoredImages(c.Request.Context())
+	if err != nil {
+		logger.Error("integrity verification failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the stored images."})
+		return
+	}
+	stored := make(map[string]integrityObject, len(current))
+	for _, object := range current {
+		stored[object.Filename] = object
+	}
+	modified, missing, added := []string{}, []string{}, []string{}
+	unchanged := 0
+	for _, object := range export.Objects {
+		now, ok := stored[object.Filename]
+		switch {
+		case !ok:
+			missing = append(missing, object.Filename)
+		case now.SHA256 != object.SHA256:
+			modified = append(modified, object.Filename)
+		default:
+			unchanged++
+		}
+		delete(stored, object.Filename)
+	}
+	for filename := range stored {
+		added = append(added, filename)
+	}
+	slices.Sort(added)
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"signature_valid":  signed,
+		"signed_by_server": currentKey,
+		"root_matches":     consistent,
+		"generated_at":     export.GeneratedAt,
+		"unchanged":        unchanged,
+		"modified":         modified,
+		"missing":          missing,
+		"added":            added,
+		"intact":           signed && currentKey && consistent && len(modified) == 0 && len(missing) == 0,
+	})
+}
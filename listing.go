@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Orders a listing can be sorted in with ?sort=.
+const (
+	sortUploaded = "uploaded"
+	sortSize     = "size"
+	sortName     = "name"
+)
+
+// maxListingPage bounds the entries of one listing page.
+const maxListingPage = 1000
+
+type listedObject struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// listingQuery is a parsed listing request. The cursor, when set, is the
+// sort key of the last entry of the previous page.
+type listingQuery struct {
+	prefix      string
+	contentType string
+	minBytes    int64
+	maxBytes    int64
+	since       time.Time
+	before      time.Time
+	sort        string
+	descending  bool
+	limit       int
+	// tags, when set, limits the listing to images carrying all of them.
+	tags []string
+
+	cursorValue int64
+	cursorName  string
+	hasCursor   bool
+}
+
+// key returns the value object is sorted by in q before its name.
+func (q listingQuery) key(object ObjectInfo) int64 {
+	switch q.sort {
+	case sortSize:
+		return object.Size
+	case sortName:
+		return 0
+	}
+	return object.ModTime.UnixNano()
+}
+
+// compare orders a and b by q's sort key, ties broken by name, so every
+// object has a distinct position a cursor can resume after.
+func (q listingQuery) compare(aValue int64, aName string, bValue int64, bName string) int {
+	n := 0
+	switch {
+	case aValue < bValue:
+		n = -1
+	case aValue > bValue:
+		n = 1
+	default:
+		n = strings.Compare(aName, bName)
+	}
+	if q.descending {
+		return -n
+	}
+	return n
+}
+
+func (q listingQuery) matches(object ObjectInfo) bool {
+	if isDerivedObject(object.Name) {
+		return false
+	}
+	if q.contentType != "" && !strings.HasPrefix(getMimeType(object.Name), q.contentType) {
+		return false
+	}
+	if q.minBytes > 0 && object.Size < q.minBytes {
+		return false
+	}
+	if q.maxBytes > 0 && object.Size > q.maxBytes {
+		return false
+	}
+	if !q.since.IsZero() && object.ModTime.Before(q.since) {
+		return false
+	}
+	if !q.before.IsZero() && !object.ModTime.Before(q.before) {
+		return false
+	}
+	return !q.hasCursor || q.compare(q.key(object), object.Name, q.cursorValue, q.cursorName) > 0
+}
+
+func encodeListingCursor(sort string, value int64, name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sort + ":" + strconv.FormatInt(value, 10) + ":" + name))
+}
+
+// parseListingQuery reads the listing parameters of c, returning a message
+// for the client when one is invalid.
+func parseListingQuery(c *gin.Context) (listingQuery, string) {
+	q := listingQuery{
+		prefix:      c.Query("prefix"),
+		contentType: c.Query("type"),
+		sort:        c.DefaultQuery("sort", sortUploaded),
+		descending:  c.DefaultQuery("order", "desc") == "desc",
+		limit:       100,
+	}
+	if q.sort != sortUploaded && q.sort != sortSize && q.sort != sortName {
+		return q, "sort must be uploaded, size or name"
+	}
+	if order := c.DefaultQuery("order", "desc"); order != "asc" && order != "desc" {
+		return q, "order must be asc or desc"
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListingPage {
+			return q, "limit must be between 1 and " + strconv.Itoa(maxListingPage)
+		}
+		q.limit = n
+	}
+	for _, bound := range []struct {
+		param string
+		value *int64
+	}{
+		{"min_bytes", &q.minBytes},
+		{"max_bytes", &q.maxBytes},
+	} {
+		if v := c.Query(bound.param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return q, bound.param + " must be a non-negative number of bytes"
+			}
+			*bound.value = n
+		}
+	}
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{
+		{"since", &q.since},
+		{"before", &q.before},
+	} {
+		if v := c.Query(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, bound.param + " must be an RFC 3339 time"
+			}
+			*bound.value = t
+		}
+	}
+	if values := c.QueryArray("tag"); len(values) > 0 {
+		tags, err := parseTags(values)
+		if err != nil {
+			return q, err.Error()
+		}
+		if len(tags) > 0 {
+			q.tags = tags
+		}
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		parts := strings.SplitN(string(raw), ":", 3)
+		if err != nil || len(parts) != 3 || parts[0] != q.sort {
+			return q, "cursor is invalid or belongs to another sort order"
+		}
+		if q.cursorValue, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return q, "cursor is invalid or belongs to another sort order"
+		}
+		q.cursorName, q.hasCursor = parts[2], true
+	}
+	return q, ""
+}
+
+// list serves a page of the stored files, newest first unless ?sort= and
+// ?order= say otherwise. With the metadata store, the page is queried from
+// it; otherwise the storage is listed. next_cursor, present while more
+// entries remain, resumes the listing after the page; entries stored
+// meanwhile are only listed when they sort after it.
+func (s *fileStore) list(c *gin.Context) {
+	q, problem := parseListingQuery(c)
+	if problem != "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": problem})
+		return
+	}
+	var page []listedObject
+	var next string
+	var err error
+	switch {
+	case s.metadata != nil:
+		page, next, err = s.metadata.listImages(c.Request.Context(), q)
+	case q.tags != nil:
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Tags need the metadata store."})
+		return
+	default:
+		page, next, err = s.scan(c.Request.Context(), q)
+	}
+	if err != nil {
+		logger.Error("listing failed", "route", s.route, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to list files."})
+		return
+	}
+	response := gin.H{strings.TrimPrefix(s.route, "/"): page, "count": len(page)}
+	if next != "" {
+		response["next_cursor"] = next
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// listImages returns the page of the recorded images q asks for, and the
+// cursor of the next page, if any. Images sort by when they were first
+// stored, which replacing them doesn't change.
+func (m *metadataStore) listImages(ctx context.Context, q listingQuery) ([]listedObject, string, error) {
+	column := "created_at"
+	switch q.sort {
+	case sortSize:
+		column = "size"
+	case sortName:
+		column = ""
+	}
+	var where []string
+	var args []any
+	if q.prefix != "" {
+		where = append(where, "substr(filename, 1, ?) = ?")
+		args = append(args, utf8.RuneCountInString(q.prefix), q.prefix)
+	}
+	if q.contentType != "" {
+		where = append(where, `content_type LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(q.contentType)+"%")
+	}
+	if q.minBytes > 0 {
+		where = append(where, "size >= ?")
+		args = append(args, q.minBytes)
+	}
+	if q.maxBytes > 0 {
+		where = append(where, "size <= ?")
+		args = append(args, q.maxBytes)
+	}
+	if !q.since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.since.UnixMilli())
+	}
+	if !q.before.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.before.UnixMilli())
+	}
+	if q.tags != nil {
+		where = append(where, "filename IN (SELECT filename FROM image_tags WHERE tag IN ("+
+			strings.TrimSuffix(strings.Repeat("?, ", len(q.tags)), ", ")+") GROUP BY filename HAVING COUNT(*) = ?)")
+		for _, tag := range q.tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(q.tags))
+	}
+	direction, after := "ASC", ">"
+	if q.descending {
+		direction, after = "DESC", "<"
+	}
+	if q.hasCursor {
+		if column == "" {
+			where = append(where, "filename "+after+" ?")
+			args = append(args, q.cursorName)
+		} else {
+			where = append(where, "("+column+" "+after+" ? OR "+column+" = ? AND filename "+after+" ?)")
+			args = append(args, q.cursorValue, q.cursorValue, q.cursorName)
+		}
+	}
+	query := "SELECT " + imageColumns + " FROM images"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY "
+	if column != "" {
+		query += column + " " + direction + ", "
+	}
+	query += "filename " + direction + " LIMIT ?"
+	args = append(args, q.limit+1)
+	rows, err := m.db.QueryContext(ctx, m.rebind(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	records, err := scanImageRecords(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := []listedObject{}
+	for _, r := range records[:min(q.limit, len(records))] {
+		page = append(page, listedObject{Filename: r.Filename, ContentType: r.ContentType, Size: r.Size, UploadedAt: r.CreatedAt})
+	}
+	if len(records) <= q.limit {
+		return page, "", nil
+	}
+	last := records[q.limit-1]
+	value := last.CreatedAt.UnixMilli()
+	switch q.sort {
+	case sortSize:
+		value = last.Size
+	case sortName:
+		value = 0
+	}
+	return page, encodeListingCursor(q.sort, value, last.Filename), nil
+}
+
+// scan returns the page q asks for by listing the storage, for stores
+// without metadata. Objects sort by when they were last written.
+func (s *fileStore) scan(ctx context.Context, q listingQuery) ([]listedObject, string, error) {
+	objects, err := s.storage.List(ctx, q.prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	objects = slices.DeleteFunc(objects, func(object ObjectInfo) bool { return !q.matches(object) })
+	slices.SortFunc(objects, func(a, b ObjectInfo) int {
+		return q.compare(q.key(a), a.Name, q.key(b), b.Name)
+	})
+
+	page := []listedObject{}
+	for _, object := range objects[:min(q.limit, len(objects))] {
+		page = append(page, listedObject{
+			Filename:    object.Name,
+			ContentType: getMimeType(object.Name),
+			Size:        object.Size,
+			UploadedAt:  object.ModTime.UTC(),
+		})
+	}
+	if len(objects) <= q.limit {
+		return page, "", nil
+	}
+	last := objects[q.limit-1]
+	return page, encodeListingCursor(q.sort, q.key(last), last.Name), nil
+}
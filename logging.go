@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+	// bodySampleRate holds the float64 bits of the fraction of requests whose
+	// body is logged; zero disables sampling.
+	bodySampleRate  atomic.Uint64
+	bodySampleBytes atomic.Int64
+)
+
+type loggingSettings struct {
+	Level           string   `json:"level"`
+	BodySampleRate  *float64 `json:"body_sample_rate"`
+	BodySampleBytes *int64   `json:"body_sample_bytes"`
+}
+
+func currentLoggingSettings() loggingSettings {
+	rate := math.Float64frombits(bodySampleRate.Load())
+	size := bodySampleBytes.Load()
+	return loggingSettings{Level: logLevel.Level().String(), BodySampleRate: &rate, BodySampleBytes: &size}
+}
+
+// applyLoggingSettings updates whichever settings are present in s.
+func applyLoggingSettings(s loggingSettings) error {
+	if s.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.ToUpper(s.Level))); err != nil {
+			return err
+		}
+		logLevel.Set(level)
+	}
+	if s.BodySampleRate != nil {
+		bodySampleRate.Store(math.Float64bits(min(max(*s.BodySampleRate, 0), 1)))
+	}
+	if s.BodySampleBytes != nil && *s.BodySampleBytes > 0 {
+		bodySampleBytes.Store(*s.BodySampleBytes)
+	}
+	return nil
+}
+
+// BodySamplingMiddleware logs the first bytes of a sampled fraction of
+// request bodies, for debugging production incidents without a restart.
+func BodySamplingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rate := math.Float64frombits(bodySampleRate.Load())
+		if rate <= 0 || c.Request.Body == nil || rand.Float64() >= rate {
+			c.Next()
+			return
+		}
+
+		sample, err := io.ReadAll(io.LimitReader(c.Request.Body, bodySampleBytes.Load()))
+		if err == nil {
+			logger.Info("request body sample",
+				"method", c.Request.Method,
+				"path", c.Request.URL.Path,
+				"content_type", c.ContentType(),
+				"body", string(sample))
+		}
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(sample), c.Request.Body), c.Request.Body}
+		c.Next()
+	}
+}
+
+func getLoggingSettings(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, currentLoggingSettings())
+}
+
+func updateLoggingSettings(c *gin.Context) {
+	var settings loggingSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid logging settings."})
+		return
+	}
+	if err := applyLoggingSettings(settings); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid log level."})
+		return
+	}
+
+	logger.Info("logging settings changed", "level", logLevel.Level().String(),
+		"body_sample_rate", math.Float64frombits(bodySampleRate.Load()))
+	c.IndentedJSON(http.StatusOK, currentLoggingSettings())
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
-	"crypto/hmac"
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
-	"fmt"
+	"errors"
+	"flag"
+	"image/color"
 	"io"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,172 +27,566 @@ import (
 
 var (
 	uploadDirPath string
-	secretKey     string
+	assetsDirPath string
+	filesDirPath  string
+	tokenMaxTTL   int64
+	tokenMaxSize  int64
+	publicBaseURL string
+	routePrefix   string
+	uploadURLTTL  int64
+	adminToken    string
+	adminUsers    []adminCredential
+	guard         *tarpit
+
+	// oneTimeURLs can be toggled at runtime.
+	oneTimeURLs atomic.Bool
+
+	allowedHosts       []string
+	requireHostBinding bool
+	// trustedProxies are the addresses whose X-Forwarded-For and
+	// X-Forwarded-Proto are believed; by default none is.
+	trustedProxies   []string
+	trustedProxyNets []*net.IPNet
+
+	filesInlineTypes  []string
+	faviconBackground color.RGBA
+	spriteMaxWidth    int
+
+	duplicateHashDistance int
+
+	accessLogDir  string
+	ingestDirPath string
+	serverPort    string
+	adminAddr     string
 )
 
-func init() {
-	uploadDirPath = getEnv("UPLOAD_DIR_PATH", "uploads")
-	secretKey = getEnv("SECRET_KEY", "")
+// loadConfig reads the configuration from the environment and returns every
+// problem found rather than stopping at the first, so --validate can report
+// them all.
+func loadConfig() []error {
+	var errs []error
 
-	if secretKey == "" {
-		panic("SECRET_KEY environment variable is required")
+	uploadDirPath = getEnv("UPLOAD_DIR_PATH", "uploads")
+	assetsDirPath = getEnv("ASSETS_DIR_PATH", "")
+	filesDirPath = getEnv("FILES_DIR_PATH", "files")
+	filesInlineTypes = strings.Split(getEnv("FILES_INLINE_TYPES", "image/,video/,audio/,text/plain,application/pdf"), ",")
+	for _, s := range rotatingSecrets {
+		if err := s.load(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	readSecretSetting := func(key string) string {
+		value, _, err := readSecret(key)
+		if err != nil {
+			errs = append(errs, err)
+		}
 		return value
 	}
-	return defaultValue
-}
+	secretsRefresh = time.Duration(getEnvInt("SECRETS_REFRESH_SECONDS", 300)) * time.Second
+	tokenMaxTTL = getEnvInt("TOKEN_MAX_TTL", 900)
+	publicBaseURL = strings.TrimSuffix(getEnv("PUBLIC_BASE_URL", ""), "/")
+	if u, err := url.Parse(publicBaseURL); publicBaseURL != "" && (err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, errors.New("PUBLIC_BASE_URL must be an absolute http or https URL"))
+	}
+	routePrefix = strings.TrimSuffix(getEnv("ROUTE_PREFIX", ""), "/")
+	if routePrefix != "" && !strings.HasPrefix(routePrefix, "/") {
+		errs = append(errs, errors.New("ROUTE_PREFIX must start with /"))
+	}
+	if uploadURLTTL = getEnvInt("UPLOAD_URL_TTL", 3600); uploadURLTTL <= 0 {
+		errs = append(errs, errors.New("UPLOAD_URL_TTL must be positive"))
+	}
+	tokenMaxSize = getEnvInt("TOKEN_MAX_SIZE", 10<<20)
+	adminToken = readSecretSetting("ADMIN_TOKEN")
+	var err error
+	if adminUsers, err = parseAdminUsers(readSecretSetting("ADMIN_USERS"), adminToken); err != nil {
+		errs = append(errs, err)
+	}
+	oneTimeURLs.Store(getEnv("ONE_TIME_URLS", "false") == "true")
+	requireHostBinding = getEnv("REQUIRE_HOST_BINDING", "false") == "true"
+	for _, host := range strings.Split(getEnv("ALLOWED_HOSTS", ""), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+	for _, proxy := range strings.Split(getEnv("TRUSTED_PROXIES", ""), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		network := proxy
+		if ip := net.ParseIP(proxy); ip != nil {
+			network = ip.String() + "/128"
+			if ip.To4() != nil {
+				network = ip.String() + "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			errs = append(errs, errors.New("TRUSTED_PROXIES must be a comma-separated list of IPs or CIDRs"))
+			break
+		}
+		trustedProxies = append(trustedProxies, proxy)
+		trustedProxyNets = append(trustedProxyNets, ipNet)
+	}
+	bodySampleBytes.Store(1024)
+	if err := applyLoggingSettings(loggingSettings{Level: getEnv("LOG_LEVEL", "info")}); err != nil {
+		errs = append(errs, errors.New("LOG_LEVEL must be one of debug, info, warn, error"))
+	}
 
-func getMimeType(filename string) string {
-	ext := filepath.Ext(filename)
-	return mime.TypeByExtension(ext)
-}
+	if getEnv("CHAOS_ENABLED", "false") == "true" {
+		chaos = chaosConfig{
+			maxLatency:       time.Duration(getEnvInt("CHAOS_MAX_LATENCY_MS", 2000)) * time.Millisecond,
+			latencyRate:      getEnvFloat("CHAOS_LATENCY_RATE", 0),
+			errorRate:        getEnvFloat("CHAOS_ERROR_RATE", 0),
+			partialWriteRate: getEnvFloat("CHAOS_PARTIAL_WRITE_RATE", 0),
+		}
+		logger.Warn("chaos mode enabled: injecting faults into image routes",
+			"latency_rate", chaos.latencyRate, "error_rate", chaos.errorRate,
+			"partial_write_rate", chaos.partialWriteRate)
+	}
+
+	stripExif.Store(getEnv("STRIP_EXIF", "true") == "true")
+	autoOrient.Store(getEnv("AUTO_ORIENT", "true") == "true")
+	responseCompression.Store(getEnv("RESPONSE_COMPRESSION", "true") == "true")
+	switch piiPolicy = getEnv("PII_POLICY", piiOff); piiPolicy {
+	case piiOff, piiFlag, piiStrip, piiReject:
+	default:
+		errs = append(errs, errors.New("PII_POLICY must be one of off, flag, strip, reject"))
+	}
 
-func validateUrl(c *gin.Context) bool {
-	filename := c.Param("filename")
-	expireStr := c.Query("expires")
-	signature := c.Query("signature")
+	if thumbnailSizes, err = parseThumbnailSizes(getEnv("THUMBNAIL_SIZES", "128,512")); err != nil {
+		errs = append(errs, err)
+	}
+	uploadPreviewSize = int(getEnvInt("UPLOAD_PREVIEW_SIZE", 0))
+	if uploadPreviewSize < 0 || uploadPreviewSize > 256 {
+		errs = append(errs, errors.New("UPLOAD_PREVIEW_SIZE must be between 0 and 256"))
+	}
+	uploadPlaceholders = getEnv("PLACEHOLDERS", "true") == "true"
+	if metadataVersions = int(getEnvInt("METADATA_VERSIONS", 5)); metadataVersions < 0 {
+		errs = append(errs, errors.New("METADATA_VERSIONS must not be negative"))
+	}
+	copyrightMetadata = getEnv("COPYRIGHT_METADATA", "false") == "true"
+	copyrightNotice = getEnv("COPYRIGHT_NOTICE", "")
+	copyrightCreator = getEnv("COPYRIGHT_CREATOR", "")
+	if len(copyrightNotice) > maxExifField || len(copyrightCreator) > maxExifField {
+		errs = append(errs, errors.New("COPYRIGHT_NOTICE and COPYRIGHT_CREATOR must be at most "+strconv.Itoa(maxExifField)+" bytes"))
+	}
+	copyrightLicense = getEnv("COPYRIGHT_LICENSE_URL", "")
+	if u, err := url.Parse(copyrightLicense); copyrightLicense != "" && (err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, errors.New("COPYRIGHT_LICENSE_URL must be an absolute http(s) URL"))
+	}
+	switch keyFile, certFile := getEnv("C2PA_KEY_FILE", ""), getEnv("C2PA_CERT_FILE", ""); {
+	case keyFile == "" && certFile == "":
+	case keyFile == "" || certFile == "":
+		errs = append(errs, errors.New("C2PA_KEY_FILE and C2PA_CERT_FILE must be set together"))
+	default:
+		if c2paSigner, err = loadContentSigner(keyFile, certFile); err != nil {
+			errs = append(errs, errors.New("C2PA: "+err.Error()))
+		}
+	}
+	integritySigner = nil
+	if keyFile := getEnv("INTEGRITY_KEY_FILE", ""); keyFile != "" {
+		if integritySigner, err = loadSigningKey(keyFile); err != nil {
+			errs = append(errs, errors.New("INTEGRITY_KEY_FILE: "+err.Error()))
+		}
+	}
+	traceKey = nil
+	if key := readSecretSetting("INVISIBLE_WATERMARK_KEY"); key != "" {
+		traceKey = []byte(key)
+	}
+	transformCacheDir = getEnv("TRANSFORM_CACHE_DIR", "cache")
+	metadataDBPath = getEnv("METADATA_DB", "metadata.db")
+	switch metadataBackend = getEnv("METADATA_BACKEND", metadataSQLite); metadataBackend {
+	case metadataSQLite:
+	case metadataPostgres:
+		if metadataDSN = readSecretSetting("METADATA_DSN"); metadataDSN == "" {
+			errs = append(errs, errors.New("METADATA_DSN is required when METADATA_BACKEND=postgres"))
+		}
+	default:
+		errs = append(errs, errors.New("METADATA_BACKEND must be sqlite or postgres"))
+	}
+	hotCacheMaxBytes = getEnvInt("HOT_CACHE_MAX_BYTES", 0)
+	hotCacheMaxObjectBytes = getEnvInt("HOT_CACHE_MAX_OBJECT_BYTES", 256<<10)
+	hotCacheTTL = time.Duration(getEnvInt("HOT_CACHE_TTL_SECONDS", 60)) * time.Second
+	if hotCacheMaxBytes < 0 || hotCacheMaxObjectBytes <= 0 || hotCacheTTL < 0 {
+		errs = append(errs, errors.New("HOT_CACHE_MAX_BYTES and HOT_CACHE_TTL_SECONDS must not be negative, HOT_CACHE_MAX_OBJECT_BYTES must be positive"))
+	}
+	if transformCacheMaxBytes = getEnvInt("TRANSFORM_CACHE_MAX_BYTES", 1<<30); transformCacheMaxBytes < 0 {
+		errs = append(errs, errors.New("TRANSFORM_CACHE_MAX_BYTES must not be negative"))
+	}
+	jpegQuality = int(getEnvInt("JPEG_QUALITY", 85))
+	if jpegQuality < 1 || jpegQuality > 100 {
+		errs = append(errs, errors.New("JPEG_QUALITY must be between 1 and 100"))
+	}
+	minQuality = int(getEnvInt("MIN_QUALITY", 30))
+	if minQuality < 1 || minQuality > 100 {
+		errs = append(errs, errors.New("MIN_QUALITY must be between 1 and 100"))
+	}
+	webpQuality = int(getEnvInt("WEBP_QUALITY", 80))
+	if webpQuality < 1 || webpQuality > 100 {
+		errs = append(errs, errors.New("WEBP_QUALITY must be between 1 and 100"))
+	}
+	avifQuality = int(getEnvInt("AVIF_QUALITY", 60))
+	if avifQuality < 1 || avifQuality > 100 {
+		errs = append(errs, errors.New("AVIF_QUALITY must be between 1 and 100"))
+	}
+	avifSpeed = int(getEnvInt("AVIF_SPEED", 8))
+	if avifSpeed < 1 || avifSpeed > 10 {
+		errs = append(errs, errors.New("AVIF_SPEED must be between 1 (slowest, smallest) and 10 (fastest)"))
+	}
+	if autoFormats, err = parseAutoFormats(getEnv("AUTO_FORMATS", "avif,webp")); err != nil {
+		errs = append(errs, err)
+	}
+	canonicalRedirects.Store(getEnv("CANONICAL_REDIRECTS", "false") == "true")
+	if originalsCacheControl, err = parseCacheControl("CACHE_CONTROL_ORIGINALS", getEnv("CACHE_CONTROL_ORIGINALS", "")); err != nil {
+		errs = append(errs, err)
+	}
+	if variantsCacheControl, err = parseCacheControl("CACHE_CONTROL_VARIANTS", getEnv("CACHE_CONTROL_VARIANTS", originalsCacheControl)); err != nil {
+		errs = append(errs, err)
+	}
+	transformMaxPixels = getEnvInt("TRANSFORM_MAX_PIXELS", 40_000_000)
+	transformMaxBytes = getEnvInt("TRANSFORM_MAX_BYTES", 10<<20)
+	transformMaxInputPixels = getEnvInt("TRANSFORM_MAX_INPUT_PIXELS", 100_000_000)
+	switch getEnv("TRANSFORM_LIMIT_ACTION", "downscale") {
+	case "downscale":
+		transformDownscale = true
+	case "reject":
+		transformDownscale = false
+	default:
+		errs = append(errs, errors.New("TRANSFORM_LIMIT_ACTION must be downscale or reject"))
+	}
+	if err := loadWatermark(getEnv("WATERMARK_IMAGE", "")); err != nil {
+		errs = append(errs, err)
+	}
+	switch watermarkMode = getEnv("WATERMARK_MODE", watermarkOnRequest); watermarkMode {
+	case watermarkOnRequest, watermarkAlways:
+	default:
+		errs = append(errs, errors.New("WATERMARK_MODE must be request or always"))
+	}
+	if watermarkPosition = getEnv("WATERMARK_POSITION", "bottom-right"); !validWatermarkPosition(watermarkPosition) {
+		errs = append(errs, errors.New("WATERMARK_POSITION must be one of "+strings.Join(watermarkPositions, ", ")))
+	}
+	if watermarkOpacity = getEnvFloat("WATERMARK_OPACITY", 0.5); watermarkOpacity <= 0 || watermarkOpacity > 1 {
+		errs = append(errs, errors.New("WATERMARK_OPACITY must be greater than 0 and at most 1"))
+	}
+	if watermarkScale = getEnvFloat("WATERMARK_SCALE", 0.25); watermarkScale <= 0 || watermarkScale > 1 {
+		errs = append(errs, errors.New("WATERMARK_SCALE must be greater than 0 and at most 1"))
+	}
+	if vanityPresets, err = parseVanityHosts(getEnv("VANITY_HOSTS", "")); err != nil {
+		errs = append(errs, err)
+	}
+	spriteMaxWidth = int(getEnvInt("SPRITE_MAX_WIDTH", 2048))
+	duplicateHashDistance = int(getEnvInt("DUPLICATE_HASH_DISTANCE", 4))
+	if referenceMatchDistance = int(getEnvInt("REFERENCE_MATCH_DISTANCE", 6)); referenceMatchDistance < 0 || referenceMatchDistance > 32 {
+		errs = append(errs, errors.New("REFERENCE_MATCH_DISTANCE must be between 0 and 32"))
+	}
+	referenceWebhookURL = getEnv("REFERENCE_WEBHOOK_URL", "")
+	if u, err := url.Parse(referenceWebhookURL); referenceWebhookURL != "" && (err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, errors.New("REFERENCE_WEBHOOK_URL must be an absolute http(s) URL"))
+	}
+	referenceWebhookSecret = readSecretSetting("REFERENCE_WEBHOOK_SECRET")
 
-	if expireStr == "" || signature == "" {
-		return false
+	if faviconBackground, err = parseHexColor(getEnv("FAVICON_BACKGROUND", "#ffffff")); err != nil {
+		errs = append(errs, errors.New("FAVICON_BACKGROUND must be a #rrggbb color"))
 	}
 
-	expires, err := strconv.ParseInt(expireStr, 10, 64)
-	if err != nil || time.Now().Unix() > expires {
-		return false
+	errs = append(errs, loadFallbackImages()...)
+
+	guard = newTarpit(
+		getEnvInt("TARPIT_THRESHOLD", 5),
+		getEnvInt("TARPIT_BAN_THRESHOLD", 20),
+		time.Duration(getEnvInt("TARPIT_BAN_SECONDS", 600))*time.Second,
+		time.Duration(getEnvInt("TARPIT_WINDOW_SECONDS", 600))*time.Second,
+		getEnv("TARPIT_ALLOWLIST", ""),
+	)
+
+	switch storageBackend = getEnv("STORAGE_BACKEND", storageLocal); storageBackend {
+	case storageLocal:
+	case storageS3:
+		s3Config = s3Settings{
+			bucket:          getEnv("S3_BUCKET", ""),
+			region:          getEnv("S3_REGION", getEnv("AWS_REGION", "us-east-1")),
+			prefix:          getEnv("S3_PREFIX", ""),
+			endpoint:        getEnv("S3_ENDPOINT", ""),
+			forcePathStyle:  getEnv("S3_FORCE_PATH_STYLE", "false") == "true",
+			accessKeyID:     readSecretSetting("S3_ACCESS_KEY_ID"),
+			secretAccessKey: readSecretSetting("S3_SECRET_ACCESS_KEY"),
+		}
+		if s3Config.bucket == "" {
+			errs = append(errs, errors.New("S3_BUCKET is required when STORAGE_BACKEND=s3"))
+		}
+	case storageAzure:
+		azureConfig = azureSettings{
+			account:   getEnv("AZURE_STORAGE_ACCOUNT", ""),
+			container: getEnv("AZURE_STORAGE_CONTAINER", ""),
+			prefix:    getEnv("AZURE_STORAGE_PREFIX", ""),
+			endpoint:  getEnv("AZURE_STORAGE_ENDPOINT", ""),
+			sasToken:  readSecretSetting("AZURE_STORAGE_SAS_TOKEN"),
+			key:       readSecretSetting("AZURE_STORAGE_KEY"),
+		}
+		if azureConfig.account == "" || azureConfig.container == "" {
+			errs = append(errs, errors.New("AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_CONTAINER are required when STORAGE_BACKEND=azure"))
+		}
+	default:
+		errs = append(errs, errors.New("STORAGE_BACKEND must be local, s3 or azure"))
+	}
+	for _, timeout := range []struct {
+		op      string
+		seconds int64
+	}{{storageOpPut, 300}, {storageOpGet, 30}, {storageOpDelete, 30}, {storageOpList, 60}} {
+		name := "STORAGE_" + strings.ToUpper(timeout.op) + "_TIMEOUT_SECONDS"
+		switch seconds := getEnvInt(name, timeout.seconds); {
+		case seconds < 0:
+			errs = append(errs, errors.New(name+" must not be negative"))
+		case seconds > 0:
+			storageTimeouts[timeout.op] = time.Duration(seconds) * time.Second
+		}
 	}
 
-	method := c.Request.Method
+	accessLogDir = getEnv("ACCESS_LOG_DIR", "")
+	ingestDirPath = getEnv("INGEST_DIR_PATH", "")
+	serverPort = getEnv("SERVER_PORT", ":8000")
+	if serverPort[0] != ':' {
+		serverPort = ":" + serverPort
+	}
+	if settingsRefresh = time.Duration(getEnvInt("SETTINGS_REFRESH_SECONDS", 30)) * time.Second; settingsRefresh < 0 {
+		errs = append(errs, errors.New("SETTINGS_REFRESH_SECONDS must not be negative"))
+	}
+	if adminAddr = getEnv("ADMIN_ADDR", ""); adminAddr != "" {
+		if _, _, err := net.SplitHostPort(adminAddr); err != nil {
+			errs = append(errs, errors.New("ADMIN_ADDR must be host:port or :port"))
+		} else if adminAddr == serverPort {
+			errs = append(errs, errors.New("ADMIN_ADDR must differ from SERVER_PORT"))
+		}
+		if len(adminUsers) == 0 {
+			errs = append(errs, errors.New("ADMIN_ADDR requires ADMIN_TOKEN or ADMIN_USERS"))
+		}
+	}
 
-	// For POST requests without filename, use empty string
-	data := fmt.Sprintf("%s:%s:%d", method, filename, expires)
-	h := hmac.New(sha256.New, []byte(secretKey))
-	h.Write([]byte(data))
-	expectedsignature := hex.EncodeToString(h.Sum(nil))
+	transformConfigTime.Store(time.Now().UnixNano())
 
-	return hmac.Equal([]byte(signature), []byte(expectedsignature))
+	if secretKey.Get() == "" {
+		errs = append(errs, errors.New("SECRET_KEY environment variable is required"))
+	}
+	return errs
 }
 
-func SignedURLMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if !validateUrl(c) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired URL"})
-			c.Abort()
-			return
-		}
-		c.Next()
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = defaultValue
 	}
+	recordSetting(key, value)
+	return value
 }
 
-func main() {
-	router := gin.Default()
-
-	router.GET("/", func(c *gin.Context) {
-		c.IndentedJSON(http.StatusOK, gin.H{"message": "Server is running"})
-	})
+func getEnvInt(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		value = defaultValue
+	}
+	recordSetting(key, strconv.FormatInt(value, 10))
+	return value
+}
 
-	router.GET("/images/:filename", SignedURLMiddleware(), func(c *gin.Context) {
-		filename := c.Param("filename")
-		path := filepath.Join(uploadDirPath, filename)
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		value = defaultValue
+	}
+	recordSetting(key, strconv.FormatFloat(value, 'g', -1, 64))
+	return value
+}
 
-		file, err := os.Open(path)
-		if err != nil {
-			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
-			return
-		}
-		defer file.Close()
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-		c.Header("Content-Disposition", "inline; filename="+filename)
-		c.Header("Content-Type", getMimeType(filename))
-		c.File(path)
-	})
+func getMimeType(filename string) string {
+	ext := filepath.Ext(filename)
+	return mime.TypeByExtension(ext)
+}
 
-	router.POST("/images", SignedURLMiddleware(), func(c *gin.Context) {
-		file, fileHeader, err := c.Request.FormFile("file")
-		if err != nil {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "File not found in the request"})
-			return
-		}
-		defer file.Close()
+// newImageName returns a fresh UUID-based name keeping the original extension.
+func newImageName(originalFilename string) string {
+	return uuid.New().String() + filepath.Ext(originalFilename)
+}
 
-		if _, err := os.Stat(uploadDirPath); os.IsNotExist(err) {
-			os.MkdirAll(uploadDirPath, 0755)
-		}
+// fileChecksum returns the hex-encoded SHA-256 digest and size of the file at path.
+func fileChecksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	return readerChecksum(file)
+}
 
-		extentionName := filepath.Ext(fileHeader.Filename)
-		newFileName := uuid.New().String() + extentionName
+// readerChecksum returns the hex-encoded SHA-256 digest and length of r.
+func readerChecksum(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
 
-		destinationPath := filepath.Join(uploadDirPath, newFileName)
-		destinationFile, err := os.Create(destinationPath)
-		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to create file."})
-			return
-		}
-		defer destinationFile.Close()
+// integrity returns the Subresource Integrity value ("sha256-<base64>") for a
+// hex-encoded SHA-256 digest, ready for an <img integrity> attribute.
+func integrity(checksum string) string {
+	digest, _ := hex.DecodeString(checksum)
+	return "sha256-" + base64.StdEncoding.EncodeToString(digest)
+}
 
-		if _, err := io.Copy(destinationFile, file); err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to save file."})
-			return
-		}
+func main() {
+	validate := flag.Bool("validate", false, "check configuration, directories and dependencies, print a report and exit")
+	flag.Parse()
 
-		c.IndentedJSON(http.StatusOK, gin.H{
-			"message":           "File uploaded",
-			"filename":          newFileName,
-			"original_filename": fileHeader.Filename,
-			"size":              fileHeader.Size,
-		})
-	})
+	configErrs := loadConfig()
+	if *validate {
+		os.Exit(runValidation(os.Stdout, configErrs))
+	}
+	if len(configErrs) > 0 {
+		panic(configErrs[0].Error())
+	}
+	go guard.run()
+	if secretsRefresh > 0 {
+		go refreshSecrets(secretsRefresh)
+	}
+	logStartupBanner()
 
-	router.PUT("/images/:filename", SignedURLMiddleware(), func(c *gin.Context) {
-		path := filepath.Join(uploadDirPath, c.Param("filename"))
+	var err error
+	if imageStorage, err = openStorage(uploadDirPath, "images/"); err != nil {
+		panic("failed to open image storage: " + err.Error())
+	}
+	filesStorage, err := openStorage(filesDirPath, "files/")
+	if err != nil {
+		panic("failed to open file storage: " + err.Error())
+	}
+	imageStorage, filesStorage = withHotCache(imageStorage), withHotCache(filesStorage)
+	if imageMetadata, err = openMetadataStore(); err != nil {
+		panic("failed to open metadata store: " + err.Error())
+	}
+	if _, err := loadStoredSettings(context.Background()); err != nil {
+		panic("failed to load runtime settings: " + err.Error())
+	}
+	if imageMetadata != nil && settingsRefresh > 0 {
+		go refreshSettings(settingsRefresh)
+	}
 
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File Not found."})
-			return
-		}
+	if flag.Arg(0) == "import-dir" {
+		os.Exit(runImportDir(flag.Args()[1:]))
+	}
 
-		file, header, err := c.Request.FormFile("file")
-		if err != nil {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "File not found in the request"})
-			return
-		}
-		defer file.Close()
+	if imageMetadata != nil {
+		go func() {
+			if err := imageMetadata.reconcile(context.Background(), imageStorage); err != nil {
+				logger.Error("failed to reconcile image metadata", "error", err)
+			}
+		}()
+	}
 
-		existingFile, err := os.Create(path)
+	router := gin.Default()
+	// The client IP keys the tarpit, replay metrics and recorded uploader,
+	// so X-Forwarded-For is only believed from the configured proxies.
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		panic("invalid TRUSTED_PROXIES: " + err.Error())
+	}
+	router.Use(TraceContextMiddleware())
+	router.Use(MaintenanceMiddleware())
+
+	if accessLogDir != "" {
+		accessLogs, err := newAccessLog(
+			accessLogDir,
+			time.Duration(getEnvInt("ACCESS_LOG_ROTATE_SECONDS", 3600))*time.Second,
+			time.Duration(getEnvInt("ACCESS_LOG_RETENTION_DAYS", 7))*24*time.Hour,
+			getEnv("ACCESS_LOG_SHIP_COMMAND", ""),
+		)
 		if err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to create file."})
-			return
-		}
-		defer existingFile.Close()
-
-		if _, err := io.Copy(existingFile, file); err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to save file."})
-			return
+			panic("failed to open access log: " + err.Error())
 		}
+		router.Use(AccessLogMiddleware(accessLogs))
+	}
+	router.Use(BodySamplingMiddleware())
+	router.Use(CompressionMiddleware())
+
+	if ingestDirPath != "" {
+		go watchDropDir(
+			ingestDirPath,
+			time.Duration(getEnvInt("INGEST_INTERVAL_SECONDS", 10))*time.Second,
+			time.Duration(getEnvInt("INGEST_SETTLE_SECONDS", 5))*time.Second,
+		)
+	}
 
-		c.IndentedJSON(http.StatusOK, gin.H{
-			"message": "File updated",
-			"size":    header.Size,
-		})
+	// Routes live under ROUTE_PREFIX when a reverse proxy forwards a
+	// sub-path unchanged.
+	routes := router.Group(routePrefix, HostMiddleware())
+	routes.GET("/", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "Server is running"})
 	})
 
-	router.DELETE("/images/:filename", SignedURLMiddleware(), func(c *gin.Context) {
-		path := filepath.Join(uploadDirPath, c.Param("filename"))
-
-		if err := os.Remove(path); err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to remove file."})
-			return
+	images := &fileStore{route: "/images", storage: imageStorage, inlineTypes: []string{""}, fallbacks: true, thumbnailSizes: thumbnailSizes, previewSize: uploadPreviewSize, placeholders: uploadPlaceholders, stripMetadata: true}
+	images.vanityHosts = len(vanityPresets) > 0
+	images.cacheControl, images.variantCacheControl = originalsCacheControl, variantsCacheControl
+	images.cache = newTransformCache(transformCacheDir, transformCacheMaxBytes)
+	images.metadata = imageMetadata
+	imageTransforms = images.cache
+	if assetsDirPath != "" {
+		images.assets = newLocalStorage(assetsDirPath)
+	}
+	images.register(routes)
+	routes.GET("/images/:filename/favicons", SignedURLMiddleware(), ChaosMiddleware(), images.favicons)
+	routes.GET("/images/:filename/favicons/:icon", SignedURLMiddleware(), ChaosMiddleware(), images.favicons)
+	routes.GET("/images/:filename/exif", SignedURLMiddleware(), ChaosMiddleware(), images.exif)
+	routes.PATCH("/images/:filename/exif", SignedURLMiddleware(), ChaosMiddleware(), images.patchExif)
+	routes.GET("/images/:filename/tags", SignedURLMiddleware(), ChaosMiddleware(), images.listTags)
+	routes.POST("/images/:filename/tags", signingNamespace(tagsNamespace), SignedURLMiddleware(), ChaosMiddleware(), images.tagImage)
+	routes.DELETE("/images/:filename/tags", signingNamespace(tagsNamespace), SignedURLMiddleware(), ChaosMiddleware(), images.untagImage)
+	routes.GET("/images/:filename/placeholder", SignedURLMiddleware(), ChaosMiddleware(), images.placeholder)
+	routes.GET("/images/:filename/thumb/:size", useFallbackImages, SignedURLMiddleware(), ChaosMiddleware(), images.thumbnail)
+	routes.POST("/sprites", signingNamespace("sprites"), SignedURLMiddleware(), ChaosMiddleware(), images.createSprite)
+	routes.POST("/pdfs", signingNamespace("pdfs"), SignedURLMiddleware(), ChaosMiddleware(), images.createPDF)
+	routes.POST("/"+batchNamespace, signingNamespace(batchNamespace), SignedURLMiddleware(), ChaosMiddleware(), images.createBatch)
+	routes.GET("/"+batchNamespace+"/:filename", signingNamespace(batchNamespace), SignedURLMiddleware(), getBatch)
+	collections := routes.Group("/"+collectionsNamespace, signingNamespace(collectionsNamespace), SignedURLMiddleware(), ChaosMiddleware())
+	collections.POST("", images.createCollection)
+	collections.GET("/:filename", images.getCollection)
+	collections.PATCH("/:filename", images.patchCollection)
+	collections.DELETE("/:filename", images.removeCollection)
+
+	files := &fileStore{route: "/files", storage: filesStorage, inlineTypes: filesInlineTypes}
+	files.register(routes, signingNamespace("files"))
+
+	// With ADMIN_ADDR the admin API and profiling get a listener of their
+	// own, and the public one doesn't serve them at all.
+	if adminAddr != "" {
+		adminRouter := gin.Default()
+		if err := adminRouter.SetTrustedProxies(trustedProxies); err != nil {
+			panic("invalid TRUSTED_PROXIES: " + err.Error())
 		}
+		registerAdminRoutes(adminRouter)
+		registerProfiling(adminRouter)
+		go func() {
+			if err := adminRouter.Run(adminAddr); err != nil {
+				panic("admin listener: " + err.Error())
+			}
+		}()
+	} else if len(adminUsers) > 0 {
+		registerAdminRoutes(routes)
+	}
 
-		c.IndentedJSON(http.StatusOK, gin.H{"message": "File removed"})
-	})
+	if emailIngestToken.Get() != "" {
+		routes.POST("/ingest/email", ingestEmail)
+	}
 
-	port := getEnv("SERVER_PORT", ":8000")
-	if port[0] != ':' {
-		port = ":" + port
+	if apiKey.Get() != "" {
+		routes.POST("/tokens", APIKeyMiddleware(), exchangeToken)
 	}
-	router.Run(port)
+
+	router.Run(serverPort)
 }
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// Metadata backends selectable with METADATA_BACKEND.
+const (
+	metadataSQLite   = "sqlite"
+	metadataPostgres = "postgres"
+)
+
+var (
+	metadataBackend = metadataSQLite
+	// metadataDBPath is the SQLite database of image metadata
+	// (METADATA_DB); empty disables the SQLite store.
+	metadataDBPath string
+	// metadataDSN is the PostgreSQL connection string (METADATA_DSN).
+	metadataDSN string
+)
+
+// imageMetadata is the metadata store of the image storage, nil when
+// disabled.
+var imageMetadata *metadataStore
+
+// Where a stored image came from.
+const (
+	sourceUpload   = "upload"
+	sourceEmail    = "email"
+	sourceIngest   = "ingest"
+	sourceImport   = "import"
+	sourceBackfill = "backfill"
+)
+
+// imageRecord is what the metadata store knows about a stored image.
+type imageRecord struct {
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"original_filename"`
+	ContentType      string    `json:"content_type"`
+	Size             int64     `json:"size"`
+	SHA256           string    `json:"sha256"`
+	Uploader         string    `json:"uploader"`
+	Source           string    `json:"source"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	// Tags and ReferenceMatches are only filled in for a single image.
+	Tags             []string         `json:"tags,omitempty"`
+	ReferenceMatches []referenceMatch `json:"reference_matches,omitempty"`
+}
+
+// metadataStore records every stored image in a database, so images can be
+// listed and searched without scanning the storage. The storage stays the
+// source of truth: a failed write is logged, and the store is reconciled
+// with the storage at startup.
+type metadataStore struct {
+	db      *sql.DB
+	dialect metadataDialect
+}
+
+// metadataDialect holds what differs between the databases the metadata
+// store runs on; the queries are otherwise shared.
+type metadataDialect struct {
+	driver string
+	schema []string
+	// lock, when set, is run before creating the schema, so instances
+	// starting together don't race to create it.
+	lock string
+	// like is the operator matching filenames case-insensitively.
+	like string
+	// numbered databases take $1, $2, ... instead of ? placeholders.
+	numbered bool
+}
+
+var sqliteDialect = metadataDialect{
+	driver: "sqlite",
+	schema: []string{`
+		CREATE TABLE IF NOT EXISTS images (
+			filename          TEXT PRIMARY KEY,
+			original_filename TEXT NOT NULL DEFAULT '',
+			content_type      TEXT NOT NULL DEFAULT '',
+			size              INTEGER NOT NULL,
+			sha256            TEXT NOT NULL,
+			uploader          TEXT NOT NULL DEFAULT '',
+			source            TEXT NOT NULL DEFAULT '',
+			created_at        INTEGER NOT NULL,
+			updated_at        INTEGER NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS images_created_at ON images (created_at)",
+		"CREATE INDEX IF NOT EXISTS images_sha256 ON images (sha256)",
+		`CREATE TABLE IF NOT EXISTS watermark_recipients (
+			code         TEXT PRIMARY KEY,
+			recipient    TEXT NOT NULL,
+			first_served INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS reference_images (
+			id         TEXT PRIMARY KEY,
+			label      TEXT NOT NULL DEFAULT '',
+			category   TEXT NOT NULL DEFAULT '',
+			hash       TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS reference_matches (
+			filename     TEXT NOT NULL,
+			reference_id TEXT NOT NULL,
+			distance     INTEGER NOT NULL,
+			matched_at   INTEGER NOT NULL,
+			PRIMARY KEY (filename, reference_id)
+		)`,
+		"CREATE INDEX IF NOT EXISTS reference_matches_matched_at ON reference_matches (matched_at)",
+		`CREATE TABLE IF NOT EXISTS image_tags (
+			filename TEXT NOT NULL,
+			tag      TEXT NOT NULL,
+			PRIMARY KEY (filename, tag)
+		)`,
+		"CREATE INDEX IF NOT EXISTS image_tags_tag ON image_tags (tag)",
+		`CREATE TABLE IF NOT EXISTS derivatives (
+			source       TEXT NOT NULL,
+			name         TEXT NOT NULL,
+			kind         TEXT NOT NULL,
+			variant      TEXT NOT NULL DEFAULT '',
+			content_type TEXT NOT NULL DEFAULT '',
+			size         INTEGER NOT NULL,
+			created_at   INTEGER NOT NULL,
+			PRIMARY KEY (source, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS collections (
+			id         TEXT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS collection_images (
+			collection_id TEXT NOT NULL,
+			filename      TEXT NOT NULL,
+			added_at      INTEGER NOT NULL,
+			PRIMARY KEY (collection_id, filename)
+		)`,
+		"CREATE INDEX IF NOT EXISTS collection_images_filename ON collection_images (filename)",
+		`CREATE TABLE IF NOT EXISTS settings (
+			name       TEXT PRIMARY KEY,
+			value      TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+	},
+	like: "LIKE",
+}
+
+var postgresDialect = metadataDialect{
+	driver: "pgx",
+	schema: []string{`
+		CREATE TABLE IF NOT EXISTS images (
+			filename          TEXT PRIMARY KEY,
+			original_filename TEXT NOT NULL DEFAULT '',
+			content_type      TEXT NOT NULL DEFAULT '',
+			size              BIGINT NOT NULL,
+			sha256            TEXT NOT NULL,
+			uploader          TEXT NOT NULL DEFAULT '',
+			source            TEXT NOT NULL DEFAULT '',
+			created_at        BIGINT NOT NULL,
+			updated_at        BIGINT NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS images_created_at ON images (created_at)",
+		"CREATE INDEX IF NOT EXISTS images_sha256 ON images (sha256)",
+		`CREATE TABLE IF NOT EXISTS watermark_recipients (
+			code         TEXT PRIMARY KEY,
+			recipient    TEXT NOT NULL,
+			first_served BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS reference_images (
+			id         TEXT PRIMARY KEY,
+			label      TEXT NOT NULL DEFAULT '',
+			category   TEXT NOT NULL DEFAULT '',
+			hash       TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS reference_matches (
+			filename     TEXT NOT NULL,
+			reference_id TEXT NOT NULL,
+			distance     INTEGER NOT NULL,
+			matched_at   BIGINT NOT NULL,
+			PRIMARY KEY (filename, reference_id)
+		)`,
+		"CREATE INDEX IF NOT EXISTS reference_matches_matched_at ON reference_matches (matched_at)",
+		`CREATE TABLE IF NOT EXISTS image_tags (
+			filename TEXT NOT NULL,
+			tag      TEXT NOT NULL,
+			PRIMARY KEY (filename, tag)
+		)`,
+		"CREATE INDEX IF NOT EXISTS image_tags_tag ON image_tags (tag)",
+		`CREATE TABLE IF NOT EXISTS derivatives (
+			source       TEXT NOT NULL,
+			name         TEXT NOT NULL,
+			kind         TEXT NOT NULL,
+			variant      TEXT NOT NULL DEFAULT '',
+			content_type TEXT NOT NULL DEFAULT '',
+			size         BIGINT NOT NULL,
+			created_at   BIGINT NOT NULL,
+			PRIMARY KEY (source, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS collections (
+			id         TEXT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS collection_images (
+			collection_id TEXT NOT NULL,
+			filename      TEXT NOT NULL,
+			added_at      BIGINT NOT NULL,
+			PRIMARY KEY (collection_id, filename)
+		)`,
+		"CREATE INDEX IF NOT EXISTS collection_images_filename ON collection_images (filename)",
+		`CREATE TABLE IF NOT EXISTS settings (
+			name       TEXT PRIMARY KEY,
+			value      TEXT NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`,
+	},
+	// The key is arbitrary; it only has to be the same on every instance.
+	lock:     "SELECT pg_advisory_xact_lock(7335016)",
+	like:     "ILIKE",
+	numbered: true,
+}
+
+// openMetadataStore opens the configured metadata backend and creates its
+// schema when missing. It returns nil when the store is disabled.
+func openMetadataStore() (*metadataStore, error) {
+	switch metadataBackend {
+	case metadataPostgres:
+		return openMetadataDB(postgresDialect, metadataDSN)
+	}
+	if metadataDBPath == "" {
+		return nil, nil
+	}
+	return openMetadataDB(sqliteDialect, "file:"+metadataDBPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+}
+
+func openMetadataDB(dialect metadataDialect, source string) (*metadataStore, error) {
+	db, err := sql.Open(dialect.driver, source)
+	if err != nil {
+		return nil, err
+	}
+	m := &metadataStore{db: db, dialect: dialect}
+	if err := m.createSchema(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *metadataStore) createSchema(ctx context.Context) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if m.dialect.lock != "" {
+		if _, err := tx.ExecContext(ctx, m.dialect.lock); err != nil {
+			return err
+		}
+	}
+	for _, statement := range m.dialect.schema {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rebind rewrites the ? placeholders of query for the dialect.
+func (m *metadataStore) rebind(query string) string {
+	if !m.dialect.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// put records r. A record of a replaced image keeps its original filename,
+// uploader, source and creation time.
+func (m *metadataStore) put(ctx context.Context, r imageRecord) error {
+	if r.UpdatedAt.IsZero() {
+		r.UpdatedAt = time.Now()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = r.UpdatedAt
+	}
+	_, err := m.db.ExecContext(ctx, m.rebind(`
+		INSERT INTO images (filename, original_filename, content_type, size, sha256, uploader, source, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (filename) DO UPDATE SET
+			content_type = excluded.content_type, size = excluded.size,
+			sha256 = excluded.sha256, updated_at = excluded.updated_at`),
+		r.Filename, r.OriginalFilename, r.ContentType, r.Size, r.SHA256, r.Uploader, r.Source,
+		r.CreatedAt.UnixMilli(), r.UpdatedAt.UnixMilli())
+	return err
+}
+
+// record is put for the handlers: the storage write already succeeded, so
+// a failure is only logged.
+func (m *metadataStore) record(ctx context.Context, r imageRecord) {
+	if m == nil {
+		return
+	}
+	if err := m.put(ctx, r); err != nil {
+		logger.Error("failed to record image metadata", "file", r.Filename, "error", err)
+	}
+}
+
+// forget deletes the record, tags, derivative entries, collection entries
+// and reference matches of a removed image.
+func (m *metadataStore) forget(ctx context.Context, filename string) {
+	if m == nil {
+		return
+	}
+	if _, err := m.db.ExecContext(ctx, m.rebind("DELETE FROM images WHERE filename = ?"), filename); err != nil {
+		logger.Error("failed to delete image metadata", "file", filename, "error", err)
+	}
+	if _, err := m.db.ExecContext(ctx, m.rebind("DELETE FROM reference_matches WHERE filename = ?"), filename); err != nil {
+		logger.Error("failed to delete reference matches", "file", filename, "error", err)
+	}
+	if _, err := m.db.ExecContext(ctx, m.rebind("DELETE FROM image_tags WHERE filename = ?"), filename); err != nil {
+		logger.Error("failed to delete image tags", "file", filename, "error", err)
+	}
+	if _, err := m.db.ExecContext(ctx, m.rebind("DELETE FROM derivatives WHERE source = ?"), filename); err != nil {
+		logger.Error("failed to delete derivatives", "file", filename, "error", err)
+	}
+	if _, err := m.db.ExecContext(ctx, m.rebind("DELETE FROM collection_images WHERE filename = ?"), filename); err != nil {
+		logger.Error("failed to delete collection entries", "file", filename, "error", err)
+	}
+}
+
+// recordRecipient registers the recipient of an invisible watermark code,
+// reporting whether it is on record. A code keeps its first recipient.
+func (m *metadataStore) recordRecipient(ctx context.Context, code, recipient string) bool {
+	if m == nil {
+		return false
+	}
+	_, err := m.db.ExecContext(ctx, m.rebind(`
+		INSERT INTO watermark_recipients (code, recipient, first_served) VALUES (?, ?, ?)
+		ON CONFLICT (code) DO NOTHING`),
+		code, recipient, time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("failed to record watermark recipient", "code", code, "error", err)
+		return false
+	}
+	return true
+}
+
+// recipient returns the recipient of an invisible watermark code, or
+// ErrNotFound.
+func (m *metadataStore) recipient(ctx context.Context, code string) (string, error) {
+	if m == nil {
+		return "", ErrNotFound
+	}
+	var recipient string
+	err := m.db.QueryRowContext(ctx, m.rebind("SELECT recipient FROM watermark_recipients WHERE code = ?"), code).Scan(&recipient)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return recipient, err
+}
+
+const imageColumns = "filename, original_filename, content_type, size, sha256, uploader, source, created_at, updated_at"
+
+func scanImageRecords(rows *sql.Rows) ([]imageRecord, error) {
+	defer rows.Close()
+	records := []imageRecord{}
+	for rows.Next() {
+		var r imageRecord
+		var created, updated int64
+		if err := rows.Scan(&r.Filename, &r.OriginalFilename, &r.ContentType, &r.Size, &r.SHA256, &r.Uploader, &r.Source, &created, &updated); err != nil {
+			return nil, err
+		}
+		r.CreatedAt, r.UpdatedAt = time.UnixMilli(created).UTC(), time.UnixMilli(updated).UTC()
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// get returns the record of filename, or ErrNotFound.
+func (m *metadataStore) get(ctx context.Context, filename string) (imageRecord, error) {
+	rows, err := m.db.QueryContext(ctx, m.rebind("SELECT "+imageColumns+" FROM images WHERE filename = ?"), filename)
+	if err != nil {
+		return imageRecord{}, err
+	}
+	records, err := scanImageRecords(rows)
+	if err != nil {
+		return imageRecord{}, err
+	}
+	if len(records) == 0 {
+		return imageRecord{}, ErrNotFound
+	}
+	return records[0], nil
+}
+
+// metadataQuery filters a search; empty fields match everything.
+type metadataQuery struct {
+	Text        string // in the stored or original filename
+	ContentType string // prefix, such as image/ or image/png
+	Uploader    string
+	SHA256      string
+	Limit       int
+}
+
+// maxSearchResults bounds the results of one search.
+const maxSearchResults = 1000
+
+// search returns the records matching q, newest first.
+func (m *metadataStore) search(ctx context.Context, q metadataQuery) ([]imageRecord, error) {
+	var where []string
+	var args []any
+	if q.Text != "" {
+		like := m.dialect.like
+		where = append(where, `(filename `+like+` ? ESCAPE '\' OR original_filename `+like+` ? ESCAPE '\')`)
+		pattern := "%" + escapeLike(q.Text) + "%"
+		args = append(args, pattern, pattern)
+	}
+	if q.ContentType != "" {
+		where = append(where, `content_type LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(q.ContentType)+"%")
+	}
+	if q.Uploader != "" {
+		where = append(where, "uploader = ?")
+		args = append(args, q.Uploader)
+	}
+	if q.SHA256 != "" {
+		where = append(where, "sha256 = ?")
+		args = append(args, strings.ToLower(q.SHA256))
+	}
+	query := "SELECT " + imageColumns + " FROM images"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, filename LIMIT ?"
+	args = append(args, q.Limit)
+	rows, err := m.db.QueryContext(ctx, m.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanImageRecords(rows)
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// reconcile records the stored images the store doesn't know, such as
+// those stored before it was enabled or while a write to it failed, and
+// drops the records of images deleted around it. Records written since the
+// listing are kept.
+func (m *metadataStore) reconcile(ctx context.Context, storage Storage) error {
+	listed := time.Now()
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT filename, updated_at FROM images")
+	if err != nil {
+		return err
+	}
+	known := map[string]int64{}
+	for rows.Next() {
+		var filename string
+		var updated int64
+		if err := rows.Scan(&filename, &updated); err != nil {
+			rows.Close()
+			return err
+		}
+		known[filename] = updated
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var added, dropped int
+	for _, object := range objects {
+		if isDerivedObject(object.Name) {
+			continue
+		}
+		if _, ok := known[object.Name]; ok {
+			delete(known, object.Name)
+			continue
+		}
+		body, _, err := storage.Get(ctx, object.Name)
+		if err != nil {
+			continue
+		}
+		h := sha256.New()
+		size, err := io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			continue
+		}
+		if err := m.put(ctx, imageRecord{
+			Filename:    object.Name,
+			ContentType: getMimeType(object.Name),
+			Size:        size,
+			SHA256:      hex.EncodeToString(h.Sum(nil)),
+			Source:      sourceBackfill,
+			CreatedAt:   object.ModTime,
+			UpdatedAt:   object.ModTime,
+		}); err != nil {
+			return err
+		}
+		added++
+	}
+	for filename, updated := range known {
+		if updated >= listed.UnixMilli() {
+			continue
+		}
+		m.forget(ctx, filename)
+		dropped++
+	}
+	logger.Info("image metadata reconciled", "objects", len(objects), "added", added, "dropped", dropped)
+	return m.reconcileDerivatives(ctx, storage, objects, listed)
+}
+
+// listImageMetadata searches the metadata store: ?q= matches filenames,
+// ?type= content types by prefix, ?uploader= and ?sha256= exactly, and
+// ?limit= caps the results (100 by default).
+func listImageMetadata(c *gin.Context) {
+	if imageMetadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	q := metadataQuery{
+		Text:        c.Query("q"),
+		ContentType: c.Query("type"),
+		Uploader:    c.Query("uploader"),
+		SHA256:      c.Query("sha256"),
+		Limit:       100,
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxSearchResults {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "limit must be between 1 and " + strconv.Itoa(maxSearchResults)})
+			return
+		}
+		q.Limit = n
+	}
+	records, err := imageMetadata.search(c.Request.Context(), q)
+	if err != nil {
+		logger.Error("metadata search failed", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to search image metadata."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"images": records, "count": len(records)})
+}
+
+// getImageMetadata serves the record of one image with its tags and
+// reference matches.
+func getImageMetadata(c *gin.Context) {
+	if imageMetadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	record, err := imageMetadata.get(c.Request.Context(), c.Param("filename"))
+	if errors.Is(err, ErrNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "No metadata for this file."})
+		return
+	}
+	if err != nil {
+		logger.Error("metadata lookup failed", "file", c.Param("filename"), "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read image metadata."})
+		return
+	}
+	if record.Tags, err = imageMetadata.tags(c.Request.Context(), record.Filename); err != nil {
+		logger.Error("tag lookup failed", "file", record.Filename, "error", err)
+	}
+	if record.ReferenceMatches, err = imageMetadata.matches(c.Request.Context(), record.Filename); err != nil {
+		logger.Error("reference match lookup failed", "file", record.Filename, "error", err)
+	}
+	c.IndentedJSON(http.StatusOK, record)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes in PostScript points (1/72 inch).
+var pdfPageSizes = map[string][2]float64{
+	"a4":     {595, 842},
+	"letter": {612, 792},
+	"a5":     {420, 595},
+}
+
+const (
+	pdfMargin        = 36
+	pdfCaptionHeight = 24
+	pdfCaptionSize   = 12
+)
+
+type pdfPage struct {
+	Image   string `json:"image" binding:"required"`
+	Caption string `json:"caption"`
+}
+
+type pdfRequest struct {
+	Pages    []pdfPage `json:"pages" binding:"required,min=1,dive"`
+	PageSize string    `json:"page_size"`
+}
+
+// pdfWriter writes numbered PDF objects sequentially, remembering their byte
+// offsets for the cross-reference table, so nothing but the current image
+// needs to be held in memory.
+type pdfWriter struct {
+	w       *bufio.Writer
+	offset  int64
+	offsets []int64
+	err     error
+}
+
+func (p *pdfWriter) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	p.err = err
+	return n, err
+}
+
+func (p *pdfWriter) printf(format string, args ...any) {
+	fmt.Fprintf(p, format, args...)
+}
+
+// alloc reserves the next object number.
+func (p *pdfWriter) alloc() int {
+	p.offsets = append(p.offsets, 0)
+	return len(p.offsets)
+}
+
+func (p *pdfWriter) begin(id int) {
+	p.offsets[id-1] = p.offset
+	p.printf("%d 0 obj\n", id)
+}
+
+func (p *pdfWriter) end() {
+	p.printf("endobj\n")
+}
+
+// stream writes object id as a stream whose length is stored in a separate
+// object, so the body can be copied without knowing its size up front.
+func (p *pdfWriter) stream(id int, dict string, body func(io.Writer) error) {
+	lengthID := p.alloc()
+	p.begin(id)
+	p.printf("<< %s /Length %d 0 R >>\nstream\n", dict, lengthID)
+	start := p.offset
+	if err := body(p); err != nil && p.err == nil {
+		p.err = err
+	}
+	length := p.offset - start
+	p.printf("\nendstream\n")
+	p.end()
+
+	p.begin(lengthID)
+	p.printf("%d\n", length)
+	p.end()
+}
+
+func (p *pdfWriter) finish(rootID int) error {
+	xref := p.offset
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		p.printf("%010d 00000 n \n", off)
+	}
+	p.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, rootID, xref)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// pdfText escapes s for a PDF literal string in WinAnsi-encoded Helvetica.
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// writeImageStream embeds the image read from open: JPEGs are passed through
+// as DCT streams, anything else is flattened onto white and Flate-compressed.
+func writeImageStream(p *pdfWriter, id int, open func() (io.ReadCloser, error), format string, cfg image.Config) {
+	if format == "jpeg" {
+		colorSpace := "/DeviceRGB"
+		switch cfg.ColorModel {
+		case color.GrayModel:
+			colorSpace = "/DeviceGray"
+		case color.CMYKModel:
+			colorSpace = "/DeviceCMYK /Decode [1 0 1 0 1 0 1 0]"
+		}
+		dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode",
+			cfg.Width, cfg.Height, colorSpace)
+		p.stream(id, dict, func(w io.Writer) error {
+			file, err := open()
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(w, file)
+			return err
+		})
+		return
+	}
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+		cfg.Width, cfg.Height)
+	p.stream(id, dict, func(w io.Writer) error {
+		file, err := open()
+		if err != nil {
+			return err
+		}
+		img, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		zw := zlib.NewWriter(w)
+		b := img.Bounds()
+		row := make([]byte, 0, b.Dx()*3)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row = row[:0]
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, a := img.At(x, y).RGBA()
+				// Composite premultiplied color over a white background.
+				white := 0xffff - a
+				row = append(row, uint8((r+white)>>8), uint8((g+white)>>8), uint8((bl+white)>>8))
+			}
+			if _, err := zw.Write(row); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+}
+
+// createPDF streams the selected images as a PDF, one image per page in the
+// requested order, each scaled to fit the page with an optional caption.
+func (s *fileStore) createPDF(c *gin.Context) {
+	var req pdfRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "A list of pages is required."})
+		return
+	}
+	if req.PageSize == "" {
+		req.PageSize = "a4"
+	}
+	pageSize, fixed := pdfPageSizes[req.PageSize]
+	if !fixed && req.PageSize != "fit" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "page_size must be a4, a5, letter or fit."})
+		return
+	}
+
+	// Validate every page before the first byte is sent.
+	ctx := c.Request.Context()
+	formats := make([]string, len(req.Pages))
+	configs := make([]image.Config, len(req.Pages))
+	for i, page := range req.Pages {
+		file, _, _, err := s.open(ctx, page.Image)
+		if err != nil {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found: " + page.Image})
+			return
+		}
+		configs[i], formats[i], err = image.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Not a decodable image: " + page.Image})
+			return
+		}
+	}
+
+	c.Header("Content-Type", "application/pdf")
+	c.Header("Content-Disposition", "attachment; filename=images.pdf")
+	c.Status(http.StatusOK)
+
+	p := &pdfWriter{w: bufio.NewWriter(c.Writer)}
+	p.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+
+	catalogID, pagesID, fontID := p.alloc(), p.alloc(), p.alloc()
+	p.begin(catalogID)
+	p.printf("<< /Type /Catalog /Pages %d 0 R >>\n", pagesID)
+	p.end()
+	p.begin(fontID)
+	p.printf("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>\n")
+	p.end()
+
+	var kids []string
+	for i, page := range req.Pages {
+		cfg := configs[i]
+		pageW, pageH := pageSize[0], pageSize[1]
+		if !fixed {
+			pageW, pageH = float64(cfg.Width)+2*pdfMargin, float64(cfg.Height)+2*pdfMargin
+			if page.Caption != "" {
+				pageH += pdfCaptionHeight
+			}
+		}
+
+		areaW, areaH := pageW-2*pdfMargin, pageH-2*pdfMargin
+		bottom := float64(pdfMargin)
+		if page.Caption != "" {
+			areaH -= pdfCaptionHeight
+			bottom += pdfCaptionHeight
+		}
+		scale := min(areaW/float64(cfg.Width), areaH/float64(cfg.Height))
+		drawW, drawH := float64(cfg.Width)*scale, float64(cfg.Height)*scale
+		x := pdfMargin + (areaW-drawW)/2
+		y := bottom + (areaH-drawH)/2
+
+		imageID := p.alloc()
+		open := func() (io.ReadCloser, error) {
+			body, _, _, err := s.open(ctx, page.Image)
+			return body, err
+		}
+		writeImageStream(p, imageID, open, formats[i], cfg)
+
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im0 Do Q\n", drawW, drawH, x, y)
+		if page.Caption != "" {
+			fmt.Fprintf(&content, "BT /F1 %d Tf %d %d Td (%s) Tj ET\n", pdfCaptionSize, pdfMargin, pdfMargin, pdfText(page.Caption))
+		}
+		contentID := p.alloc()
+		p.stream(contentID, "", func(w io.Writer) error {
+			_, err := w.Write(content.Bytes())
+			return err
+		})
+
+		pageID := p.alloc()
+		p.begin(pageID)
+		p.printf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R /Resources << /XObject << /Im0 %d 0 R >> /Font << /F1 %d 0 R >> >> >>\n",
+			pagesID, pageW, pageH, contentID, imageID, fontID)
+		p.end()
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+
+		// Keep the client receiving data while large images are processed.
+		if p.err == nil {
+			p.w.Flush()
+			c.Writer.Flush()
+		}
+	}
+
+	p.begin(pagesID)
+	p.printf("<< /Type /Pages /Kids [%s] /Count %d >>\n", strings.Join(kids, " "), len(kids))
+	p.end()
+
+	if err := p.finish(catalogID); err != nil {
+		// Headers are already sent; all that's left is to log and drop the stream.
+		logger.Error("failed to stream pdf", "error", err)
+		c.Abort()
+	}
+}
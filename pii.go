@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// PII policies applied to uploaded images (PII_POLICY).
+const (
+	piiOff    = "off"
+	piiFlag   = "flag"
+	piiStrip  = "strip"
+	piiReject = "reject"
+)
+
+var (
+	piiPolicy = piiOff
+
+	piiUploadsFlagged = expvar.NewInt("pii_uploads_flagged_total")
+
+	errPIIRejected = errors.New("upload contains personal data")
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// piiFinding is one metadata field that carries personal data.
+type piiFinding struct {
+	Kind  string `json:"kind"` // gps, name, email or serial
+	Field string `json:"field"`
+}
+
+// EXIF tags holding names or device identifiers.
+var exifPIITags = map[uint16]piiFinding{
+	0x013B: {"name", "exif:Artist"},
+	0x9C9D: {"name", "exif:XPAuthor"},
+	0xA430: {"name", "exif:CameraOwnerName"},
+	0xA431: {"serial", "exif:BodySerialNumber"},
+	0xA435: {"serial", "exif:LensSerialNumber"},
+}
+
+// Free-text EXIF tags, reported only when they contain an email address.
+var exifTextTags = map[uint16]string{
+	0x010E: "exif:ImageDescription",
+	0x9286: "exif:UserComment",
+	0x9C9B: "exif:XPTitle",
+	0x9C9C: "exif:XPComment",
+	0x9C9F: "exif:XPSubject",
+}
+
+var xmpPIIFields = []piiFinding{
+	{"name", "dc:creator"},
+	{"name", "photoshop:AuthorsPosition"},
+	{"name", "Iptc4xmpCore:CreatorContactInfo"},
+	{"name", "exifEX:CameraOwnerName"},
+	{"serial", "exifEX:BodySerialNumber"},
+	{"serial", "aux:SerialNumber"},
+	{"gps", "exif:GPSLatitude"},
+	{"gps", "exif:GPSLongitude"},
+}
+
+var pngPIIKeywords = map[string]piiFinding{
+	"Author": {"name", "png:Author"},
+}
+
+const (
+	exifHeader = "Exif\x00\x00"
+	xmpHeader  = "http://ns.adobe.com/xap/1.0/\x00"
+
+	// PNG text chunks larger than this are passed through unscanned.
+	maxPNGMetadataChunk = 1 << 20
+)
+
+// scanPII reports the personal data found in the EXIF, XMP and text metadata
+// of a JPEG or PNG and rewinds r. Other formats yield no findings.
+func scanPII(r io.ReadSeeker) ([]piiFinding, error) {
+	findings, err := walkMetadata(nil, r)
+	if _, seekErr := r.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return findings, err
+}
+
+// stripPII copies r to w with personal data removed: PII fields inside EXIF
+// are zeroed in place, so orientation and camera settings survive, while XMP
+// packets, comments and text chunks carrying PII are dropped whole.
+func stripPII(w io.Writer, r io.Reader) error {
+	_, err := walkMetadata(w, r)
+	return err
+}
+
+// walkMetadata scans the metadata of r, and when w is non-nil also writes a
+// redacted copy of the whole stream to it.
+func walkMetadata(w io.Writer, r io.Reader) ([]piiFinding, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(8)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return walkJPEG(w, br)
+	case bytes.Equal(head, []byte("\x89PNG\r\n\x1a\n")):
+		return walkPNG(w, br)
+	}
+	if w == nil {
+		return nil, nil
+	}
+	_, err := io.Copy(w, br)
+	return nil, err
+}
+
+func walkJPEG(w io.Writer, r *bufio.Reader) ([]piiFinding, error) {
+	out := &metadataWriter{w: w}
+	var findings []piiFinding
+
+	soi := make([]byte, 2)
+	io.ReadFull(r, soi)
+	out.write(soi)
+
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return findings, out.finish(r, nil)
+		}
+		if marker != 0xFF {
+			// Not a marker: stop parsing and pass the rest through untouched.
+			return findings, out.finish(r, []byte{marker})
+		}
+		code, err := r.ReadByte()
+		if err != nil {
+			return findings, out.finish(r, []byte{marker})
+		}
+		if code == 0xFF {
+			r.UnreadByte()
+			continue
+		}
+		if code == 0x01 || code >= 0xD0 && code <= 0xD7 {
+			out.write([]byte{0xFF, code})
+			continue
+		}
+		if code == 0xD9 {
+			return findings, out.finish(r, []byte{0xFF, code})
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return findings, out.finish(r, []byte{0xFF, code})
+		}
+		data := make([]byte, length-2)
+		if n, err := io.ReadFull(r, data); err != nil {
+			return findings, out.finish(r, append([]byte{0xFF, code, byte(length >> 8), byte(length)}, data[:n]...))
+		}
+
+		keep := true
+		switch {
+		case code == 0xE1 && bytes.HasPrefix(data, []byte(exifHeader)):
+			findings = append(findings, scanExif(data[len(exifHeader):], w != nil)...)
+		case code == 0xE1 && bytes.HasPrefix(data, []byte(xmpHeader)):
+			found := scanXMP(data[len(xmpHeader):])
+			findings = append(findings, found...)
+			keep = len(found) == 0
+		case code == 0xFE:
+			found := scanText("jpeg:Comment", data)
+			findings = append(findings, found...)
+			keep = len(found) == 0
+		}
+		if keep {
+			out.write([]byte{0xFF, code, byte(length >> 8), byte(length)}, data)
+		}
+
+		// Image data follows the start-of-scan header; metadata can't.
+		if code == 0xDA {
+			return findings, out.finish(r, nil)
+		}
+	}
+}
+
+func walkPNG(w io.Writer, r *bufio.Reader) ([]piiFinding, error) {
+	out := &metadataWriter{w: w}
+	var findings []piiFinding
+
+	signature := make([]byte, 8)
+	io.ReadFull(r, signature)
+	out.write(signature)
+
+	for {
+		header := make([]byte, 8)
+		if n, err := io.ReadFull(r, header); err != nil {
+			return findings, out.finish(r, header[:n])
+		}
+		length := binary.BigEndian.Uint32(header)
+		kind := string(header[4:])
+
+		isMetadata := kind == "eXIf" || kind == "tEXt" || kind == "zTXt" || kind == "iTXt"
+		if !isMetadata || length > maxPNGMetadataChunk {
+			out.write(header)
+			if err := out.copyN(r, int64(length)+4); err != nil {
+				return findings, err
+			}
+			if kind == "IEND" {
+				return findings, out.finish(r, nil)
+			}
+			continue
+		}
+
+		data := make([]byte, length+4)
+		if n, err := io.ReadFull(r, data); err != nil {
+			return findings, out.finish(r, append(header, data[:n]...))
+		}
+		data = data[:length]
+
+		keep := true
+		if kind == "eXIf" {
+			found := scanExif(data, w != nil)
+			findings = append(findings, found...)
+		} else {
+			found := scanPNGText(kind, data)
+			findings = append(findings, found...)
+			keep = len(found) == 0
+		}
+		if keep {
+			crc := crc32.NewIEEE()
+			crc.Write(header[4:])
+			crc.Write(data)
+			out.write(header, data, binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+		}
+	}
+}
+
+// metadataWriter writes the rewritten stream when a destination is set and
+// discards everything in scan-only mode.
+type metadataWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metadataWriter) write(parts ...[]byte) {
+	for _, p := range parts {
+		if m.w != nil && m.err == nil {
+			_, m.err = m.w.Write(p)
+		}
+	}
+}
+
+func (m *metadataWriter) copyN(r io.Reader, n int64) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.w == nil {
+		_, err := io.CopyN(io.Discard, r, n)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	_, m.err = io.CopyN(m.w, r, n)
+	if m.err == io.EOF {
+		m.err = nil
+	}
+	return m.err
+}
+
+// finish writes pending bytes and passes the rest of r through unchanged.
+func (m *metadataWriter) finish(r io.Reader, pending []byte) error {
+	if m.w == nil {
+		return nil
+	}
+	m.write(pending)
+	if m.err == nil {
+		_, m.err = io.Copy(m.w, r)
+	}
+	return m.err
+}
+
+// scanExif reports PII in a TIFF-structured EXIF block and, when redact is
+// set, zeroes the offending values in place. The GPS directory is emptied
+// entirely. Malformed blocks are scanned as far as they are readable.
+func scanExif(tiff []byte, redact bool) []piiFinding {
+	if len(tiff) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	var findings []piiFinding
+	visited := map[uint32]bool{}
+	var walk func(offset uint32, gps bool)
+	walk = func(offset uint32, gps bool) {
+		if visited[offset] || int(offset)+2 > len(tiff) {
+			return
+		}
+		visited[offset] = true
+		count := int(order.Uint16(tiff[offset:]))
+		first := int(offset) + 2
+		if first+count*12 > len(tiff) {
+			count = (len(tiff) - first) / 12
+		}
+
+		if gps {
+			if count > 0 {
+				findings = append(findings, piiFinding{"gps", "exif:GPSInfo"})
+			}
+			if redact {
+				for i := 0; i < count; i++ {
+					if start, size, ok := exifValue(tiff, order, first+i*12); ok && size > 4 {
+						clear(tiff[start : start+size])
+					}
+				}
+				clear(tiff[first : first+count*12])
+				order.PutUint16(tiff[offset:], 0)
+			}
+			return
+		}
+
+		for i := 0; i < count; i++ {
+			entry := tiff[first+i*12 : first+i*12+12]
+			tag := order.Uint16(entry)
+			start, size, ok := exifValue(tiff, order, first+i*12)
+			if !ok {
+				continue
+			}
+			value := tiff[start : start+size]
+
+			switch tag {
+			case 0x8769:
+				walk(order.Uint32(entry[8:]), false)
+				continue
+			case 0x8825:
+				walk(order.Uint32(entry[8:]), true)
+				continue
+			}
+
+			if finding, ok := exifPIITags[tag]; ok && !blank(value) {
+				findings = append(findings, finding)
+			} else if field, ok := exifTextTags[tag]; ok && emailPattern.Match(bytes.ReplaceAll(value, []byte{0}, nil)) {
+				findings = append(findings, piiFinding{"email", field})
+			} else {
+				continue
+			}
+			if redact {
+				clear(value)
+			}
+		}
+	}
+	walk(order.Uint32(tiff[4:]), false)
+	return findings
+}
+
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// exifValue locates the value of the 12-byte IFD entry at offset in tiff.
+func exifValue(tiff []byte, order binary.ByteOrder, offset int) (start, size int, ok bool) {
+	entry := tiff[offset : offset+12]
+	typeSize, known := exifTypeSizes[order.Uint16(entry[2:])]
+	count := int64(order.Uint32(entry[4:]))
+	if !known || count*int64(typeSize) > int64(len(tiff)) {
+		return 0, 0, false
+	}
+	size = int(count) * typeSize
+	if size <= 4 {
+		// Small values are stored inline in the entry itself.
+		return offset + 8, size, true
+	}
+	start = int(order.Uint32(entry[8:]))
+	return start, size, start+size <= len(tiff)
+}
+
+func blank(value []byte) bool {
+	return len(bytes.Trim(value, "\x00 ")) == 0
+}
+
+func scanXMP(packet []byte) []piiFinding {
+	var findings []piiFinding
+	for _, field := range xmpPIIFields {
+		if bytes.Contains(packet, []byte("<"+field.Field)) || bytes.Contains(packet, []byte(field.Field+`="`)) {
+			findings = append(findings, piiFinding{field.Kind, "xmp:" + field.Field})
+		}
+	}
+	if emailPattern.Match(packet) {
+		findings = append(findings, piiFinding{"email", "xmp"})
+	}
+	return findings
+}
+
+func scanText(field string, text []byte) []piiFinding {
+	if emailPattern.Match(text) {
+		return []piiFinding{{"email", field}}
+	}
+	return nil
+}
+
+// scanPNGText scans a tEXt, zTXt or iTXt chunk, including XMP packets that
+// are stored in iTXt under the "XML:com.adobe.xmp" keyword.
+func scanPNGText(kind string, data []byte) []piiFinding {
+	keyword, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return nil
+	}
+	compressed := false
+	switch kind {
+	case "zTXt":
+		// Compression method byte, then the compressed text.
+		if len(rest) < 1 {
+			return nil
+		}
+		rest, compressed = rest[1:], true
+	case "iTXt":
+		// Compression flag and method, then language tag and translated
+		// keyword, each NUL-terminated.
+		if len(rest) < 2 {
+			return nil
+		}
+		compressed = rest[0] == 1
+		rest = rest[2:]
+		for range 2 {
+			if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+				return nil
+			}
+		}
+	}
+	text := rest
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(rest))
+		if err != nil {
+			return nil
+		}
+		text, _ = io.ReadAll(io.LimitReader(zr, maxPNGMetadataChunk))
+	}
+
+	if string(keyword) == "XML:com.adobe.xmp" {
+		return scanXMP(text)
+	}
+	if finding, ok := pngPIIKeywords[string(keyword)]; ok && !blank(text) {
+		return []piiFinding{finding}
+	}
+	return scanText("png:"+string(keyword), text)
+}
+
+// maxRecentPIIReviews bounds how many flagged uploads are kept for review.
+const maxRecentPIIReviews = 100
+
+type piiReview struct {
+	Route    string       `json:"route"`
+	Filename string       `json:"filename"`
+	Action   string       `json:"action"`
+	Findings []piiFinding `json:"findings"`
+	At       time.Time    `json:"at"`
+}
+
+var piiReviews struct {
+	mu     sync.Mutex
+	recent []piiReview
+}
+
+// recordPIIFindings logs an upload whose metadata contained PII and keeps it
+// for compliance review through the admin API.
+func recordPIIFindings(route, filename string, findings []piiFinding) {
+	action := map[string]string{piiFlag: "flagged", piiStrip: "stripped", piiReject: "rejected"}[piiPolicy]
+	piiUploadsFlagged.Add(1)
+	logger.Warn("personal data found in upload metadata",
+		"route", route, "filename", filename, "action", action, "findings", fmt.Sprint(findings))
+
+	piiReviews.mu.Lock()
+	defer piiReviews.mu.Unlock()
+	piiReviews.recent = append(piiReviews.recent, piiReview{
+		Route: route, Filename: filename, Action: action, Findings: findings, At: time.Now(),
+	})
+	if len(piiReviews.recent) > maxRecentPIIReviews {
+		piiReviews.recent = piiReviews.recent[len(piiReviews.recent)-maxRecentPIIReviews:]
+	}
+}
+
+func piiReport() map[string]any {
+	piiReviews.mu.Lock()
+	defer piiReviews.mu.Unlock()
+	return map[string]any{
+		"policy": piiPolicy,
+		"total":  piiUploadsFlagged.Value(),
+		"recent": append([]piiReview{}, piiReviews.recent...),
+	}
+}
+
+// checkPII scans an upload according to PII_POLICY. It returns the findings
+// and errPIIRejected when the policy rejects them.
+func checkPII(r io.ReadSeeker) ([]piiFinding, error) {
+	if piiPolicy == piiOff {
+		return nil, nil
+	}
+	findings, err := scanPII(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(findings) > 0 && piiPolicy == piiReject {
+		return findings, errPIIRejected
+	}
+	return findings, nil
+}
+
+// uploadReader returns r with the metadata removed that the configuration
+// asks for: personal data when the policy strips PII and the scan found
+// some, and JPEG EXIF and XMP when STRIP_EXIF is on. The caller must close
+// it once done, whether or not it was read to the end.
+func uploadReader(r io.Reader, findings []piiFinding) io.ReadCloser {
+	rc := io.NopCloser(r)
+	if piiPolicy == piiStrip && len(findings) > 0 {
+		rc = pipeThrough(rc, stripPII)
+	}
+	if stripExif.Load() {
+		rc = pipeThrough(rc, stripExifMetadata)
+	}
+	return rc
+}
+
+// filteredReader reads what a filter goroutine writes while copying src.
+type filteredReader struct {
+	*io.PipeReader
+	src  io.ReadCloser
+	done chan struct{}
+}
+
+// pipeThrough returns a reader of what filter writes while copying src.
+func pipeThrough(src io.ReadCloser, filter func(w io.Writer, r io.Reader) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	f := &filteredReader{PipeReader: pr, src: src, done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		pw.CloseWithError(filter(pw, src))
+	}()
+	return f
+}
+
+// Close stops the filter and waits for it, so src is no longer read once
+// Close returns.
+func (f *filteredReader) Close() error {
+	f.PipeReader.CloseWithError(io.ErrClosedPipe)
+	f.src.Close()
+	<-f.done
+	return nil
+}
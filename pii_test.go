@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// jpegWithArtist returns a small JPEG whose EXIF names its artist.
+func jpegWithArtist(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	artist := "Jane Doe"
+	tiff, err := patchTIFF(nil, map[uint16]*string{exifArtistTag: &artist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := writeExif(buf.Bytes(), tiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func usePIISettings(t *testing.T, policy string, strip bool) {
+	t.Helper()
+	previousPolicy, previousStrip := piiPolicy, stripExif.Load()
+	piiPolicy = policy
+	stripExif.Store(strip)
+	t.Cleanup(func() {
+		piiPolicy = previousPolicy
+		stripExif.Store(previousStrip)
+	})
+}
+
+// sourceReads counts the reads of r.
+type sourceReads struct {
+	r     io.Reader
+	reads atomic.Int64
+}
+
+func (c *sourceReads) Read(p []byte) (int, error) {
+	c.reads.Add(1)
+	return c.r.Read(p)
+}
+
+func TestPipeThroughCloseStopsReadingSource(t *testing.T) {
+	src := &sourceReads{r: bytes.NewReader(make([]byte, 1<<20))}
+	copyAll := func(w io.Writer, r io.Reader) error {
+		_, err := io.CopyBuffer(w, r, make([]byte, 512))
+		return err
+	}
+	r := pipeThrough(pipeThrough(io.NopCloser(src), copyAll), copyAll)
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	reads := src.reads.Load()
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("read after Close succeeded")
+	}
+	if got := src.reads.Load(); got != reads {
+		t.Errorf("source read %d more times after Close", got-reads)
+	}
+}
+
+func TestUploadReaderStripsMetadata(t *testing.T) {
+	data := jpegWithArtist(t)
+	for _, tc := range []struct {
+		policy       string
+		stripExif    bool
+		wantFindings bool
+		wantExif     bool
+	}{
+		{piiOff, false, true, true},
+		{piiFlag, false, true, true},
+		{piiStrip, false, false, true},
+		{piiOff, true, false, false},
+		{piiFlag, true, false, false},
+		{piiStrip, true, false, false},
+	} {
+		usePIISettings(t, tc.policy, tc.stripExif)
+		findings, err := checkPII(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: checkPII: %v", tc.policy, err)
+		}
+		body := uploadReader(bytes.NewReader(data), findings)
+		stored, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("%s: reading upload: %v", tc.policy, err)
+		}
+
+		left, _ := scanPII(bytes.NewReader(stored))
+		if got := len(left) > 0; got != tc.wantFindings {
+			t.Errorf("%s, strip_exif %v: personal data kept = %v, want %v", tc.policy, tc.stripExif, got, tc.wantFindings)
+		}
+		tiff, _ := readExif(bytes.NewReader(stored))
+		if got := tiff != nil; got != tc.wantExif {
+			t.Errorf("%s, strip_exif %v: EXIF kept = %v, want %v", tc.policy, tc.stripExif, got, tc.wantExif)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(stored)); err != nil {
+			t.Errorf("%s, strip_exif %v: stored image undecodable: %v", tc.policy, tc.stripExif, err)
+		}
+	}
+}
+
+func TestCheckPIIRejects(t *testing.T) {
+	data := jpegWithArtist(t)
+	for policy, want := range map[string]error{piiOff: nil, piiFlag: nil, piiStrip: nil, piiReject: errPIIRejected} {
+		usePIISettings(t, policy, false)
+		if _, err := checkPII(bytes.NewReader(data)); !errors.Is(err, want) {
+			t.Errorf("%s: checkPII = %v, want %v", policy, err, want)
+		}
+	}
+}
+
+func TestFilesStoreKeepsUploadsAsSent(t *testing.T) {
+	usePIISettings(t, piiStrip, true)
+	data := jpegWithArtist(t)
+	findings, _ := checkPII(bytes.NewReader(data))
+	for _, s := range []*fileStore{{route: "/files"}, {route: "/images", stripMetadata: true}} {
+		body := s.uploadReader(bytes.NewReader(data), findings)
+		stored, _ := io.ReadAll(body)
+		body.Close()
+		if got, want := bytes.Equal(stored, data), !s.stripMetadata; got != want {
+			t.Errorf("%s: stored as sent = %v, want %v", s.route, got, want)
+		}
+	}
+}
+
+func TestIngestFileAppliesPIIPolicy(t *testing.T) {
+	previous := imageStorage
+	imageStorage = newLocalStorage(t.TempDir())
+	t.Cleanup(func() { imageStorage = previous })
+	data := jpegWithArtist(t)
+
+	usePIISettings(t, piiReject, false)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ingestFile(src); !errors.Is(err, errPIIRejected) {
+		t.Fatalf("ingestFile = %v, want errPIIRejected", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".photo.jpg")); err != nil {
+		t.Errorf("rejected file not set aside: %v", err)
+	}
+
+	usePIISettings(t, piiStrip, false)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	name, err := ingestFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _, err := imageStorage.Get(t.Context(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	content, err := io.ReadAll(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findings, _ := scanPII(bytes.NewReader(content)); len(findings) > 0 {
+		t.Errorf("ingested file kept %v", findings)
+	}
+}
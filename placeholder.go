@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadPlaceholders enables computing a BlurHash placeholder of every
+// uploaded image (PLACEHOLDERS).
+var uploadPlaceholders = true
+
+// blurHashComponents are the horizontal and vertical BlurHash components;
+// 4x3 suits most landscape and portrait photos.
+const blurHashX, blurHashY = 4, 3
+
+// blurHashSample is the size images are reduced to before hashing. The hash
+// only keeps a few cosine components, so more pixels add nothing but time.
+const blurHashSample = 32
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// placeholder is the stored placeholder of an image. Width and height are
+// those of the image as displayed, so clients can reserve its aspect ratio.
+type placeholder struct {
+	BlurHash string `json:"blurhash"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// placeholderName is the object name of the placeholder of filename, kept in
+// a dot-directory beside the originals like thumbnails.
+func placeholderName(filename string) string {
+	return ".placeholders/" + filename + ".json"
+}
+
+func encodeBase83(value, length int) string {
+	var b strings.Builder
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		b.WriteByte(base83Chars[digit])
+	}
+	return b.String()
+}
+
+func srgbToLinear(v uint32) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurHash encodes img as a BlurHash (https://blurha.sh) with xComp x yComp
+// components.
+func blurHash(img image.Image, xComp, yComp int) string {
+	img = fitImage(img, blurHashSample, blurHashSample)
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := range yComp {
+		for i := range xComp {
+			var sum [3]float64
+			for y := range h {
+				for x := range w {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					sum[0] += basis * srgbToLinear(r>>8)
+					sum[1] += basis * srgbToLinear(g>>8)
+					sum[2] += basis * srgbToLinear(bl>>8)
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{sum[0] * scale, sum[1] * scale, sum[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComp-1)+(yComp-1)*9, 1))
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actual := 0.0
+		for _, f := range factors[1:] {
+			actual = max(actual, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantised := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		hash.WriteString(encodeBase83(quantised, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	quant := func(v float64) int {
+		return int(max(0, min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+	}
+	for _, f := range factors[1:] {
+		hash.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+// storePlaceholder computes and stores the placeholder of src for filename.
+func (s *fileStore) storePlaceholder(ctx context.Context, src image.Image, filename string) (placeholder, error) {
+	p := placeholder{
+		BlurHash: blurHash(src, blurHashX, blurHashY),
+		Width:    src.Bounds().Dx(),
+		Height:   src.Bounds().Dy(),
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return p, err
+	}
+	if _, err = s.storage.Put(ctx, placeholderName(filename), bytes.NewReader(data)); err != nil {
+		return p, err
+	}
+	s.metadata.recordDerivative(ctx, derivative{
+		Source:      filename,
+		Name:        placeholderName(filename),
+		Kind:        derivedPlaceholder,
+		ContentType: "application/json",
+		Size:        int64(len(data)),
+	})
+	return p, nil
+}
+
+// removePlaceholder deletes the stored placeholder of filename.
+func (s *fileStore) removePlaceholder(ctx context.Context, filename string) {
+	if s.placeholders {
+		s.storage.Delete(ctx, placeholderName(filename))
+	}
+}
+
+// placeholder serves the BlurHash placeholder of an image. Placeholders
+// missing from storage, such as those of files stored before placeholders
+// were enabled, are computed and stored on first request.
+func (s *fileStore) placeholder(c *gin.Context) {
+	filename := c.Param("filename")
+	name := placeholderName(filename)
+	ctx := c.Request.Context()
+
+	var p placeholder
+	if body, _, err := s.storage.Get(ctx, name); err == nil {
+		err = json.NewDecoder(body).Decode(&p)
+		body.Close()
+		if err == nil {
+			c.IndentedJSON(http.StatusOK, gin.H{"filename": filename, "blurhash": p.BlurHash, "width": p.Width, "height": p.Height})
+			return
+		}
+	}
+
+	leader := false
+	result, err, shared := transformFlight.Do(name, func() (any, error) {
+		leader = true
+		src, _, err := s.decode(ctx, filename)
+		if err != nil {
+			return nil, errNotDecodable
+		}
+		return s.storePlaceholder(ctx, src, filename)
+	})
+	if shared && !leader {
+		transformsDeduplicated.Add(1)
+	}
+	if errors.Is(err, errNotDecodable) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Image not found or not decodable"})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate placeholder."})
+		return
+	}
+	p = result.(placeholder)
+	c.IndentedJSON(http.StatusOK, gin.H{"filename": filename, "blurhash": p.BlurHash, "width": p.Width, "height": p.Height})
+}
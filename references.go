@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Brand-safety screening: operators register reference images, such as
+// logos or banned content, and every new image is compared with them by
+// difference hash. Matches within referenceMatchDistance bits are recorded
+// in the metadata store and posted to referenceWebhookURL.
+var (
+	referenceMatchDistance int
+	referenceWebhookURL    string
+	// referenceWebhookSecret signs alerts with HMAC-SHA256 when set.
+	referenceWebhookSecret string
+)
+
+var (
+	referenceMatchesFound  = expvar.NewInt("reference_matches_total")
+	referenceAlertFailures = expvar.NewInt("reference_alert_failures_total")
+)
+
+var referenceAlertClient = &http.Client{Timeout: 10 * time.Second}
+
+// referenceAlertAttempts bounds the deliveries of one alert; retries back
+// off 2, then 4 seconds.
+const referenceAlertAttempts = 3
+
+// screeningSlots bounds the images decoded for screening at once, so a
+// burst of uploads doesn't hold every image in memory together.
+var screeningSlots = make(chan struct{}, 2)
+
+// referenceImage is a registered reference; only its hash is kept.
+type referenceImage struct {
+	ID        string    `json:"id"`
+	Label     string    `json:"label"`
+	Category  string    `json:"category"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// referenceMatch is a stored image found to match a reference. Score runs
+// from 1 for identical hashes down to 0.
+type referenceMatch struct {
+	Filename    string    `json:"filename,omitempty"`
+	ReferenceID string    `json:"reference_id"`
+	Label       string    `json:"label"`
+	Category    string    `json:"category"`
+	Distance    int       `json:"distance"`
+	Score       float64   `json:"score"`
+	MatchedAt   time.Time `json:"matched_at"`
+}
+
+func matchScore(distance int) float64 {
+	return math.Round((1-float64(distance)/64)*1000) / 1000
+}
+
+func (m *metadataStore) addReference(ctx context.Context, r referenceImage) error {
+	_, err := m.db.ExecContext(ctx, m.rebind(
+		"INSERT INTO reference_images (id, label, category, hash, created_at) VALUES (?, ?, ?, ?, ?)"),
+		r.ID, r.Label, r.Category, r.Hash, r.CreatedAt.UnixMilli())
+	return err
+}
+
+// references returns the reference set, oldest first.
+func (m *metadataStore) references(ctx context.Context) ([]referenceImage, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT id, label, category, hash, created_at FROM reference_images ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	references := []referenceImage{}
+	for rows.Next() {
+		var r referenceImage
+		var created int64
+		if err := rows.Scan(&r.ID, &r.Label, &r.Category, &r.Hash, &created); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = time.UnixMilli(created).UTC()
+		references = append(references, r)
+	}
+	return references, rows.Err()
+}
+
+// deleteReference removes a reference and its matches, or returns
+// ErrNotFound.
+func (m *metadataStore) deleteReference(ctx context.Context, id string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, m.rebind("DELETE FROM reference_images WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, m.rebind("DELETE FROM reference_matches WHERE reference_id = ?"), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceMatches sets the matches of filename, dropping those of an image
+// it replaced.
+func (m *metadataStore) replaceMatches(ctx context.Context, filename string, matches []referenceMatch) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.rebind("DELETE FROM reference_matches WHERE filename = ?"), filename); err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if _, err := tx.ExecContext(ctx, m.rebind(
+			"INSERT INTO reference_matches (filename, reference_id, distance, matched_at) VALUES (?, ?, ?, ?)"),
+			filename, match.ReferenceID, match.Distance, match.MatchedAt.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const matchColumns = `SELECT m.filename, m.reference_id, r.label, r.category, m.distance, m.matched_at
+	FROM reference_matches m JOIN reference_images r ON r.id = m.reference_id`
+
+func scanReferenceMatches(rows *sql.Rows) ([]referenceMatch, error) {
+	defer rows.Close()
+	matches := []referenceMatch{}
+	for rows.Next() {
+		var match referenceMatch
+		var matched int64
+		if err := rows.Scan(&match.Filename, &match.ReferenceID, &match.Label, &match.Category, &match.Distance, &matched); err != nil {
+			return nil, err
+		}
+		match.Score, match.MatchedAt = matchScore(match.Distance), time.UnixMilli(matched).UTC()
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+// matches returns the matches of filename, closest first.
+func (m *metadataStore) matches(ctx context.Context, filename string) ([]referenceMatch, error) {
+	rows, err := m.db.QueryContext(ctx, m.rebind(matchColumns+" WHERE m.filename = ? ORDER BY m.distance, m.reference_id"), filename)
+	if err != nil {
+		return nil, err
+	}
+	return scanReferenceMatches(rows)
+}
+
+// recentMatches returns the latest matches, of one reference when
+// referenceID is set.
+func (m *metadataStore) recentMatches(ctx context.Context, referenceID string, limit int) ([]referenceMatch, error) {
+	query, args := matchColumns, []any{}
+	if referenceID != "" {
+		query += " WHERE m.reference_id = ?"
+		args = append(args, referenceID)
+	}
+	rows, err := m.db.QueryContext(ctx, m.rebind(query+" ORDER BY m.matched_at DESC, m.filename LIMIT ?"), append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReferenceMatches(rows)
+}
+
+// screen compares the stored image filename with the reference set and
+// records its matches, posting an alert when there are any. Files that
+// don't decode as images aren't screened.
+func (m *metadataStore) screen(ctx context.Context, filename string) {
+	if m == nil {
+		return
+	}
+	references, err := m.references(ctx)
+	if err != nil {
+		logger.Error("failed to read the reference set", "error", err)
+		return
+	}
+	if len(references) == 0 {
+		return
+	}
+	screeningSlots <- struct{}{}
+	hash, err := storedDHash(ctx, filename)
+	<-screeningSlots
+	if err != nil {
+		return
+	}
+
+	matches := []referenceMatch{}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, r := range references {
+		referenceHash, err := strconv.ParseUint(r.Hash, 16, 64)
+		if err != nil {
+			continue
+		}
+		if distance := bits.OnesCount64(hash ^ referenceHash); distance <= referenceMatchDistance {
+			matches = append(matches, referenceMatch{
+				ReferenceID: r.ID,
+				Label:       r.Label,
+				Category:    r.Category,
+				Distance:    distance,
+				Score:       matchScore(distance),
+				MatchedAt:   now,
+			})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Distance < matches[j].Distance })
+	if err := m.replaceMatches(ctx, filename, matches); err != nil {
+		logger.Error("failed to record reference matches", "file", filename, "error", err)
+	}
+	if len(matches) == 0 {
+		return
+	}
+	referenceMatchesFound.Add(int64(len(matches)))
+	logger.Warn("image matches the reference set", "file", filename, "reference", matches[0].ReferenceID, "distance", matches[0].Distance)
+	if referenceWebhookURL != "" {
+		record, err := m.get(ctx, filename)
+		if err != nil {
+			record = imageRecord{Filename: filename}
+		}
+		postReferenceAlert(ctx, referenceAlert{Event: "reference.match", Image: record, Matches: matches})
+	}
+}
+
+// storedDHash hashes the stored image filename.
+func storedDHash(ctx context.Context, filename string) (uint64, error) {
+	body, _, err := imageStorage.Get(ctx, filename)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	img, _, err := decodeOriented(body)
+	if err != nil {
+		return 0, err
+	}
+	return imageDHash(img), nil
+}
+
+// referenceAlert is the body posted to REFERENCE_WEBHOOK_URL.
+type referenceAlert struct {
+	Event   string           `json:"event"`
+	Image   imageRecord      `json:"image"`
+	Matches []referenceMatch `json:"matches"`
+}
+
+// postReferenceAlert delivers an alert, retrying failed deliveries. With
+// REFERENCE_WEBHOOK_SECRET set, X-Signature-256 carries the HMAC-SHA256 of
+// the body so the receiver can verify it.
+func postReferenceAlert(ctx context.Context, alert referenceAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	for attempt := range referenceAlertAttempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, referenceWebhookURL, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if referenceWebhookSecret != "" {
+			mac := hmac.New(sha256.New, []byte(referenceWebhookSecret))
+			mac.Write(body)
+			req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := referenceAlertClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+		logger.Warn("reference alert delivery failed", "file", alert.Image.Filename, "attempt", attempt+1, "error", err)
+	}
+	referenceAlertFailures.Add(1)
+	logger.Error("reference alert dropped", "file", alert.Image.Filename)
+}
+
+const (
+	// maxReferenceLabel bounds the label and category of a reference.
+	maxReferenceLabel = 256
+	// maxReferenceUpload bounds uploaded reference images.
+	maxReferenceUpload = 64 << 20
+)
+
+// listReferences serves the reference set.
+func listReferences(c *gin.Context) {
+	if imageMetadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	references, err := imageMetadata.references(c.Request.Context())
+	if err != nil {
+		logger.Error("failed to read the reference set", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read the reference set."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"references": references, "count": len(references)})
+}
+
+// createReference registers the image uploaded as the file form field, with
+// the optional label and category form fields. The image itself isn't
+// kept, only its hash.
+func createReference(c *gin.Context) {
+	if imageMetadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxReferenceUpload)
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "File not found in the request"})
+		return
+	}
+	defer file.Close()
+	label, category := c.PostForm("label"), c.PostForm("category")
+	if len(label) > maxReferenceLabel || len(category) > maxReferenceLabel {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "label and category must be at most " + strconv.Itoa(maxReferenceLabel) + " bytes"})
+		return
+	}
+	img, _, err := decodeOriented(file)
+	if err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "File is not a supported image."})
+		return
+	}
+	reference := referenceImage{
+		ID:        uuid.New().String(),
+		Label:     label,
+		Category:  category,
+		Hash:      fmt.Sprintf("%016x", imageDHash(img)),
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := imageMetadata.addReference(c.Request.Context(), reference); err != nil {
+		logger.Error("failed to add reference image", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to add the reference image."})
+		return
+	}
+	logger.Info("reference image added", "id", reference.ID, "label", label, "user", c.GetString("adminUser"))
+	c.IndentedJSON(http.StatusCreated, reference)
+}
+
+// removeReference removes a reference and the matches found for it.
+func removeReference(c *gin.Context) {
+	if imageMetadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	err := imageMetadata.deleteReference(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, ErrNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "No such reference image."})
+		return
+	}
+	if err != nil {
+		logger.Error("failed to delete reference image", "id", c.Param("id"), "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to delete the reference image."})
+		return
+	}
+	logger.Info("reference image deleted", "id", c.Param("id"), "user", c.GetString("adminUser"))
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Reference image deleted."})
+}
+
+// listReferenceMatches serves the latest matches, newest first: of one
+// reference with ?reference=, at most ?limit= (100 by default).
+func listReferenceMatches(c *gin.Context) {
+	if imageMetadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "The metadata store is disabled."})
+		return
+	}
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchResults {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "limit must be between 1 and " + strconv.Itoa(maxSearchResults)})
+			return
+		}
+		limit = n
+	}
+	matches, err := imageMetadata.recentMatches(c.Request.Context(), c.Query("reference"), limit)
+	if err != nil {
+		logger.Error("failed to read reference matches", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read reference matches."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"matches": matches, "count": len(matches)})
+}
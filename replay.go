@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/heap"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	replaysRejected     = expvar.NewInt("replays_rejected_total")
+	replaysRejectedByIP = expvar.NewMap("replays_rejected_by_ip")
+)
+
+// maxRecentReplays bounds how many rejected replays are kept for the admin view.
+const maxRecentReplays = 100
+
+type replayEvent struct {
+	IP    string    `json:"ip"`
+	Path  string    `json:"path"`
+	Nonce string    `json:"nonce"`
+	At    time.Time `json:"at"`
+}
+
+// Bounds of the per-IP replay counts: an IP is forgotten after
+// replayIPWindow without replays, and beyond maxReplayIPs the IP that
+// replayed least recently is.
+const (
+	maxReplayIPs   = 1024
+	replayIPWindow = 24 * time.Hour
+)
+
+// replayGuard remembers nonces of one-time URLs until they expire, so a
+// signed URL carrying a nonce can only be used once.
+type replayGuard struct {
+	mu     sync.Mutex
+	seen   map[string]int64
+	expiry nonceHeap // the nonces in seen, soonest to expire first
+	byIP   map[string]*ipReplays
+	recent []replayEvent
+}
+
+type ipReplays struct {
+	count int64
+	last  time.Time
+}
+
+type seenNonce struct {
+	nonce   string
+	expires int64
+}
+
+// nonceHeap is a min-heap of nonces by expiry.
+type nonceHeap []seenNonce
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expires < h[j].expires }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x any)        { *h = append(*h, x.(seenNonce)) }
+func (h *nonceHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+var replays = &replayGuard{
+	seen: make(map[string]int64),
+	byIP: make(map[string]*ipReplays),
+}
+
+// consume marks nonce as used and reports whether this was its first use.
+// Replays are counted per client IP for abuse detection.
+func (g *replayGuard) consume(nonce string, expires int64, ip, path string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for g.expiry.Len() > 0 && g.expiry[0].expires < now.Unix() {
+		delete(g.seen, heap.Pop(&g.expiry).(seenNonce).nonce)
+	}
+
+	if _, used := g.seen[nonce]; !used {
+		g.seen[nonce] = expires
+		heap.Push(&g.expiry, seenNonce{nonce: nonce, expires: expires})
+		return true
+	}
+
+	replaysRejected.Add(1)
+	g.countReplay(ip, now)
+	g.recent = append(g.recent, replayEvent{IP: ip, Path: path, Nonce: nonce, At: now})
+	if len(g.recent) > maxRecentReplays {
+		g.recent = g.recent[len(g.recent)-maxRecentReplays:]
+	}
+	return false
+}
+
+// countReplay counts a replay from ip. A new IP beyond maxReplayIPs first
+// makes room by forgetting stale IPs, or else the least recent one, so the
+// counts stay bounded however many IPs replay; g.mu must be held.
+func (g *replayGuard) countReplay(ip string, now time.Time) {
+	if _, ok := g.byIP[ip]; !ok && len(g.byIP) >= maxReplayIPs {
+		oldest := ""
+		for other, r := range g.byIP {
+			if now.Sub(r.last) > replayIPWindow {
+				g.forgetIP(other)
+			} else if oldest == "" || r.last.Before(g.byIP[oldest].last) {
+				oldest = other
+			}
+		}
+		if len(g.byIP) >= maxReplayIPs {
+			g.forgetIP(oldest)
+		}
+	}
+	r, ok := g.byIP[ip]
+	if !ok {
+		r = &ipReplays{}
+		g.byIP[ip] = r
+	}
+	r.count++
+	r.last = now
+	replaysRejectedByIP.Add(ip, 1)
+}
+
+// forgetIP drops the replay count of ip; g.mu must be held.
+func (g *replayGuard) forgetIP(ip string) {
+	delete(g.byIP, ip)
+	replaysRejectedByIP.Delete(ip)
+}
+
+func (g *replayGuard) report() map[string]any {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	byIP := make(map[string]int64, len(g.byIP))
+	for ip, r := range g.byIP {
+		byIP[ip] = r.count
+	}
+	return map[string]any{
+		"total":  replaysRejected.Value(),
+		"by_ip":  byIP,
+		"recent": append([]replayEvent(nil), g.recent...),
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplayGuardExpiresNonces(t *testing.T) {
+	g := &replayGuard{seen: map[string]int64{}, byIP: map[string]*ipReplays{}}
+	now := time.Now().Unix()
+	if !g.consume("old", now-1, "192.0.2.1", "/images/a.jpg") {
+		t.Fatal("first use of a nonce rejected")
+	}
+	if !g.consume("new", now+60, "192.0.2.1", "/images/a.jpg") {
+		t.Fatal("first use of a nonce rejected")
+	}
+	if g.consume("new", now+60, "192.0.2.1", "/images/a.jpg") {
+		t.Fatal("replayed nonce accepted")
+	}
+	if _, ok := g.seen["old"]; ok || len(g.expiry) != 1 {
+		t.Fatalf("expired nonce kept: seen %v, %d in heap", g.seen, len(g.expiry))
+	}
+}
+
+func TestReplayGuardBoundsIPs(t *testing.T) {
+	g := &replayGuard{seen: map[string]int64{}, byIP: map[string]*ipReplays{}}
+	expires := time.Now().Unix() + 60
+	g.consume("n", expires, "", "/images/a.jpg")
+	for i := range maxReplayIPs + 10 {
+		g.consume("n", expires, "198.51.100."+strconv.Itoa(i), "/images/a.jpg")
+	}
+	if len(g.byIP) != maxReplayIPs {
+		t.Fatalf("%d IPs counted, want %d", len(g.byIP), maxReplayIPs)
+	}
+	if _, ok := g.byIP["198.51.100.0"]; ok {
+		t.Fatal("least recent IP kept")
+	}
+}
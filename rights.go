@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"hash/crc32"
+	"strings"
+)
+
+// Rights metadata embedded into derivatives while copyrightMetadata is on
+// (COPYRIGHT_METADATA), so crops and resizes passed around still carry
+// attribution. An image's own EXIF copyright and artist take precedence over
+// the configured notice and creator.
+var (
+	copyrightMetadata bool
+	copyrightNotice   string
+	copyrightCreator  string
+	copyrightLicense  string // URL of the license terms
+)
+
+// rights is the attribution embedded into a derivative.
+type rights struct {
+	notice, creator, license string
+}
+
+// sourceRights returns the rights of an image whose EXIF block is tiff
+// (nil when it has none), zero when copyrightMetadata is off.
+func sourceRights(tiff []byte) rights {
+	if !copyrightMetadata {
+		return rights{}
+	}
+	r := rights{copyrightNotice, copyrightCreator, copyrightLicense}
+	if tiff != nil {
+		info := parseExif(tiff)
+		if info.Copyright != "" {
+			r.notice = info.Copyright
+		}
+		if info.Artist != "" {
+			r.creator = info.Artist
+		}
+	}
+	return r
+}
+
+// rights reads the rights of the stored image filename.
+func (s *fileStore) rights(ctx context.Context, filename string) rights {
+	if !copyrightMetadata {
+		return rights{}
+	}
+	var tiff []byte
+	if body, _, _, err := s.open(ctx, filename); err == nil {
+		tiff, _ = readExif(body)
+		body.Close()
+	}
+	return sourceRights(tiff)
+}
+
+// rightsCacheKey identifies the configured rights in transform cache keys,
+// so changing them doesn't serve conversions made before.
+func rightsCacheKey() string {
+	if !copyrightMetadata {
+		return ""
+	}
+	return strings.Join([]string{copyrightNotice, copyrightCreator, copyrightLicense}, "\x00")
+}
+
+// xmpPacket renders r as an XMP packet with the Dublin Core and XMP Rights
+// properties IPTC Core maps its copyright notice, creator and web statement
+// to.
+func (r rights) xmpPacket() []byte {
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmpRights=\"http://ns.adobe.com/xap/1.0/rights/\"\n")
+	b.WriteString("    xmlns:cc=\"http://creativecommons.org/ns#\"")
+	if r.notice != "" {
+		b.WriteString("\n    xmpRights:Marked=\"True\"")
+	}
+	if r.license != "" {
+		b.WriteString("\n    xmpRights:WebStatement=\"" + escape(r.license) + "\"")
+	}
+	b.WriteString(">\n")
+	if r.notice != "" {
+		b.WriteString("   <dc:rights><rdf:Alt><rdf:li xml:lang=\"x-default\">" + escape(r.notice) + "</rdf:li></rdf:Alt></dc:rights>\n")
+	}
+	if r.creator != "" {
+		b.WriteString("   <dc:creator><rdf:Seq><rdf:li>" + escape(r.creator) + "</rdf:li></rdf:Seq></dc:creator>\n")
+	}
+	if r.license != "" {
+		b.WriteString("   <cc:license rdf:resource=\"" + escape(r.license) + "\"/>\n")
+	}
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"r\"?>")
+	return []byte(b.String())
+}
+
+// embedRights adds r as XMP to data, a JPEG, PNG or WebP encoded here.
+// Other formats, and data when r is empty, are returned unchanged.
+func embedRights(data []byte, r rights) []byte {
+	if r == (rights{}) {
+		return data
+	}
+	packet := r.xmpPacket()
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		// The encoder writes no APPn segments, so APP1 goes right after SOI.
+		segment := append([]byte(xmpHeader), packet...)
+		if len(segment)+2 > 0xFFFF {
+			return data
+		}
+		out := append([]byte{0xFF, 0xD8, 0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(segment)+2))...)
+		out = append(out, segment...)
+		return append(out, data[2:]...)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) && len(data) > 33:
+		// An iTXt chunk after IHDR: keyword, no compression, no language.
+		text := append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), packet...)
+		out := append([]byte(nil), data[:33]...)
+		out = appendPNGChunk(out, "iTXt", text)
+		return append(out, data[33:]...)
+	case len(data) > 30 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return embedWebPXMP(data, packet)
+	}
+	return data
+}
+
+func appendPNGChunk(out []byte, kind string, data []byte) []byte {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, kind...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc.Sum32())
+}
+
+// embedWebPXMP adds an XMP chunk to a WebP. A simple (VP8 or VP8L) one has
+// to become an extended one, with a VP8X header announcing the chunk.
+func embedWebPXMP(data, packet []byte) []byte {
+	chunk, body := string(data[12:16]), data[20:]
+	var width, height int
+	var flags byte = 0x04 // XMP
+	switch chunk {
+	case "VP8X":
+		out := append([]byte(nil), data...)
+		out[20] |= flags
+		return appendWebPChunk(out, "XMP ", packet)
+	case "VP8 ":
+		if len(body) < 10 {
+			return data
+		}
+		width = int(binary.LittleEndian.Uint16(body[6:]) & 0x3FFF)
+		height = int(binary.LittleEndian.Uint16(body[8:]) & 0x3FFF)
+	case "VP8L":
+		if len(body) < 5 {
+			return data
+		}
+		bits := binary.LittleEndian.Uint32(body[1:])
+		width = int(bits&0x3FFF) + 1
+		height = int(bits>>14&0x3FFF) + 1
+		if bits>>28&1 == 1 {
+			flags |= 0x10 // alpha
+		}
+	default:
+		return data
+	}
+
+	out := append([]byte("RIFF\x00\x00\x00\x00WEBP"), "VP8X"...)
+	out = binary.LittleEndian.AppendUint32(out, 10)
+	out = append(out, flags, 0, 0, 0)
+	out = append(out, byte(width-1), byte((width-1)>>8), byte((width-1)>>16))
+	out = append(out, byte(height-1), byte((height-1)>>8), byte((height-1)>>16))
+	out = append(out, data[12:]...)
+	return appendWebPChunk(out, "XMP ", packet)
+}
+
+// appendWebPChunk appends a chunk to the RIFF container in out and updates
+// its size.
+func appendWebPChunk(out []byte, kind string, data []byte) []byte {
+	out = append(out, kind...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// s3Storage keeps objects in an S3 bucket (or an S3-compatible service such
+// as MinIO or R2) under a key prefix.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// s3Settings are read from the S3_* environment variables.
+type s3Settings struct {
+	bucket          string
+	region          string
+	prefix          string
+	endpoint        string
+	forcePathStyle  bool
+	accessKeyID     string
+	secretAccessKey string
+}
+
+// newS3Storage creates a client for bucket. Without explicit keys the default
+// AWS credential chain is used: environment, shared config, then the IAM role
+// of the instance or task.
+func newS3Storage(ctx context.Context, settings s3Settings, prefix string) (*s3Storage, error) {
+	if settings.bucket == "" {
+		return nil, errors.New("S3_BUCKET is required for the s3 storage backend")
+	}
+	options := []func(*config.LoadOptions) error{config.WithRegion(settings.region)}
+	if settings.accessKeyID != "" {
+		options = append(options, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(settings.accessKeyID, settings.secretAccessKey, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if settings.endpoint != "" {
+			o.BaseEndpoint = aws.String(settings.endpoint)
+		}
+		o.UsePathStyle = settings.forcePathStyle
+		o.APIOptions = append(o.APIOptions, s3TraceContext)
+	})
+	return &s3Storage{client: client, bucket: settings.bucket, prefix: settings.prefix + prefix}, nil
+}
+
+func (s *s3Storage) key(name string) (string, error) {
+	if !validObjectName(name) {
+		return "", errInvalidName
+	}
+	return s.prefix + name, nil
+}
+
+// s3NotFound maps the missing-object errors of GetObject and HeadObject to
+// ErrNotFound.
+func s3NotFound(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound") {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// PutObject needs the length up front, so the stream is spooled to a
+	// temporary file first; an object is never left half-written in the bucket.
+	spool, err := os.CreateTemp("", "s3-put-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          spool,
+		ContentLength: aws.Int64(size),
+	}
+	if contentType := getMimeType(name); contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: size, ModTime: time.Now()}, nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, ObjectInfo{}, s3NotFound(err)
+	}
+	info := ObjectInfo{Name: name, Size: aws.ToInt64(out.ContentLength), ModTime: aws.ToTime(out.LastModified)}
+	return newRangedObject(out.Body, info.Size, func(offset int64) (io.ReadCloser, error) {
+		out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.Body, nil
+	}), info, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	// DeleteObject succeeds for missing keys, so check first to report them.
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	return err
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return ObjectInfo{}, s3NotFound(err)
+	}
+	return ObjectInfo{Name: name, Size: aws.ToInt64(out.ContentLength), ModTime: aws.ToTime(out.LastModified)}, nil
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Name:    strings.TrimPrefix(aws.ToString(object.Key), s.prefix),
+				Size:    aws.ToInt64(object.Size),
+				ModTime: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// secretsRefresh is how often secrets read from files or secret managers are
+// read again, so rotating them needs no restart. 0 reads them once.
+var secretsRefresh time.Duration
+
+// Credentials checked on every request, which follow rotation.
+var (
+	secretKey        = &secret{name: "SECRET_KEY"}
+	apiKey           = &secret{name: "API_KEY"}
+	emailIngestToken = &secret{name: "EMAIL_INGEST_TOKEN"}
+
+	rotatingSecrets = []*secret{secretKey, apiKey, emailIngestToken}
+)
+
+// secretsClient fetches secrets from Vault and AWS Secrets Manager.
+var secretsClient = &http.Client{Timeout: 10 * time.Second}
+
+// secret is a credential that can change while the server runs.
+type secret struct {
+	name     string // of its environment variable
+	value    atomic.Pointer[string]
+	external bool // read from a file or secret manager rather than the environment
+}
+
+// Get returns the current value, empty when the secret isn't set.
+func (s *secret) Get() string {
+	if value := s.value.Load(); value != nil {
+		return *value
+	}
+	return ""
+}
+
+// load reads the secret from its source.
+func (s *secret) load() error {
+	value, external, err := readSecret(s.name)
+	if err != nil {
+		return err
+	}
+	s.value.Store(&value)
+	s.external = external
+	return nil
+}
+
+// readSecret reads the secret setting key. KEY_FILE names a file holding it,
+// such as a Docker or Kubernetes secret mount. Otherwise KEY holds the value,
+// or a reference to a secret manager:
+//
+//	vault:<path>[#<field>]          a Vault KV secret, field "value" by default
+//	aws-sm:<secret id>[#<json key>] an AWS Secrets Manager secret
+//
+// external reports whether the value came from a file or secret manager.
+func readSecret(key string) (value string, external bool, err error) {
+	file, ref := os.Getenv(key+"_FILE"), os.Getenv(key)
+	source := ""
+	switch {
+	case file != "" && ref != "":
+		return "", false, fmt.Errorf("%s and %s_FILE are mutually exclusive", key, key)
+	case file != "":
+		var data []byte
+		if data, err = os.ReadFile(file); err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %w", key, err)
+		}
+		value, source = strings.TrimRight(string(data), "\r\n"), "file "+file
+	case strings.HasPrefix(ref, "vault:"):
+		path, field := splitSecretRef(strings.TrimPrefix(ref, "vault:"))
+		value, err = readVaultSecret(path, field)
+		source = "vault " + path
+	case strings.HasPrefix(ref, "aws-sm:"):
+		id, field := splitSecretRef(strings.TrimPrefix(ref, "aws-sm:"))
+		value, err = readAWSSecret(id, field)
+		source = "secrets manager " + id
+	default:
+		recordSecret(key, ref, "")
+		return ref, false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", key, err)
+	}
+	recordSecret(key, value, source)
+	return value, true, nil
+}
+
+func splitSecretRef(ref string) (name, field string) {
+	name, field, _ = strings.Cut(ref, "#")
+	return name, field
+}
+
+// readVaultSecret reads field of the Vault secret at path, a KV version 2
+// data path such as secret/data/image-server or a version 1 path. The token
+// is VAULT_TOKEN, or the contents of VAULT_TOKEN_FILE as written by a Vault
+// agent, read anew each time.
+func readVaultSecret(path, field string) (string, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is required for vault: secrets")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if file := os.Getenv("VAULT_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if field == "" {
+		field = "value"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	body, err := fetchSecret(req)
+	if err != nil {
+		return "", fmt.Errorf("vault %s: %w", path, err)
+	}
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("vault %s: %w", path, err)
+	}
+	// KV version 2 nests the fields under data.data.
+	fields := secret.Data
+	if nested, ok := fields["data"]; ok {
+		fields = nil
+		json.Unmarshal(nested, &fields)
+	}
+	var value string
+	if err := json.Unmarshal(fields[field], &value); err != nil {
+		return "", fmt.Errorf("vault %s: no string field %q", path, field)
+	}
+	return value, nil
+}
+
+// awsConfig loads the AWS region and credentials once, from the same default
+// chain as the S3 backend.
+var awsConfig = sync.OnceValues(func() (aws.Config, error) {
+	return config.LoadDefaultConfig(context.Background())
+})
+
+// readAWSSecret reads the secret string of id, an ARN or name, from AWS
+// Secrets Manager. With field, the secret string is a JSON object and field
+// one of its keys. AWS_ENDPOINT_URL_SECRETS_MANAGER overrides the endpoint.
+func readAWSSecret(id, field string) (string, error) {
+	cfg, err := awsConfig()
+	if err != nil {
+		return "", err
+	}
+	region := cfg.Region
+	if arn := strings.Split(id, ":"); len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+	if region == "" {
+		return "", errors.New("AWS_REGION is required for aws-sm: secrets")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	payload, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	ctx, cancel := context.WithTimeout(context.Background(), secretsClient.Timeout)
+	defer cancel()
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("aws credentials: %w", err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(hash[:]), "secretsmanager", region, time.Now()); err != nil {
+		return "", err
+	}
+	body, err := fetchSecret(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("secrets manager %s: %w", id, err)
+	}
+	var secret struct {
+		SecretString *string
+	}
+	if err := json.Unmarshal(body, &secret); err != nil || secret.SecretString == nil {
+		return "", fmt.Errorf("secrets manager %s: no secret string", id)
+	}
+	if field == "" {
+		return *secret.SecretString, nil
+	}
+	var fields map[string]any
+	json.Unmarshal([]byte(*secret.SecretString), &fields)
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secrets manager %s: no string key %q", id, field)
+	}
+	return value, nil
+}
+
+// fetchSecret performs a secret manager request and returns the body of a
+// successful response.
+func fetchSecret(req *http.Request) ([]byte, error) {
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return body, nil
+}
+
+// refreshSecrets reads the external rotating secrets again every interval.
+// A secret that fails to read, or reads empty, keeps its previous value.
+func refreshSecrets(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, s := range rotatingSecrets {
+			if !s.external {
+				continue
+			}
+			value, _, err := readSecret(s.name)
+			if err == nil && value == "" {
+				err = errors.New("empty value")
+			}
+			if err != nil {
+				logger.Warn("failed to refresh secret, keeping the previous value", "secret", s.name, "error", err)
+				continue
+			}
+			if value != s.Get() {
+				s.value.Store(&value)
+				logger.Info("secret rotated", "secret", s.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceMode makes the public API read-only: uploads, updates and
+// deletes answer 503 while reads keep working.
+var maintenanceMode atomic.Bool
+
+// settingsMu serializes updates, so the settings in effect always match
+// those persisted.
+var settingsMu sync.Mutex
+
+// runtimeSettings are the settings that can change without a restart.
+// Fields missing from an update are left unchanged.
+type runtimeSettings struct {
+	loggingSettings
+	MaintenanceMode     *bool  `json:"maintenance_mode"`
+	TarpitThreshold     *int64 `json:"tarpit_threshold"`
+	TarpitBanThreshold  *int64 `json:"tarpit_ban_threshold"`
+	TarpitBanSeconds    *int64 `json:"tarpit_ban_seconds"`
+	TarpitWindowSeconds *int64 `json:"tarpit_window_seconds"`
+	CanonicalRedirects  *bool  `json:"canonical_redirects"`
+	ResponseCompression *bool  `json:"response_compression"`
+	AutoOrient          *bool  `json:"auto_orient"`
+	StripExif           *bool  `json:"strip_exif"`
+	OneTimeURLs         *bool  `json:"one_time_urls"`
+}
+
+func currentRuntimeSettings() runtimeSettings {
+	maintenance := maintenanceMode.Load()
+	threshold, banThreshold := guard.threshold.Load(), guard.banThreshold.Load()
+	banSeconds := int64(time.Duration(guard.banDuration.Load()) / time.Second)
+	windowSeconds := int64(time.Duration(guard.window.Load()) / time.Second)
+	redirects, compression, orient := canonicalRedirects.Load(), responseCompression.Load(), autoOrient.Load()
+	strip, oneTime := stripExif.Load(), oneTimeURLs.Load()
+	return runtimeSettings{
+		loggingSettings:     currentLoggingSettings(),
+		MaintenanceMode:     &maintenance,
+		TarpitThreshold:     &threshold,
+		TarpitBanThreshold:  &banThreshold,
+		TarpitBanSeconds:    &banSeconds,
+		TarpitWindowSeconds: &windowSeconds,
+		CanonicalRedirects:  &redirects,
+		ResponseCompression: &compression,
+		AutoOrient:          &orient,
+		StripExif:           &strip,
+		OneTimeURLs:         &oneTime,
+	}
+}
+
+// applyRuntimeSettings validates s and then updates whichever settings are
+// present in it, so an invalid update changes nothing.
+func applyRuntimeSettings(s runtimeSettings) error {
+	if s.TarpitThreshold != nil && *s.TarpitThreshold < 0 || s.TarpitBanThreshold != nil && *s.TarpitBanThreshold < 0 {
+		return errors.New("tarpit thresholds must not be negative")
+	}
+	if s.TarpitBanSeconds != nil && *s.TarpitBanSeconds <= 0 || s.TarpitWindowSeconds != nil && *s.TarpitWindowSeconds <= 0 {
+		return errors.New("tarpit durations must be positive")
+	}
+	var level slog.Level
+	if s.Level != "" && level.UnmarshalText([]byte(strings.ToUpper(s.Level))) != nil {
+		return errors.New("invalid log level")
+	}
+	if err := applyLoggingSettings(s.loggingSettings); err != nil {
+		return err
+	}
+	for _, flag := range []struct {
+		value  *bool
+		target *atomic.Bool
+	}{
+		{s.MaintenanceMode, &maintenanceMode},
+		{s.CanonicalRedirects, &canonicalRedirects},
+		{s.ResponseCompression, &responseCompression},
+		{s.AutoOrient, &autoOrient},
+		{s.StripExif, &stripExif},
+		{s.OneTimeURLs, &oneTimeURLs},
+	} {
+		if flag.value == nil {
+			continue
+		}
+		// Conversions rendered from now on differ from those served before.
+		if flag.target.Swap(*flag.value) != *flag.value && flag.target == &autoOrient {
+			transformConfigTime.Store(time.Now().UnixNano())
+		}
+	}
+	if s.TarpitThreshold != nil {
+		guard.threshold.Store(*s.TarpitThreshold)
+	}
+	if s.TarpitBanThreshold != nil {
+		guard.banThreshold.Store(*s.TarpitBanThreshold)
+	}
+	if s.TarpitBanSeconds != nil {
+		guard.banDuration.Store(int64(time.Duration(*s.TarpitBanSeconds) * time.Second))
+	}
+	if s.TarpitWindowSeconds != nil {
+		guard.window.Store(int64(time.Duration(*s.TarpitWindowSeconds) * time.Second))
+	}
+	return nil
+}
+
+// settingsRefresh is how often the settings persisted in the metadata store
+// are read again, so a change made through another instance takes effect
+// here too (SETTINGS_REFRESH_SECONDS). 0 only reads them at startup.
+var settingsRefresh time.Duration
+
+// storedSettings returns the settings persisted in the metadata store. Only
+// settings changed through the API are stored; the others are left unset.
+func (m *metadataStore) storedSettings(ctx context.Context) (runtimeSettings, error) {
+	var s runtimeSettings
+	rows, err := m.db.QueryContext(ctx, "SELECT name, value FROM settings")
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	fields := map[string]json.RawMessage{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return s, err
+		}
+		fields[name] = json.RawMessage(value)
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal(data, &s)
+}
+
+// storeSettings persists the fields set in update, each as a row of its
+// own, so concurrent updates of different settings don't undo each other.
+func (m *metadataStore) storeSettings(ctx context.Context, update runtimeSettings) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixMilli()
+	for _, name := range sortedKeys(fields) {
+		if value := string(fields[name]); value == "null" || value == `""` {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.rebind(`
+			INSERT INTO settings (name, value, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`),
+			name, string(fields[name]), now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadStoredSettings applies the settings persisted in the metadata store
+// on top of the environment's, reporting whether any changed.
+func loadStoredSettings(ctx context.Context) (bool, error) {
+	if imageMetadata == nil {
+		return false, nil
+	}
+	s, err := imageMetadata.storedSettings(ctx)
+	if err != nil {
+		return false, err
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	before := currentRuntimeSettings()
+	if err := applyRuntimeSettings(s); err != nil {
+		return false, err
+	}
+	return !reflect.DeepEqual(before, currentRuntimeSettings()), nil
+}
+
+// refreshSettings picks up the settings other instances persisted.
+func refreshSettings(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := loadStoredSettings(context.Background())
+		if err != nil {
+			logger.Warn("failed to refresh runtime settings", "error", err)
+			continue
+		}
+		if changed {
+			logger.Info("runtime settings changed in the metadata store")
+		}
+	}
+}
+
+// MaintenanceMiddleware refuses changes to stored files while maintenance
+// mode is on. The admin API stays available so it can be switched off.
+func MaintenanceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if maintenanceMode.Load() && !strings.HasPrefix(routePath(c.Request.URL.Path), "/admin/") {
+				c.Header("Retry-After", "60")
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is in maintenance mode"})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func getRuntimeSettings(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, currentRuntimeSettings())
+}
+
+func updateRuntimeSettings(c *gin.Context) {
+	var settings runtimeSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid settings."})
+		return
+	}
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	if err := applyRuntimeSettings(settings); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	current := currentRuntimeSettings()
+	logger.Info("runtime settings changed", "user", c.GetString("adminUser"),
+		"level", current.Level,
+		"maintenance_mode", *current.MaintenanceMode,
+		"tarpit_threshold", *current.TarpitThreshold,
+		"tarpit_ban_threshold", *current.TarpitBanThreshold,
+		"tarpit_ban_seconds", *current.TarpitBanSeconds,
+		"tarpit_window_seconds", *current.TarpitWindowSeconds,
+		"canonical_redirects", *current.CanonicalRedirects,
+		"response_compression", *current.ResponseCompression,
+		"auto_orient", *current.AutoOrient,
+		"strip_exif", *current.StripExif,
+		"one_time_urls", *current.OneTimeURLs)
+	if imageMetadata != nil {
+		if err := imageMetadata.storeSettings(c.Request.Context(), settings); err != nil {
+			logger.Error("failed to persist settings", "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Settings applied but not persisted."})
+			return
+		}
+	}
+	c.IndentedJSON(http.StatusOK, current)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cookie names used for signed-cookie access to a path prefix.
+const (
+	policyPrefixCookie    = "Image-Policy-Prefix"
+	policyExpiresCookie   = "Image-Policy-Expires"
+	policySignatureCookie = "Image-Policy-Signature"
+)
+
+// sign returns the hex-encoded HMAC-SHA256 of data using the server secret.
+func sign(data string) string {
+	h := hmac.New(sha256.New, []byte(secretKey.Get()))
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseExpires parses a Unix timestamp and reports whether it is valid and
+// still in the future.
+func parseExpires(expireStr string) (int64, bool) {
+	expires, err := strconv.ParseInt(expireStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+	return expires, true
+}
+
+// signingNamespace scopes signatures of a route family: the signed filename
+// becomes "<namespace>/<filename>", so a URL signed for one family cannot be
+// replayed against another.
+func signingNamespace(namespace string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("signingNamespace", namespace)
+		c.Next()
+	}
+}
+
+// publicPath returns the path clients use to reach route path p: p under
+// ROUTE_PREFIX and under the path of PUBLIC_BASE_URL, for proxies that
+// strip a prefix before forwarding.
+func publicPath(p string) string {
+	base := ""
+	if u, err := url.Parse(publicBaseURL); err == nil {
+		base = u.Path
+	}
+	return base + routePrefix + p
+}
+
+// routePath strips ROUTE_PREFIX from a request path, so signed path
+// prefixes read the same wherever the server is mounted.
+func routePath(p string) string {
+	return strings.TrimPrefix(p, routePrefix)
+}
+
+// requestOrigin is the scheme and host a host-bound signature covers: the
+// origin of PUBLIC_BASE_URL when set, so proxies can't change it, or else
+// the one the request was made to.
+func requestOrigin(c *gin.Context) string {
+	if u, err := url.Parse(publicBaseURL); err == nil && u.Host != "" {
+		return u.Scheme + "://" + strings.ToLower(u.Host)
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || fromTrustedProxy(c) && c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + strings.ToLower(c.Request.Host)
+}
+
+// fromTrustedProxy reports whether c came straight from one of
+// TRUSTED_PROXIES, whose forwarding headers can be believed.
+func fromTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	for _, network := range trustedProxyNets {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostBinding returns the payload suffix and query parameter that bind a
+// signature issued by the server to the request's origin, or nothing when
+// REQUIRE_HOST_BINDING is off.
+func hostBinding(c *gin.Context) (data, query string) {
+	if !requireHostBinding {
+		return "", ""
+	}
+	return signedField("host", requestOrigin(c)), "&host=1"
+}
+
+// signedField encodes an optional field of a signed payload as
+// ":key=<length>:value". The byte length makes the encoding unambiguous:
+// no value, whatever it holds, can pass for another field, so a parameter
+// can't be dropped from a URL by smuggling it into another one.
+func signedField(key, value string) string {
+	return ":" + key + "=" + strconv.Itoa(len(value)) + ":" + value
+}
+
+// signedParams are the query parameters a URL signature depends on. Each
+// may appear once: the signature is checked against the first value, and
+// handlers mustn't act on another.
+var signedParams = []string{"v", "methods", "expires", "signature", "max_size", "nonce", "host", "recipient"}
+
+// signedGetURL returns the absolute URL of route path under
+// PUBLIC_BASE_URL, signed for GET access to filename until expires.
+// Sub-paths such as thumbnails share the signature of the file they belong
+// to.
+func signedGetURL(c *gin.Context, namespace, path, filename string, expires int64) string {
+	if namespace != "" {
+		filename = namespace + "/" + filename
+	}
+	hostData, hostQuery := hostBinding(c)
+	signature := sign(fmt.Sprintf("%s:%s:%d", http.MethodGet, filename, expires) + hostData)
+	return fmt.Sprintf("%s%s%s?expires=%d%s&signature=%s", publicBaseURL, routePrefix, path, expires, hostQuery, signature)
+}
+
+// HostMiddleware rejects requests whose Host header isn't one of
+// ALLOWED_HOSTS, so host-bound signatures can't be satisfied by sending
+// another deployment's hostname. An empty list allows every host.
+func HostMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(allowedHosts) == 0 {
+			c.Next()
+			return
+		}
+		host := strings.ToLower(c.Request.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !slices.Contains(allowedHosts, host) && !slices.Contains(allowedHosts, strings.ToLower(c.Request.Host)) {
+			c.JSON(http.StatusMisdirectedRequest, gin.H{"error": "Unknown host"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// validateUrl checks the signature of c's URL for its method. HEAD
+// discloses less than GET, so URLs signed for GET allow it as well.
+func validateUrl(c *gin.Context) bool {
+	return validateUrlFor(c, c.Request.Method) ||
+		c.Request.Method == http.MethodHead && validateUrlFor(c, http.MethodGet)
+}
+
+func validateUrlFor(c *gin.Context, method string) bool {
+	query := c.Request.URL.Query()
+	for _, param := range signedParams {
+		if len(query[param]) > 1 {
+			return false
+		}
+	}
+	filename := c.Param("filename")
+	// Stored names never hold a colon, and one could shift the expiry and
+	// the fields of a payload into the filename.
+	if strings.Contains(filename, ":") {
+		return false
+	}
+	if namespace := c.GetString("signingNamespace"); namespace != "" {
+		filename = namespace + "/" + filename
+	}
+	expireStr := c.Query("expires")
+	signature := c.Query("signature")
+
+	if expireStr == "" || signature == "" {
+		return false
+	}
+
+	expires, ok := parseExpires(expireStr)
+	if !ok {
+		return false
+	}
+
+	var data string
+	switch c.Query("v") {
+	case "", "1":
+		// For POST requests without filename, use empty string
+		data = fmt.Sprintf("%s:%s:%d", method, filename, expires)
+	case "2":
+		// v2 signs a comma-separated method scope instead of a single method
+		methods := c.Query("methods")
+		if !methodInScope(methods, method) {
+			return false
+		}
+		data = fmt.Sprintf("v2:%s:%s:%d", methods, filename, expires)
+	default:
+		return false
+	}
+	if maxSize := c.Query("max_size"); maxSize != "" {
+		if n, err := strconv.ParseInt(maxSize, 10, 64); err != nil || n < 0 || strconv.FormatInt(n, 10) != maxSize {
+			return false
+		}
+		data += signedField("max_size", maxSize)
+	}
+	if nonce := c.Query("nonce"); nonce != "" {
+		data += signedField("nonce", nonce)
+	}
+	switch c.Query("host") {
+	case "1":
+		data += signedField("host", requestOrigin(c))
+	case "":
+		if requireHostBinding {
+			return false
+		}
+	default:
+		return false
+	}
+	if recipient := c.Query("recipient"); recipient != "" {
+		data += signedField("recipient", recipient)
+	}
+	expectedsignature := sign(data)
+
+	return hmac.Equal([]byte(signature), []byte(expectedsignature))
+}
+
+// methodInScope reports whether method is listed in a v2 method scope such as
+// "GET,HEAD". The wildcard scope "*" allows every method.
+func methodInScope(scope, method string) bool {
+	for _, m := range strings.Split(scope, ",") {
+		if m == "*" || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCookies checks CloudFront-style signed cookies granting read access
+// to every path under a prefix, so galleries don't need one signature per image.
+func validateCookies(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+
+	prefix, err := c.Cookie(policyPrefixCookie)
+	if err != nil || prefix == "" {
+		return false
+	}
+	expireStr, err := c.Cookie(policyExpiresCookie)
+	if err != nil {
+		return false
+	}
+	expires, ok := parseExpires(expireStr)
+	if !ok {
+		return false
+	}
+	signature, err := c.Cookie(policySignatureCookie)
+	if err != nil {
+		return false
+	}
+
+	if !strings.HasPrefix(routePath(c.Request.URL.Path), prefix) {
+		return false
+	}
+
+	data := fmt.Sprintf("COOKIE:%s:%d", prefix, expires)
+	return hmac.Equal([]byte(signature), []byte(sign(data)))
+}
+
+// SignedOrAdminMiddleware admits unsigned requests carrying an admin bearer
+// token and checks the signature of the others. Admin tokens are only
+// accepted where the admin API is served, so ADMIN_ADDR keeps them off the
+// public listener.
+func SignedOrAdminMiddleware() gin.HandlerFunc {
+	signed := SignedURLMiddleware()
+	return func(c *gin.Context) {
+		bearer := strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !bearer || c.Query("signature") != "" || len(adminUsers) == 0 || adminAddr != "" {
+			signed(c)
+			return
+		}
+		if !authenticateAdmin(c) {
+			auditDenial(c, "", 0, "invalid token")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func SignedURLMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Vanity-host presets are public by design.
+		if c.GetBool("vanityPreset") {
+			c.Next()
+			return
+		}
+		if remaining, banned := guard.banned(c.ClientIP()); banned {
+			c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid signatures"})
+			c.Abort()
+			return
+		}
+
+		var valid bool
+		if c.Query("signature") != "" {
+			valid = validateUrl(c)
+		} else {
+			// Cookies don't sign the query, and an unsigned recipient would
+			// let the holder trace a copy to someone else.
+			valid = validateCookies(c) && c.Query("recipient") == ""
+		}
+
+		if !valid {
+			guard.sleep(c.Request.Context(), guard.fail(c.ClientIP()))
+			if !serveFallbackImage(c, http.StatusForbidden) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired URL"})
+			}
+			c.Abort()
+			return
+		}
+
+		if nonce := c.Query("nonce"); oneTimeURLs.Load() && nonce != "" {
+			expires, _ := parseExpires(c.Query("expires"))
+			if !replays.consume(nonce, expires, c.ClientIP(), c.Request.URL.Path) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "URL has already been used"})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useSecretKey(t *testing.T, key string) {
+	t.Helper()
+	previous := secretKey.value.Load()
+	secretKey.value.Store(&key)
+	t.Cleanup(func() { secretKey.value.Store(previous) })
+}
+
+// signedRequest returns a context for method on /images/filename with
+// query, as the route handlers see it.
+func signedRequest(method, filename, query string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(method, "http://img.example.com/images/"+filename+"?"+query, nil)
+	c.Params = gin.Params{{Key: "filename", Value: filename}}
+	return c
+}
+
+func TestSignedFieldLengthPrefixesValue(t *testing.T) {
+	for _, tc := range []struct {
+		key, value, want string
+	}{
+		{"nonce", "ab12", ":nonce=4:ab12"},
+		{"max_size", "1048576", ":max_size=7:1048576"},
+		{"recipient", "bob:host=x", ":recipient=10:bob:host=x"},
+		{"recipient", "é", ":recipient=2:é"},
+	} {
+		if got := signedField(tc.key, tc.value); got != tc.want {
+			t.Errorf("signedField(%q, %q) = %q, want %q", tc.key, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestValidateUrlFor(t *testing.T) {
+	useSecretKey(t, "test-secret")
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	base := "GET:a.jpg:" + expires
+	withNonce := sign(base + signedField("nonce", "n1"))
+	withSize := sign("POST::" + expires + signedField("max_size", "1024"))
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		filename string
+		query    string
+		want     bool
+	}{
+		{"plain", http.MethodGet, "a.jpg", "expires=" + expires + "&signature=" + sign(base), true},
+		{"other file", http.MethodGet, "b.jpg", "expires=" + expires + "&signature=" + sign(base), false},
+		{"other method", http.MethodDelete, "a.jpg", "expires=" + expires + "&signature=" + sign(base), false},
+		{"expired", http.MethodGet, "a.jpg", "expires=1&signature=" + sign("GET:a.jpg:1"), false},
+		{"nonce", http.MethodGet, "a.jpg", "expires=" + expires + "&nonce=n1&signature=" + withNonce, true},
+		{"nonce dropped", http.MethodGet, "a.jpg", "expires=" + expires + "&signature=" + withNonce, false},
+		{"nonce moved into max_size", http.MethodGet, "a.jpg", "expires=" + expires + "&max_size=nonce%3D2%3An1&signature=" + withNonce, false},
+		{"nonce repeated", http.MethodGet, "a.jpg", "expires=" + expires + "&nonce=n1&nonce=n2&signature=" + withNonce, false},
+		{"max_size", http.MethodPost, "", "expires=" + expires + "&max_size=1024&signature=" + withSize, true},
+		{"max_size with sign", http.MethodPost, "", "expires=" + expires + "&max_size=%2B1024&signature=" + withSize, false},
+		{"max_size with zeros", http.MethodPost, "", "expires=" + expires + "&max_size=01024&signature=" + withSize, false},
+		{"colon in filename", http.MethodGet, "a.jpg:" + expires, "expires=1&signature=" + sign(base+":1"), false},
+		{"unknown host flag", http.MethodGet, "a.jpg", "expires=" + expires + "&host=2&signature=" + sign(base), false},
+	} {
+		c := signedRequest(tc.method, tc.filename, tc.query)
+		if got := validateUrlFor(c, tc.method); got != tc.want {
+			t.Errorf("%s: validateUrlFor = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateUrlForRecipient(t *testing.T) {
+	useSecretKey(t, "test-secret")
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	signature := sign("GET:a.jpg:" + expires + signedField("recipient", "bob"))
+	for _, tc := range []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{"recipient", "recipient=bob", true},
+		{"other recipient", "recipient=eve", false},
+		{"recipient dropped", "", false},
+		{"recipient moved into max_size", "max_size=recipient%3D3%3Abob", false},
+		{"recipient moved into nonce", "nonce=x%3Arecipient%3D3%3Abob", false},
+		{"recipient repeated", "recipient=bob&recipient=eve", false},
+	} {
+		c := signedRequest(http.MethodGet, "a.jpg", tc.query+"&expires="+expires+"&signature="+signature)
+		if got := validateUrlFor(c, http.MethodGet); got != tc.want {
+			t.Errorf("%s: validateUrlFor = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateUrlForHost(t *testing.T) {
+	useSecretKey(t, "test-secret")
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	signature := sign("GET:a.jpg:" + expires + signedField("host", "http://img.example.com"))
+	for _, tc := range []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{"host", "host=1", true},
+		{"host dropped", "", false},
+		{"host moved into max_size", "max_size=host%3D22%3Ahttp%3A%2F%2Fimg.example.com", false},
+		{"host moved into nonce", "nonce=x%3Ahost%3D22%3Ahttp%3A%2F%2Fimg.example.com", false},
+	} {
+		c := signedRequest(http.MethodGet, "a.jpg", tc.query+"&expires="+expires+"&signature="+signature)
+		if got := validateUrlFor(c, http.MethodGet); got != tc.want {
+			t.Errorf("%s: validateUrlFor = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequestOriginTrustsForwardedProtoFromProxiesOnly(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxyNets = []*net.IPNet{proxies}
+	t.Cleanup(func() { trustedProxyNets = nil })
+	for _, tc := range []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"10.1.2.3:4000", "https://img.example.com"},
+		{"192.0.2.1:4000", "http://img.example.com"},
+	} {
+		c := signedRequest(http.MethodGet, "a.jpg", "")
+		c.Request.RemoteAddr = tc.remoteAddr
+		c.Request.Header.Set("X-Forwarded-Proto", "https")
+		if got := requestOrigin(c); got != tc.want {
+			t.Errorf("requestOrigin from %s = %q, want %q", tc.remoteAddr, got, tc.want)
+		}
+	}
+}
+
+func TestValidateUrlForScopes(t *testing.T) {
+	useSecretKey(t, "test-secret")
+	expires := time.Now().Add(time.Hour).Unix()
+	signature := sign(fmt.Sprintf("v2:GET,HEAD:a.jpg:%d", expires))
+	for _, tc := range []struct {
+		method string
+		want   bool
+	}{
+		{http.MethodGet, true},
+		{http.MethodHead, true},
+		{http.MethodPut, false},
+	} {
+		c := signedRequest(tc.method, "a.jpg", fmt.Sprintf("v=2&methods=GET,HEAD&expires=%d&signature=%s", expires, signature))
+		if got := validateUrlFor(c, tc.method); got != tc.want {
+			t.Errorf("%s: validateUrlFor = %v, want %v", tc.method, got, tc.want)
+		}
+	}
+}
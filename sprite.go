@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// spritePadding separates packed images so bilinear sampling doesn't bleed.
+const spritePadding = 2
+
+type spriteRequest struct {
+	Images []string `json:"images" binding:"required,min=1"`
+}
+
+type spriteRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+var cssClassUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// spriteKey identifies a sprite by its members and their current versions,
+// so a changed member produces a new sheet.
+func spriteKey(members []ObjectInfo) string {
+	h := sha256.New()
+	for _, info := range members {
+		fmt.Fprintf(h, "%s:%d:%d\n", info.Name, info.Size, info.ModTime.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// packSprite arranges images on shelves no wider than maxWidth.
+func packSprite(names []string, images map[string]image.Image, maxWidth int) (*image.RGBA, map[string]spriteRect) {
+	order := append([]string(nil), names...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return images[order[i]].Bounds().Dy() > images[order[j]].Bounds().Dy()
+	})
+
+	rects := make(map[string]spriteRect, len(order))
+	x, y, shelf, width := 0, 0, 0, 0
+	for _, name := range order {
+		b := images[name].Bounds()
+		if x > 0 && x+b.Dx() > maxWidth {
+			x, y, shelf = 0, y+shelf+spritePadding, 0
+		}
+		rects[name] = spriteRect{X: x, Y: y, W: b.Dx(), H: b.Dy()}
+		x += b.Dx() + spritePadding
+		shelf = max(shelf, b.Dy())
+		width = max(width, x-spritePadding)
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, width, y+shelf))
+	for name, r := range rects {
+		img := images[name]
+		draw.Draw(sheet, image.Rect(r.X, r.Y, r.X+r.W, r.Y+r.H), img, img.Bounds().Min, draw.Src)
+	}
+	return sheet, rects
+}
+
+func spriteCSS(spriteURL string, names []string, rects map[string]spriteRect) []byte {
+	var buf bytes.Buffer
+	for _, name := range names {
+		r := rects[name]
+		class := cssClassUnsafe.ReplaceAllString(strings.TrimSuffix(name, filepath.Ext(name)), "-")
+		fmt.Fprintf(&buf, ".sprite-%s { background: url(%s) -%dpx -%dpx; width: %dpx; height: %dpx; }\n",
+			class, spriteURL, r.X, r.Y, r.W, r.H)
+	}
+	return buf.Bytes()
+}
+
+// createSprite packs stored images into one sheet plus a JSON and CSS
+// coordinate map. Results are cached as derived artifacts in the store and
+// reused while the member images are unchanged.
+func (s *fileStore) createSprite(c *gin.Context) {
+	var req spriteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "A list of images is required."})
+		return
+	}
+
+	ctx := c.Request.Context()
+	members := make([]ObjectInfo, len(req.Images))
+	for i, name := range req.Images {
+		info, _, err := s.stat(ctx, name)
+		if err != nil {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+			return
+		}
+		members[i] = info
+	}
+	key := spriteKey(members)
+
+	base := "sprite-" + key
+	spriteURL := publicPath(s.route + "/" + base + ".png")
+	response := gin.H{
+		"sprite": spriteURL,
+		"map":    publicPath(s.route + "/" + base + ".json"),
+		"css":    publicPath(s.route + "/" + base + ".css"),
+	}
+
+	if body, _, err := s.storage.Get(ctx, base+".json"); err == nil {
+		var rects map[string]spriteRect
+		err := json.NewDecoder(body).Decode(&rects)
+		body.Close()
+		if err == nil {
+			response["images"] = rects
+			c.IndentedJSON(http.StatusOK, response)
+			return
+		}
+	}
+
+	images := make(map[string]image.Image, len(req.Images))
+	for _, name := range req.Images {
+		img, _, err := s.decode(ctx, name)
+		if err != nil {
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Not a decodable image: " + name})
+			return
+		}
+		images[name] = img
+	}
+
+	sheet, rects := packSprite(req.Images, images, spriteMaxWidth)
+	sheetData, err := encodePNG(sheet)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate sprite."})
+		return
+	}
+	mapData, _ := json.MarshalIndent(rects, "", "  ")
+
+	// The map is written last: its presence marks a complete cached sprite.
+	for _, artifact := range []struct {
+		name string
+		data []byte
+	}{
+		{base + ".png", sheetData},
+		{base + ".css", spriteCSS(spriteURL, req.Images, rects)},
+		{base + ".json", mapData},
+	} {
+		if _, err := s.storage.Put(ctx, artifact.name, bytes.NewReader(artifact.data)); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to save file."})
+			return
+		}
+	}
+
+	response["images"] = rects
+	c.IndentedJSON(http.StatusOK, response)
+}
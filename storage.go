@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by a Storage when the named object doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// errInvalidName rejects object names that would escape the storage root
+// or name a directory rather than an object.
+var errInvalidName = errors.New("invalid object name")
+
+// validObjectName reports whether name names an object below the storage
+// root: it is relative, has no .. segment, and its last segment is neither
+// empty nor ".", so it can't be the root or a directory.
+func validObjectName(name string) bool {
+	last := path.Base("/" + name)
+	if name == "" || strings.HasSuffix(name, "/") || last == "." || last == "/" {
+		return false
+	}
+	return !strings.HasPrefix(name, "/") && !strings.Contains("/"+name+"/", "/../")
+}
+
+// isDerivedObject reports whether name is a thumbnail, version or other
+// object derived from an original, which live in dot-directories.
+func isDerivedObject(name string) bool {
+	return strings.Contains(name, "/") || strings.HasPrefix(name, ".")
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage holds the objects of a fileStore. Names are slash-separated and
+// relative to the storage root. Readers returned by Get that also implement
+// io.Seeker are served with range and conditional request support.
+type Storage interface {
+	// Put stores r under name, replacing any existing object atomically.
+	Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error)
+	Get(ctx context.Context, name string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, name string) error
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	// List returns the objects whose names start with prefix, sorted by name.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Storage backends selectable with STORAGE_BACKEND.
+const (
+	storageLocal = "local"
+	storageS3    = "s3"
+	storageAzure = "azure"
+)
+
+var (
+	storageBackend = storageLocal
+	s3Config       s3Settings
+	azureConfig    azureSettings
+
+	// imageStorage holds the objects served under /images. Ingestion paths
+	// (drop directory, email, import-dir) store into it as well.
+	imageStorage Storage
+)
+
+// openStorage returns the configured backend for one family of objects: dir
+// for the local backend, or keyPrefix below the configured prefix for S3 and
+// Azure. Remote backends get the per-operation timeouts.
+func openStorage(dir, keyPrefix string) (Storage, error) {
+	switch storageBackend {
+	case storageS3:
+		return withTimeouts(newS3Storage(context.Background(), s3Config, keyPrefix))
+	case storageAzure:
+		return withTimeouts(newAzureStorage(azureConfig, keyPrefix))
+	}
+	return newLocalStorage(dir), nil
+}
+
+// localStorage keeps objects as files under a directory.
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) *localStorage {
+	return &localStorage{dir: dir}
+}
+
+func (l *localStorage) path(name string) (string, error) {
+	if !validObjectName(name) || !fs.ValidPath(name) || strings.Contains(name, "\\") {
+		return "", errInvalidName
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(name)), nil
+}
+
+func objectInfo(name string, info os.FileInfo) ObjectInfo {
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}
+}
+
+func (l *localStorage) Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error) {
+	dst, err := l.path(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Write beside the destination and rename over it, so readers never see
+	// a partial object, and merged duplicates, which share one file through
+	// hard links, don't all change when one alias is replaced.
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Chmod(0644)
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return ObjectInfo{}, err
+	}
+	return l.Stat(ctx, name)
+}
+
+func (l *localStorage) Get(ctx context.Context, name string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, notFound(err)
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return file, objectInfo(name, info), nil
+}
+
+func (l *localStorage) Delete(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return notFound(err)
+	}
+	// Drop the parent directory of a nested name once it is empty; this
+	// fails harmlessly while other objects remain in it.
+	if dir := filepath.Dir(p); dir != filepath.Clean(l.dir) {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+func (l *localStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return objectInfo(name, info), nil
+}
+
+// List walks the directory tree. Dotfiles, such as temporary files of an
+// unfinished Put, are skipped, and so are dot-directories unless prefix
+// lies within one.
+func (l *localStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(l.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == l.dir {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(l.dir, p)
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(entry.Name(), ".") && p != l.dir {
+			if entry.IsDir() && strings.HasPrefix(prefix, name+"/") {
+				return nil
+			}
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, objectInfo(name, info))
+		return ctx.Err()
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, err
+}
+
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// rangedObject is the reader returned by remote backends. It supports seeking
+// by reopening the object from the new offset with a ranged read, so range
+// requests don't download the whole object.
+type rangedObject struct {
+	open   func(offset int64) (io.ReadCloser, error)
+	size   int64
+	offset int64
+
+	// body is the open response, positioned at bodyOffset.
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func newRangedObject(body io.ReadCloser, size int64, open func(offset int64) (io.ReadCloser, error)) *rangedObject {
+	return &rangedObject{open: open, size: size, body: body}
+}
+
+func (o *rangedObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyOffset != o.offset {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		body, err := o.open(o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.bodyOffset = body, o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	return n, err
+}
+
+func (o *rangedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative seek position")
+	}
+	// The open body is only replaced when a read needs another position, so
+	// seeking to the end to learn the size (as http.ServeContent does) is free.
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *rangedObject) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
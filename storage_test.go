@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoragePathRejectsRootAndDirectories(t *testing.T) {
+	l := newLocalStorage(t.TempDir())
+	for _, name := range []string{"", ".", "./", "a/.", "a/", "/a.jpg", "../a.jpg", "a/../../b.jpg", `a\b.jpg`} {
+		if _, err := l.path(name); !errors.Is(err, errInvalidName) {
+			t.Errorf("path(%q) = %v, want errInvalidName", name, err)
+		}
+	}
+	for _, name := range []string{"a.jpg", ".thumbs/a.jpg", "a/b.jpg"} {
+		if _, err := l.path(name); err != nil {
+			t.Errorf("path(%q) = %v, want no error", name, err)
+		}
+	}
+}
+
+func TestLocalStorageDeleteDotKeepsRoot(t *testing.T) {
+	dir := t.TempDir()
+	l := newLocalStorage(dir)
+	if err := l.Delete(t.Context(), "."); !errors.Is(err, errInvalidName) {
+		t.Fatalf("Delete(\".\") = %v, want errInvalidName", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("storage root removed: %v", err)
+	}
+}
+
+func TestTransformCachePurgeDotKeepsCache(t *testing.T) {
+	dir := t.TempDir()
+	cached := filepath.Join(dir, "a.jpg", "w=10")
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cached, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newTransformCache(dir, 1<<20).purge(".")
+	if _, err := os.Stat(cached); err != nil {
+		t.Fatalf("purge(\".\") removed the cache: %v", err)
+	}
+}
+
+func TestRemoteObjectNames(t *testing.T) {
+	for name, want := range map[string]bool{
+		"a.jpg": true, ".thumbs/a.jpg": true,
+		"": false, ".": false, "a/": false, "a/.": false, "/a.jpg": false, "a/../b.jpg": false,
+	} {
+		if got := validObjectName(name); got != want {
+			t.Errorf("validObjectName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
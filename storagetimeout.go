@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrStorageTimeout is wrapped by the errors of remote storage calls that
+// ran past their STORAGE_*_TIMEOUT_SECONDS.
+var ErrStorageTimeout = errors.New("storage call timed out")
+
+// Storage operations with their own timeout. Stat counts as a get.
+const (
+	storageOpPut    = "put"
+	storageOpGet    = "get"
+	storageOpDelete = "delete"
+	storageOpList   = "list"
+)
+
+// storageTimeouts bound the remote storage calls per operation; 0 leaves an
+// operation unbounded.
+var storageTimeouts = map[string]time.Duration{}
+
+var (
+	storageTimeoutsByOp = expvar.NewMap("storage_timeouts_by_operation")
+	storageErrorsByOp   = expvar.NewMap("storage_errors_by_operation")
+)
+
+// timeoutStorage applies the per-operation timeouts to a remote backend and
+// tells timeouts apart from other failures in errors, logs and metrics.
+type timeoutStorage struct {
+	backend Storage
+}
+
+// withTimeouts wraps backend when any operation has a timeout.
+func withTimeouts(backend Storage, err error) (Storage, error) {
+	if err != nil || len(storageTimeouts) == 0 {
+		return backend, err
+	}
+	return &timeoutStorage{backend: backend}, nil
+}
+
+// bound returns ctx limited by the timeout of op. The returned cancel stops
+// the timer; ctx ends with ErrStorageTimeout as its cause once it fires.
+func (t *timeoutStorage) bound(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	timeout := storageTimeouts[op]
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, timeout, ErrStorageTimeout)
+}
+
+// result classifies the error of one call. Missing objects aren't failures.
+func (t *timeoutStorage) result(ctx context.Context, op, name string, err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, errInvalidName) {
+		return err
+	}
+	if errors.Is(context.Cause(ctx), ErrStorageTimeout) {
+		storageTimeoutsByOp.Add(op, 1)
+		logger.Warn("storage call timed out", "operation", op, "name", name, "timeout", storageTimeouts[op])
+		return fmt.Errorf("%s %s after %s: %w", op, name, storageTimeouts[op], ErrStorageTimeout)
+	}
+	storageErrorsByOp.Add(op, 1)
+	logger.Error("storage call failed", "operation", op, "name", name, "error", err)
+	return err
+}
+
+func (t *timeoutStorage) Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error) {
+	ctx, cancel := t.bound(ctx, storageOpPut)
+	defer cancel()
+	info, err := t.backend.Put(ctx, name, r)
+	return info, t.result(ctx, storageOpPut, name, err)
+}
+
+// Get bounds the call until the object starts arriving; streaming the body
+// runs on without a deadline, so large objects aren't cut off mid-response.
+func (t *timeoutStorage) Get(ctx context.Context, name string) (io.ReadCloser, ObjectInfo, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() bool { return true }
+	if timeout := storageTimeouts[storageOpGet]; timeout > 0 {
+		stop = time.AfterFunc(timeout, func() { cancel(ErrStorageTimeout) }).Stop
+	}
+	body, info, err := t.backend.Get(ctx, name)
+	if !stop() && err == nil {
+		// The timer fired as the call returned.
+		body.Close()
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		defer cancel(nil)
+		return nil, info, t.result(ctx, storageOpGet, name, err)
+	}
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		return &cancelingSeeker{cancelingBody{body, cancel}, seeker}, info, nil
+	}
+	return &cancelingBody{body, cancel}, info, nil
+}
+
+func (t *timeoutStorage) Delete(ctx context.Context, name string) error {
+	ctx, cancel := t.bound(ctx, storageOpDelete)
+	defer cancel()
+	return t.result(ctx, storageOpDelete, name, t.backend.Delete(ctx, name))
+}
+
+func (t *timeoutStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	ctx, cancel := t.bound(ctx, storageOpGet)
+	defer cancel()
+	info, err := t.backend.Stat(ctx, name)
+	return info, t.result(ctx, storageOpGet, name, err)
+}
+
+func (t *timeoutStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	ctx, cancel := t.bound(ctx, storageOpList)
+	defer cancel()
+	objects, err := t.backend.List(ctx, prefix)
+	return objects, t.result(ctx, storageOpList, prefix, err)
+}
+
+// cancelingBody releases the context of a Get when its body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+// cancelingSeeker keeps the body seekable for range requests.
+type cancelingSeeker struct {
+	cancelingBody
+	seeker io.ReadSeeker
+}
+
+func (b *cancelingSeeker) Seek(offset int64, whence int) (int64, error) {
+	return b.seeker.Seek(offset, whence)
+}
+
+// storageFailed answers a failed storage call: 504 when it timed out,
+// otherwise 500 with message.
+func storageFailed(c *gin.Context, err error, message string) {
+	if errors.Is(err, ErrStorageTimeout) {
+		c.IndentedJSON(http.StatusGatewayTimeout, gin.H{"message": "Storage timed out."})
+		return
+	}
+	c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": message})
+}
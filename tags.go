@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tagsNamespace scopes the signatures of tag changes, so a URL removing
+// tags of an image can't delete the image itself.
+const tagsNamespace = "tags"
+
+// Bounds of the tags of one image, and of the tags one search may ask for.
+const (
+	maxTagLength = 64
+	maxImageTags = 32
+)
+
+// tagPattern is the form tags are stored in: lower case letters, digits
+// and a few separators, starting with a letter or digit.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]*$`)
+
+var errInvalidTag = fmt.Errorf("tags must be at most %d letters, digits, '.', '_', ':' or '-', starting with a letter or digit", maxTagLength)
+
+// parseTags reads tags given as repeated or comma-separated values, folding
+// case and dropping blanks and repeats, and returns them sorted.
+func parseTags(values []string) ([]string, error) {
+	tags := []string{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || slices.Contains(tags, tag) {
+				continue
+			}
+			if len(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+				return nil, errInvalidTag
+			}
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxImageTags {
+		return nil, fmt.Errorf("at most %d tags", maxImageTags)
+	}
+	slices.Sort(tags)
+	return tags, nil
+}
+
+// addTags attaches tags to filename, keeping the ones it has.
+func (m *metadataStore) addTags(ctx context.Context, filename string, tags []string) error {
+	if m == nil {
+		return errors.New("the metadata store is disabled")
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, m.rebind(
+			"INSERT INTO image_tags (filename, tag) VALUES (?, ?) ON CONFLICT (filename, tag) DO NOTHING"),
+			filename, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// removeTags detaches tags from filename.
+func (m *metadataStore) removeTags(ctx context.Context, filename string, tags []string) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, m.rebind("DELETE FROM image_tags WHERE filename = ? AND tag = ?"), filename, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// tags returns the tags of filename, sorted.
+func (m *metadataStore) tags(ctx context.Context, filename string) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, m.rebind("SELECT tag FROM image_tags WHERE filename = ? ORDER BY tag"), filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// taggable resolves the image of a tags request, answering for c when it
+// can't be tagged.
+func (s *fileStore) taggable(c *gin.Context) (string, bool) {
+	filename := c.Param("filename")
+	if s.metadata == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Tags need the metadata store."})
+		return "", false
+	}
+	_, readOnly, err := s.stat(c.Request.Context(), filename)
+	if readOnly {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "File is read-only."})
+		return "", false
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "File not found"})
+		return "", false
+	}
+	return filename, true
+}
+
+// respondTags answers with the tags filename has.
+func (s *fileStore) respondTags(c *gin.Context, filename string) {
+	tags, err := s.metadata.tags(c.Request.Context(), filename)
+	if err != nil {
+		logger.Error("tag lookup failed", "file", filename, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read tags."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"filename": filename, "tags": tags})
+}
+
+// listTags serves the tags of an image.
+func (s *fileStore) listTags(c *gin.Context) {
+	if filename, ok := s.taggable(c); ok {
+		s.respondTags(c, filename)
+	}
+}
+
+// tagImage attaches the tags of a JSON body such as {"tags": ["a", "b"]}
+// to an image, keeping the ones it has, and answers with all of them.
+func (s *fileStore) tagImage(c *gin.Context) {
+	var body struct {
+		Tags []string `json:"tags" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "A list of tags is required."})
+		return
+	}
+	tags, err := parseTags(body.Tags)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	filename, ok := s.taggable(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	existing, err := s.metadata.tags(ctx, filename)
+	if err != nil {
+		logger.Error("tag lookup failed", "file", filename, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to read tags."})
+		return
+	}
+	added := slices.DeleteFunc(tags, func(tag string) bool { return slices.Contains(existing, tag) })
+	if len(existing)+len(added) > maxImageTags {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("An image has at most %d tags.", maxImageTags)})
+		return
+	}
+	if err := s.metadata.addTags(ctx, filename, added); err != nil {
+		logger.Error("failed to tag image", "file", filename, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to save tags."})
+		return
+	}
+	s.respondTags(c, filename)
+}
+
+// untagImage detaches the tags given as ?tag=, repeated or comma-separated,
+// from an image and answers with the ones left. Tags it doesn't have are
+// ignored.
+func (s *fileStore) untagImage(c *gin.Context) {
+	tags, err := parseTags(c.QueryArray("tag"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if len(tags) == 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Name the tags to remove with ?tag=."})
+		return
+	}
+	filename, ok := s.taggable(c)
+	if !ok {
+		return
+	}
+	if err := s.metadata.removeTags(c.Request.Context(), filename, tags); err != nil {
+		logger.Error("failed to untag image", "file", filename, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to remove tags."})
+		return
+	}
+	s.respondTags(c, filename)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	invalidSignatures = expvar.NewInt("invalid_signatures_total")
+	tarpitDelays      = expvar.NewInt("tarpit_delays_total")
+	tarpitBans        = expvar.NewInt("tarpit_bans_total")
+)
+
+// maxTarpitDelay caps the per-request delay handed to a misbehaving client.
+const maxTarpitDelay = 10 * time.Second
+
+// tarpitSweepInterval is how often forgotten offenders are dropped.
+const tarpitSweepInterval = time.Minute
+
+type offender struct {
+	failures    int64
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// tarpit slows down and eventually bans clients that keep presenting invalid
+// signatures, which makes brute-forcing signatures impractical.
+type tarpit struct {
+	mu        sync.Mutex
+	offenders map[string]*offender
+
+	// The thresholds and durations can be changed at runtime through
+	// /admin/settings.
+	threshold    atomic.Int64
+	banThreshold atomic.Int64
+	banDuration  atomic.Int64 // a time.Duration
+	window       atomic.Int64 // a time.Duration
+	allowlist    []*net.IPNet
+}
+
+func newTarpit(threshold, banThreshold int64, banDuration, window time.Duration, allowlist string) *tarpit {
+	t := &tarpit{
+		offenders: make(map[string]*offender),
+	}
+	t.threshold.Store(threshold)
+	t.banThreshold.Store(banThreshold)
+	t.banDuration.Store(int64(banDuration))
+	t.window.Store(int64(window))
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			t.allowlist = append(t.allowlist, network)
+		}
+	}
+	return t
+}
+
+func (t *tarpit) enabled() bool {
+	return t.threshold.Load() > 0
+}
+
+func (t *tarpit) allowed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range t.allowlist {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// banned reports whether ip is currently banned and for how long.
+func (t *tarpit) banned(ip string) (time.Duration, bool) {
+	if !t.enabled() || t.allowed(ip) {
+		return 0, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	o, ok := t.offenders[ip]
+	if !ok {
+		return 0, false
+	}
+	remaining := time.Until(o.bannedUntil)
+	return remaining, remaining > 0
+}
+
+// fail records an invalid signature from ip and returns how long the
+// response should be delayed.
+func (t *tarpit) fail(ip string) time.Duration {
+	invalidSignatures.Add(1)
+	if !t.enabled() || t.allowed(ip) {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	o, ok := t.offenders[ip]
+	if !ok || t.forgotten(o, now) {
+		o = &offender{}
+		t.offenders[ip] = o
+	}
+	o.failures++
+	o.lastFailure = now
+
+	threshold, banThreshold := t.threshold.Load(), t.banThreshold.Load()
+	if banThreshold > 0 && o.failures >= banThreshold {
+		tarpitBans.Add(1)
+		o.bannedUntil = now.Add(time.Duration(t.banDuration.Load()))
+		o.failures = 0
+		return 0
+	}
+
+	if o.failures <= threshold {
+		return 0
+	}
+
+	tarpitDelays.Add(1)
+	delay := time.Duration(o.failures-threshold) * 500 * time.Millisecond
+	return min(delay, maxTarpitDelay)
+}
+
+// forgotten reports whether o has neither failed within the window nor is
+// still banned.
+func (t *tarpit) forgotten(o *offender, now time.Time) bool {
+	return now.Sub(o.lastFailure) > time.Duration(t.window.Load()) && now.After(o.bannedUntil)
+}
+
+// sweep drops the offenders that have been forgotten.
+func (t *tarpit) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ip, o := range t.offenders {
+		if t.forgotten(o, now) {
+			delete(t.offenders, ip)
+		}
+	}
+}
+
+func (t *tarpit) run() {
+	ticker := time.NewTicker(tarpitSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.sweep(now)
+	}
+}
+
+// sleep waits for d unless the client goes away first.
+func (t *tarpit) sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
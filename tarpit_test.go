@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTarpitSweepDropsForgottenOffenders(t *testing.T) {
+	guard := newTarpit(1, 0, time.Minute, time.Minute, "")
+	guard.fail("192.0.2.1")
+	guard.fail("192.0.2.2")
+	guard.offenders["192.0.2.2"].lastFailure = time.Now().Add(-2 * time.Minute)
+
+	guard.sweep(time.Now())
+	if _, ok := guard.offenders["192.0.2.1"]; !ok {
+		t.Error("recent offender dropped")
+	}
+	if _, ok := guard.offenders["192.0.2.2"]; ok {
+		t.Error("forgotten offender kept")
+	}
+}
+
+func TestTarpitFailRestartsForgottenCount(t *testing.T) {
+	guard := newTarpit(1, 0, time.Minute, time.Minute, "")
+	guard.fail("192.0.2.1")
+	guard.fail("192.0.2.1")
+	guard.offenders["192.0.2.1"].lastFailure = time.Now().Add(-2 * time.Minute)
+	if delay := guard.fail("192.0.2.1"); delay != 0 {
+		t.Errorf("fail after the window delayed %v, want 0", delay)
+	}
+}
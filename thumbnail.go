@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errNotDecodable reports a missing source or one that isn't an image.
+var errNotDecodable = errors.New("image not found or not decodable")
+
+// thumbnailSizes are the bounding boxes, in pixels, of the thumbnails
+// generated for every uploaded image.
+var thumbnailSizes []int
+
+// uploadPreviewSize is the size of the data: URI preview returned by
+// uploads; 0 disables it.
+var uploadPreviewSize int
+
+// parseThumbnailSizes parses THUMBNAIL_SIZES, a comma-separated list of
+// pixel sizes. "none" disables thumbnails.
+func parseThumbnailSizes(value string) ([]int, error) {
+	var sizes []int
+	if value == "none" {
+		return nil, nil
+	}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		size, err := strconv.Atoi(field)
+		if err != nil || size <= 0 || size > 4096 {
+			return nil, fmt.Errorf("THUMBNAIL_SIZES: invalid size %q", field)
+		}
+		if !slices.Contains(sizes, size) {
+			sizes = append(sizes, size)
+		}
+	}
+	slices.Sort(sizes)
+	return sizes, nil
+}
+
+// thumbnailName is the object name of a thumbnail. Thumbnails live in a
+// dot-directory beside the originals, which the upload directory scans skip.
+// JPEG sources keep JPEG; everything else becomes PNG to keep transparency.
+func thumbnailName(filename string, size int) string {
+	ext := ".png"
+	if isJPEG(filename) {
+		ext = ".jpg"
+	}
+	return ".thumbs/" + filename + "/" + strconv.Itoa(size) + ext
+}
+
+func isJPEG(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// encodeThumbnail renders the thumbnail of src for filename at size.
+func encodeThumbnail(src image.Image, filename string, size int) ([]byte, error) {
+	img := fitImage(src, size, size)
+	if watermarkImage != nil && watermarkMode == watermarkAlways {
+		img = applyWatermark(img)
+	}
+	if !isJPEG(filename) {
+		return encodePNG(img)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// generateThumbnails renders and stores every configured thumbnail of
+// filename and returns the decoded image, which the preview and placeholder
+// are made from. Files that aren't decodable images are skipped and return
+// nil.
+func (s *fileStore) generateThumbnails(ctx context.Context, filename string) image.Image {
+	if len(s.thumbnailSizes) == 0 && s.previewSize == 0 && !s.placeholders {
+		return nil
+	}
+	src, _, err := s.decode(ctx, filename)
+	if err != nil {
+		logger.Debug("no thumbnails for undecodable file", "file", filename, "error", err)
+		return nil
+	}
+	for _, size := range s.thumbnailSizes {
+		if _, err := s.storeThumbnail(ctx, src, filename, size); err != nil {
+			logger.Error("failed to generate thumbnail", "file", filename, "size", size, "error", err)
+		}
+	}
+	return src
+}
+
+// thumbnailVariants lists the thumbnail URLs of filename.
+func (s *fileStore) thumbnailVariants(filename string) []gin.H {
+	variants := []gin.H{}
+	for _, size := range s.thumbnailSizes {
+		variants = append(variants, gin.H{
+			"name": "thumb-" + strconv.Itoa(size),
+			"url":  publicPath(s.route + "/" + filename + "/thumb/" + strconv.Itoa(size)),
+		})
+	}
+	return variants
+}
+
+// signedURLs returns ready-to-use GET URLs of an uploaded file and, for
+// images, of its thumbnails, keyed like the manifest's variants.
+func (s *fileStore) signedURLs(c *gin.Context, filename string, isImage bool) gin.H {
+	namespace := c.GetString("signingNamespace")
+	expires := time.Now().Unix() + uploadURLTTL
+	urls := gin.H{"original": signedGetURL(c, namespace, s.route+"/"+filename, filename, expires)}
+	if isImage {
+		for _, size := range s.thumbnailSizes {
+			path := s.route + "/" + filename + "/thumb/" + strconv.Itoa(size)
+			urls["thumb-"+strconv.Itoa(size)] = signedGetURL(c, namespace, path, filename, expires)
+		}
+	}
+	return urls
+}
+
+// previewDataURI renders src at the preview size as a data: URI, small
+// enough to embed in the upload response and show while the image loads.
+func (s *fileStore) previewDataURI(src image.Image, filename string) (string, error) {
+	data, err := encodeThumbnail(src, filename, s.previewSize)
+	if err != nil {
+		return "", err
+	}
+	contentType := getMimeType(thumbnailName(filename, s.previewSize))
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (s *fileStore) storeThumbnail(ctx context.Context, src image.Image, filename string, size int) ([]byte, error) {
+	data, err := encodeThumbnail(src, filename, size)
+	if err != nil {
+		return nil, err
+	}
+	data = embedRights(data, s.rights(ctx, filename))
+	if c2paSigner != nil {
+		source, err := s.c2paSource(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = c2paSigner.sign(data, source, thumbnailActions(size)); err != nil {
+			return nil, err
+		}
+	}
+	name := thumbnailName(filename, size)
+	if _, err := s.storage.Put(ctx, name, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	s.metadata.recordDerivative(ctx, derivative{
+		Source:      filename,
+		Name:        name,
+		Kind:        derivedThumbnail,
+		Variant:     strconv.Itoa(size),
+		ContentType: getMimeType(name),
+		Size:        int64(len(data)),
+	})
+	return data, nil
+}
+
+// removeThumbnails deletes the stored thumbnails of filename.
+func (s *fileStore) removeThumbnails(ctx context.Context, filename string) {
+	for _, size := range s.thumbnailSizes {
+		s.storage.Delete(ctx, thumbnailName(filename, size))
+	}
+}
+
+// thumbnail serves a configured thumbnail size of an image. Thumbnails
+// missing from storage, such as those of ingested or imported files or of a
+// size added later, are generated and stored on first request.
+func (s *fileStore) thumbnail(c *gin.Context) {
+	filename := c.Param("filename")
+	size, err := strconv.Atoi(c.Param("size"))
+	if err != nil || !slices.Contains(s.thumbnailSizes, size) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Thumbnail size not available"})
+		return
+	}
+	name := thumbnailName(filename, size)
+	contentType := getMimeType(name)
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	ctx := c.Request.Context()
+	if body, info, err := s.storage.Get(ctx, name); err == nil {
+		defer body.Close()
+		c.Header("Content-Type", contentType)
+		setCacheControl(c, s.variantCacheControl)
+		writeObject(c, filepath.Base(name), contentType, body, info)
+		return
+	}
+
+	leader := false
+	result, err, shared := transformFlight.Do(name, func() (any, error) {
+		leader = true
+		src, _, err := s.decode(ctx, filename)
+		if err != nil {
+			return nil, errNotDecodable
+		}
+		return s.storeThumbnail(ctx, src, filename, size)
+	})
+	if shared && !leader {
+		transformsDeduplicated.Add(1)
+	}
+	if errors.Is(err, errNotDecodable) {
+		if !serveFallbackImage(c, http.StatusNotFound) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Image not found or not decodable"})
+		}
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Failed to generate thumbnail."})
+		return
+	}
+	c.Header("ETag", dataETag(result.([]byte)))
+	setLastModified(c, time.Now())
+	setCacheControl(c, s.variantCacheControl)
+	c.Data(http.StatusOK, contentType, result.([]byte))
+}
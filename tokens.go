@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type tokenRequest struct {
+	TTL     int64 `json:"ttl"`
+	MaxSize int64 `json:"max_size"`
+}
+
+// APIKeyMiddleware authenticates backend callers by the API_KEY bearer token.
+func APIKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiKey.Get())) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// exchangeToken issues a short-lived, upload-only signed URL capped to a
+// maximum file size. It is safe to hand to front-end code because it cannot
+// read, modify or delete existing images.
+func exchangeToken(c *gin.Context) {
+	req := tokenRequest{TTL: 300, MaxSize: tokenMaxSize}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid token request."})
+			return
+		}
+	}
+
+	if req.TTL <= 0 || req.TTL > tokenMaxTTL {
+		req.TTL = tokenMaxTTL
+	}
+	if req.MaxSize <= 0 || req.MaxSize > tokenMaxSize {
+		req.MaxSize = tokenMaxSize
+	}
+
+	expires := time.Now().Unix() + req.TTL
+	hostData, hostQuery := hostBinding(c)
+	signature := sign(fmt.Sprintf("%s::%d", http.MethodPost, expires) + signedField("max_size", strconv.FormatInt(req.MaxSize, 10)) + hostData)
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"upload_url": fmt.Sprintf("%s?expires=%d&max_size=%d%s&signature=%s", publicPath("/images"), expires, req.MaxSize, hostQuery, signature),
+		"expires":    expires,
+		"max_size":   req.MaxSize,
+	})
+}
+
+// uploadSizeLimit returns the max_size bound into the request's signature, if any.
+func uploadSizeLimit(c *gin.Context) (int64, bool) {
+	maxSize, err := strconv.ParseInt(c.Query("max_size"), 10, 64)
+	if err != nil || maxSize <= 0 {
+		return 0, false
+	}
+	return maxSize, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/gin-gonic/gin"
+)
+
+// traceContext is the W3C Trace Context (https://www.w3.org/TR/trace-context/)
+// of a request: the trace it belongs to and this server's span in it.
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+	state   string
+}
+
+type traceContextKey struct{}
+
+// traceparent is the header value identifying this server's span as the
+// parent of downstream calls.
+func (t traceContext) traceparent() string {
+	return "00-" + t.traceID + "-" + t.spanID + "-" + t.flags
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isLowerHex(s string, n int) bool {
+	return len(s) == n && strings.Trim(s, "0123456789abcdef") == ""
+}
+
+// parseTraceparent reads the trace ID and flags of a traceparent header.
+// Versions after 00 may append fields, which are ignored.
+func parseTraceparent(value string) (traceID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || !isLowerHex(parts[0], 2) || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return "", "", false
+	}
+	// All-zero trace and parent IDs are invalid.
+	if !isLowerHex(parts[1], 32) || !isLowerHex(parts[2], 16) || !isLowerHex(parts[3], 2) ||
+		strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// TraceContextMiddleware joins the trace of an incoming traceparent header,
+// or starts a new one, and opens a span for the request. Storage calls made
+// with the request's context carry it downstream.
+func TraceContextMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		trace := traceContext{spanID: randomHex(8), flags: "00"}
+		if traceID, flags, ok := parseTraceparent(c.GetHeader("traceparent")); ok {
+			trace.traceID, trace.flags = traceID, flags
+			trace.state = c.GetHeader("tracestate")
+		} else {
+			trace.traceID = randomHex(16)
+		}
+		c.Set("traceID", trace.traceID)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), traceContextKey{}, trace))
+		c.Next()
+	}
+}
+
+// setTraceHeaders adds the trace context of ctx, if any, to an outgoing
+// request's headers.
+func setTraceHeaders(ctx context.Context, header http.Header) {
+	trace, ok := ctx.Value(traceContextKey{}).(traceContext)
+	if !ok {
+		return
+	}
+	header.Set("traceparent", trace.traceparent())
+	if trace.state != "" {
+		header.Set("tracestate", trace.state)
+	}
+}
+
+// s3TraceContext adds the trace headers to every S3 request. It runs in the
+// build step, before the request is signed.
+func s3TraceContext(stack *middleware.Stack) error {
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("TraceContext",
+		func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				setTraceHeaders(ctx, req.Header)
+			}
+			return next.HandleBuild(ctx, in)
+		}), middleware.After)
+}
+
+// azureTracePolicy adds the trace headers to every Blob Storage request.
+type azureTracePolicy struct{}
+
+func (azureTracePolicy) Do(req *policy.Request) (*http.Response, error) {
+	setTraceHeaders(req.Raw().Context(), req.Raw().Header)
+	return req.Next()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"image"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+// Invisible watermarks trace leaked copies of paid content: a signed URL
+// with ?recipient= (a tenant or link ID) serves a copy marked with a code
+// derived from the recipient, which the detect endpoint reads back. The
+// mark is spread over low-frequency DCT coefficients of the luminance at a
+// fixed working resolution, so it survives re-encoding and resizing but not
+// cropping.
+
+// traceKey keys the codes and their layout (INVISIBLE_WATERMARK_KEY); nil
+// disables invisible watermarks.
+var traceKey []byte
+
+var (
+	// errNoTraceKey reports ?recipient= without a configured key.
+	errNoTraceKey = errors.New("invisible watermarks are not configured")
+	// errTraceTooSmall reports an image smaller than the working
+	// resolution, which can't hold the mark.
+	errTraceTooSmall = errors.New("image is too small for an invisible watermark")
+)
+
+const (
+	// traceGrid is the longer side of the working resolution.
+	traceGrid = 256
+	// traceStep is the quantizer step of the marked coefficients; larger
+	// steps survive more loss but start to show in flat areas.
+	traceStep = 24.0
+	// traceThreshold is the confidence a reading needs to count.
+	traceThreshold        = 0.25
+	tracePayloadBits      = 64
+	maxRecipientLength    = 128
+	minTraceGridDimension = 64
+)
+
+// traceCoefficients are the DCT coefficients of every 8x8 block that carry
+// payload bits.
+var traceCoefficients = [][2]int{{1, 2}, {2, 1}}
+
+// traceCode identifies a recipient in the mark.
+type traceCode [6]byte
+
+func (code traceCode) String() string {
+	return hex.EncodeToString(code[:])
+}
+
+// recipientCode derives the code of recipient from the key, so codes can't
+// be forged or linked to recipients without it.
+func recipientCode(recipient string) traceCode {
+	mac := hmac.New(sha256.New, traceKey)
+	mac.Write([]byte("recipient:" + recipient))
+	var code traceCode
+	copy(code[:], mac.Sum(nil))
+	return code
+}
+
+// payload returns the bits embedded for code: the code and a 16-bit
+// checksum telling a mark from noise.
+func (code traceCode) payload() (bits [tracePayloadBits]bool) {
+	sum := crc32.ChecksumIEEE(code[:])
+	data := append(code[:], byte(sum>>8), byte(sum))
+	for i := range bits {
+		bits[i] = data[i/8]>>(7-i%8)&1 == 1
+	}
+	return bits
+}
+
+// traceGridSize returns the working resolution of a w x h image: the
+// longer side traceGrid and the shorter one scaled by shift blocks and
+// rounded to whole blocks. ok is false for images too narrow to carry the
+// mark.
+func traceGridSize(w, h, shift int) (gw, gh int, ok bool) {
+	long, short := max(w, h), min(w, h)
+	if short == 0 {
+		return 0, 0, false
+	}
+	scaled := (short*traceGrid/long+4)/8*8 + shift*8
+	if scaled < minTraceGridDimension || scaled > traceGrid {
+		return 0, 0, false
+	}
+	if w >= h {
+		return traceGrid, scaled, true
+	}
+	return scaled, traceGrid, true
+}
+
+// traceSlot is one marked coefficient: its block, its frequencies, the
+// payload bit it carries and the dither of its quantizer.
+type traceSlot struct {
+	bx, by, u, v, bit int
+	dither            float64
+}
+
+// traceSlots spreads the payload bits over the marked coefficients of a
+// gw x gh grid in an order and with dithers derived from the key, so the
+// mark can't be read or scrubbed selectively without it.
+func traceSlots(gw, gh int) []traceSlot {
+	mac := hmac.New(sha256.New, traceKey)
+	mac.Write([]byte("layout"))
+	seed := mac.Sum(nil)
+	rng := rand.New(rand.NewPCG(binary.LittleEndian.Uint64(seed), binary.LittleEndian.Uint64(seed[8:])))
+	columns := gw / 8
+	count := columns * (gh / 8) * len(traceCoefficients)
+	slots := make([]traceSlot, count)
+	for i, slot := range rng.Perm(count) {
+		block, uv := slot/len(traceCoefficients), traceCoefficients[slot%len(traceCoefficients)]
+		slots[i] = traceSlot{
+			bx:     block % columns,
+			by:     block / columns,
+			u:      uv[0],
+			v:      uv[1],
+			bit:    i % tracePayloadBits,
+			dither: rng.Float64() * traceStep,
+		}
+	}
+	return slots
+}
+
+// dctBasis holds the orthonormal 8-point DCT-II basis, dctBasis[u][x].
+var dctBasis = func() (basis [8][8]float64) {
+	for u := range 8 {
+		scale := math.Sqrt(2.0 / 8)
+		if u == 0 {
+			scale = math.Sqrt(1.0 / 8)
+		}
+		for x := range 8 {
+			basis[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return basis
+}()
+
+// value returns the coefficient of s in grid, a luminance plane gw wide.
+func (s traceSlot) value(grid []float64, gw int) float64 {
+	var sum float64
+	for y := range 8 {
+		row := grid[(s.by*8+y)*gw+s.bx*8:]
+		for x := range 8 {
+			sum += dctBasis[s.u][x] * dctBasis[s.v][y] * row[x]
+		}
+	}
+	return sum
+}
+
+// add adds delta to the coefficient of s in grid.
+func (s traceSlot) add(grid []float64, gw int, delta float64) {
+	for y := range 8 {
+		row := grid[(s.by*8+y)*gw+s.bx*8:]
+		for x := range 8 {
+			row[x] += delta * dctBasis[s.u][x] * dctBasis[s.v][y]
+		}
+	}
+}
+
+// traceLuma returns the luminance of img resized to gw x gh.
+func traceLuma(img image.Image, gw, gh int) []float64 {
+	small := resizeImage(img, gw, gh)
+	luma := make([]float64, gw*gh)
+	for y := range gh {
+		for x := range gw {
+			p := small.Pix[y*small.Stride+x*4:]
+			luma[y*gw+x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+	return luma
+}
+
+// embedTraceMark returns a copy of img carrying code. Each marked
+// coefficient is quantized onto the lattice of its bit; the change is made
+// at the working resolution and scaled up onto the pixels, so it stays in
+// frequencies resizing and compression keep.
+func embedTraceMark(img image.Image, code traceCode) (image.Image, error) {
+	b := img.Bounds()
+	gw, gh, ok := traceGridSize(b.Dx(), b.Dy(), 0)
+	if !ok || b.Dx() < gw || b.Dy() < gh {
+		return nil, errTraceTooSmall
+	}
+	luma := traceLuma(img, gw, gh)
+	bits := code.payload()
+	delta := make([]float64, gw*gh)
+	for _, s := range traceSlots(gw, gh) {
+		offset := s.dither
+		if bits[s.bit] {
+			offset += traceStep / 2
+		}
+		c := s.value(luma, gw)
+		s.add(delta, gw, math.Round((c-offset)/traceStep)*traceStep+offset-c)
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	for y := range h {
+		// Bilinear interpolation between grid pixel centers.
+		gy := max((float64(y)+0.5)*float64(gh)/float64(h)-0.5, 0)
+		y0 := min(int(gy), gh-1)
+		y1, fy := min(y0+1, gh-1), gy-float64(y0)
+		for x := range w {
+			gx := max((float64(x)+0.5)*float64(gw)/float64(w)-0.5, 0)
+			x0 := min(int(gx), gw-1)
+			x1, fx := min(x0+1, gw-1), gx-float64(x0)
+			d := (delta[y0*gw+x0]*(1-fx)+delta[y0*gw+x1]*fx)*(1-fy) +
+				(delta[y1*gw+x0]*(1-fx)+delta[y1*gw+x1]*fx)*fy
+			p := out.Pix[y*out.Stride+x*4:]
+			for i := range 3 {
+				p[i] = uint8(min(max(math.Round(float64(p[i])+d), 0), 255))
+			}
+		}
+	}
+	return out, nil
+}
+
+// traceReading is what one working resolution reads from an image: per
+// payload bit, the mean vote of its coefficients, from 1 for a clear 0 to
+// -1 for a clear 1.
+type traceReading [tracePayloadBits]float64
+
+// readTraceMark reads img at its working resolution and the neighbouring
+// ones.
+func readTraceMark(img image.Image) []traceReading {
+	b := img.Bounds()
+	var readings []traceReading
+	for _, shift := range []int{0, -1, 1} {
+		gw, gh, ok := traceGridSize(b.Dx(), b.Dy(), shift)
+		if !ok {
+			continue
+		}
+		luma := traceLuma(img, gw, gh)
+		var reading traceReading
+		var votes [tracePayloadBits]int
+		for _, s := range traceSlots(gw, gh) {
+			// The phase of the coefficient on its quantizer: 0 on the
+			// lattice of a 0 bit, half a step off on that of a 1.
+			reading[s.bit] += math.Cos(2 * math.Pi * (s.value(luma, gw) - s.dither) / traceStep)
+			votes[s.bit]++
+		}
+		for i := range reading {
+			reading[i] /= float64(votes[i])
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+// decode returns the code the reading spells and its confidence, the mean
+// strength of the votes. ok is false when the checksum doesn't match.
+func (r traceReading) decode() (code traceCode, confidence float64, ok bool) {
+	var data [tracePayloadBits / 8]byte
+	for i, vote := range r {
+		if vote < 0 {
+			data[i/8] |= 1 << (7 - i%8)
+		}
+		confidence += math.Abs(vote)
+	}
+	copy(code[:], data[:])
+	return code, confidence / tracePayloadBits, code.payload() == r.bits()
+}
+
+// bits returns the payload bits the reading votes for.
+func (r traceReading) bits() (bits [tracePayloadBits]bool) {
+	for i, vote := range r {
+		bits[i] = vote < 0
+	}
+	return bits
+}
+
+// correlation returns how strongly the reading agrees with the payload of
+// code, from 1 when it reads exactly that code to about 0 for noise or
+// another code.
+func (r traceReading) correlation(code traceCode) float64 {
+	var sum float64
+	for i, bit := range code.payload() {
+		if bit {
+			sum -= r[i]
+		} else {
+			sum += r[i]
+		}
+	}
+	return sum / tracePayloadBits
+}
+
+// tracedRecipients are the codes recorded since startup, so the registry
+// is written once per recipient rather than on every conversion.
+var tracedRecipients sync.Map
+
+// rememberRecipient records whom the code of recipient belongs to, so the
+// detect endpoint can name the recipient of a found mark.
+func rememberRecipient(ctx context.Context, recipient string) {
+	code := recipientCode(recipient).String()
+	if _, seen := tracedRecipients.LoadOrStore(code, true); seen {
+		return
+	}
+	if !imageMetadata.recordRecipient(ctx, code, recipient) {
+		tracedRecipients.Delete(code)
+	}
+}
+
+// maxTraceUpload bounds the images sent to the detect endpoint.
+const maxTraceUpload = 64 << 20
+
+// detectTraceMark reads the invisible watermark of an image uploaded as
+// the file form field. It reports the code found and, from the registry,
+// its recipient; with ?recipient= it also reports whether the image
+// carries that recipient's mark, which works on weaker marks than a blind
+// read.
+func detectTraceMark(c *gin.Context) {
+	if traceKey == nil {
+		c.IndentedJSON(http.StatusNotImplemented, gin.H{"message": "Invisible watermarks are not configured."})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxTraceUpload)
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "File not found in the request"})
+		return
+	}
+	defer file.Close()
+	img, _, err := decodeOriented(file)
+	if err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "File is not a supported image."})
+		return
+	}
+	readings := readTraceMark(img)
+	if len(readings) == 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Image is too small to carry a watermark."})
+		return
+	}
+
+	result := gin.H{"detected": false}
+	best := -1.0
+	for _, reading := range readings {
+		code, confidence, ok := reading.decode()
+		if !ok || confidence < traceThreshold || confidence <= best {
+			continue
+		}
+		best = confidence
+		result = gin.H{"detected": true, "code": code.String(), "confidence": math.Round(confidence*1000) / 1000}
+	}
+	if code, found := result["code"].(string); found {
+		recipient, err := imageMetadata.recipient(c.Request.Context(), code)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			logger.Error("watermark recipient lookup failed", "code", code, "error", err)
+		}
+		if recipient != "" {
+			result["recipient"] = recipient
+		}
+	}
+	if candidate := c.Query("recipient"); candidate != "" {
+		code := recipientCode(candidate)
+		var correlation float64
+		for _, reading := range readings {
+			correlation = max(correlation, reading.correlation(code))
+		}
+		result["candidate"] = gin.H{
+			"recipient":   candidate,
+			"code":        code.String(),
+			"match":       correlation >= traceThreshold,
+			"correlation": math.Round(correlation*1000) / 1000,
+		}
+	}
+	c.IndentedJSON(http.StatusOK, result)
+}
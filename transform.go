@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// outputFormat is an encoding that stored images can be converted to with
+// ?format=.
+type outputFormat struct {
+	contentType string
+	ext         string
+	// quality is the configured default, which ?q= overrides; nil for
+	// lossless formats.
+	quality *int
+	encode  func(w io.Writer, img image.Image, quality int) error
+}
+
+var (
+	transformCacheDir string
+	jpegQuality       int
+	minQuality        int
+	webpQuality       int
+	avifQuality       int
+	avifSpeed         int
+
+	// Output limits of a conversion; zero disables a limit. Oversized
+	// results are downscaled to fit when transformDownscale is set and
+	// rejected otherwise.
+	transformMaxPixels int64
+	transformMaxBytes  int64
+	transformDownscale bool
+
+	// transformMaxInputPixels bounds the sources decoded for a conversion;
+	// larger ones are refused before decoding. Zero disables the limit.
+	transformMaxInputPixels int64
+)
+
+// canonicalRedirects redirects transform requests whose query isn't in
+// canonical form, so CDNs cache one URL per variant. It can be toggled at
+// runtime.
+var canonicalRedirects atomic.Bool
+
+// transformConfigTime is when the configuration conversions depend on, such
+// as the watermark, rights and copyright metadata, C2PA signer, encoder
+// settings and auto-orientation, was last loaded or changed, in Unix
+// nanoseconds.
+var transformConfigTime atomic.Int64
+
+// convertedModTime returns when a conversion of a source modified at
+// modTime last changed: a conversion is as old as the newer of its source
+// and the configuration it was rendered with.
+func convertedModTime(modTime time.Time) time.Time {
+	if config := time.Unix(0, transformConfigTime.Load()); config.After(modTime) {
+		return config
+	}
+	return modTime
+}
+
+var (
+	transformsRejected   = expvar.NewInt("transforms_rejected_total")
+	transformsDownscaled = expvar.NewInt("transforms_downscaled_total")
+	transformsNearLimit  = expvar.NewInt("transforms_near_limit_total")
+
+	transformsDeduplicated = expvar.NewInt("transforms_deduplicated_total")
+)
+
+// transformFlight collapses concurrent identical conversions and thumbnail
+// renders into one.
+var transformFlight singleflight.Group
+
+// nearLimit is the fraction of a limit above which a conversion is counted
+// as near the limit, to spot limits that are about to bite.
+const nearLimit = 0.8
+
+// maxDownscaleAttempts bounds the re-encodes made to fit the byte limit.
+const maxDownscaleAttempts = 3
+
+var (
+	errTransformTooLarge = errors.New("transform output exceeds the configured limits")
+	errSourceTooLarge    = errors.New("source image exceeds the configured pixel limit")
+)
+
+// outputFormats maps ?format= values to their encoders.
+var outputFormats = map[string]outputFormat{
+	"jpeg": {"image/jpeg", ".jpg", &jpegQuality, func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}},
+	"png": {"image/png", ".png", nil, func(w io.Writer, img image.Image, quality int) error {
+		return png.Encode(w, img)
+	}},
+	"webp": {"image/webp", ".webp", &webpQuality, func(w io.Writer, img image.Image, quality int) error {
+		return webp.Encode(w, img, webp.Options{Quality: quality})
+	}},
+	"avif": {"image/avif", ".avif", &avifQuality, func(w io.Writer, img image.Image, quality int) error {
+		return avif.Encode(w, img, avif.Options{
+			Quality:           quality,
+			QualityAlpha:      quality,
+			Speed:             avifSpeed,
+			ChromaSubsampling: image.YCbCrSubsampleRatio420,
+		})
+	}},
+}
+
+// transformOptions describe how a stored image is converted before serving.
+type transformOptions struct {
+	format  string
+	quality int
+
+	// rotate (clockwise degrees) and flip ("h" or "v") are applied first,
+	// so crop coordinates refer to the corrected orientation.
+	rotate int
+	flip   string
+
+	// crop is an explicit region (crop=x,y,w,h), empty when not requested.
+	crop image.Rectangle
+	// gravity (crop=center and friends, or gravity=) fills a width x height
+	// box and crops the overflow toward it. Without gravity, width and
+	// height bound the output size; either may be zero.
+	gravity       string
+	width, height int
+
+	// watermark overlays the configured watermark.
+	watermark bool
+	// recipient embeds an invisible watermark tracing the copy to it.
+	recipient string
+}
+
+// maxDimension bounds the w and h parameters.
+const maxDimension = 8192
+
+// cropGravities are the crop= values that crop toward an edge or the center.
+var cropGravities = []string{"center", "top", "bottom", "left", "right", "smart"}
+
+// errCropOutside reports a crop region that doesn't overlap the image.
+var errCropOutside = errors.New("crop region lies outside the image")
+
+// query renders o as a query string with the parameters in a fixed order
+// and in one spelling each (gravity= becomes crop=), so equivalent
+// requests share a cache entry. format and q are included when asked for.
+func (o transformOptions) query(format, quality bool) string {
+	var params []string
+	if o.rotate != 0 {
+		params = append(params, "rotate="+strconv.Itoa(o.rotate))
+	}
+	if o.flip != "" {
+		params = append(params, "flip="+o.flip)
+	}
+	if r := o.crop; r != (image.Rectangle{}) {
+		params = append(params, fmt.Sprintf("crop=%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy()))
+	} else if o.gravity != "" {
+		params = append(params, "crop="+o.gravity)
+	}
+	if o.width > 0 {
+		params = append(params, "w="+strconv.Itoa(o.width))
+	}
+	if o.height > 0 {
+		params = append(params, "h="+strconv.Itoa(o.height))
+	}
+	if o.watermark {
+		params = append(params, "watermark=1")
+	}
+	if o.recipient != "" {
+		params = append(params, "recipient="+url.QueryEscape(o.recipient))
+	}
+	if format {
+		params = append(params, "format="+o.format)
+	}
+	if quality && o.quality > 0 {
+		params = append(params, "q="+strconv.Itoa(o.quality))
+	}
+	return strings.Join(params, "&")
+}
+
+// transformParams are the query parameters parseTransformOptions reads.
+var transformParams = []string{"rotate", "flip", "crop", "gravity", "w", "h", "watermark", "recipient", "format", "q"}
+
+// canonicalQuery returns the raw query of a request for opts in canonical
+// form: the transform parameters it sent in query's order, without ones
+// that only restate a default, followed by every other parameter (the
+// signature) as sent.
+func canonicalQuery(c *gin.Context, opts transformOptions) string {
+	explicitFormat := c.Query("format") != ""
+	quality := c.Query("q") != ""
+	if f := outputFormats[opts.format]; explicitFormat && f.quality != nil && opts.quality == *f.quality {
+		quality = false
+	}
+	// Enforced watermarks aren't part of the request.
+	if c.Query("watermark") != "1" {
+		opts.watermark = false
+	}
+	parts := []string{}
+	if transform := opts.query(explicitFormat, quality); transform != "" {
+		parts = append(parts, transform)
+	}
+	for _, param := range strings.Split(c.Request.URL.RawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if param != "" && !slices.Contains(transformParams, name) {
+			parts = append(parts, param)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// reshapes reports whether o changes the geometry of the image.
+func (o transformOptions) reshapes() bool {
+	return o.rotate != 0 || o.flip != "" ||
+		o.crop != (image.Rectangle{}) || o.gravity != "" || o.width > 0 || o.height > 0
+}
+
+// sourceFormat is the output format that keeps filename's own encoding, for
+// transforms that change only the geometry. GIFs become PNGs since only
+// their first frame survives.
+func sourceFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".webp":
+		return "webp"
+	case ".avif":
+		return "avif"
+	}
+	return "png"
+}
+
+// parseGeometry reads the rotate, flip, crop, w and h parameters.
+func parseGeometry(c *gin.Context, opts *transformOptions) error {
+	switch rotate := c.Query("rotate"); rotate {
+	case "", "0":
+	case "90", "180", "270":
+		opts.rotate, _ = strconv.Atoi(rotate)
+	default:
+		return errors.New("rotate must be 90, 180 or 270")
+	}
+	switch opts.flip = strings.ToLower(c.Query("flip")); opts.flip {
+	case "", "h", "v":
+	default:
+		return errors.New("flip must be h or v")
+	}
+
+	for _, dim := range []struct {
+		name  string
+		value *int
+	}{{"w", &opts.width}, {"h", &opts.height}} {
+		if v := c.Query(dim.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDimension {
+				return fmt.Errorf("%s must be between 1 and %d", dim.name, maxDimension)
+			}
+			*dim.value = n
+		}
+	}
+
+	crop := strings.ToLower(c.Query("crop"))
+	if gravity := strings.ToLower(c.Query("gravity")); gravity != "" {
+		if crop != "" || !slices.Contains(cropGravities, gravity) {
+			return errors.New("gravity must be one of " + strings.Join(cropGravities, ", ") + " and can't be combined with crop")
+		}
+		crop = gravity
+	}
+	switch {
+	case crop == "":
+	case slices.Contains(cropGravities, crop):
+		if opts.width == 0 || opts.height == 0 {
+			return fmt.Errorf("crop=%s needs both w and h", crop)
+		}
+		opts.gravity = crop
+	default:
+		fields := strings.Split(crop, ",")
+		if len(fields) != 4 {
+			return errors.New("crop must be x,y,w,h or one of " + strings.Join(cropGravities, ", "))
+		}
+		var v [4]int
+		for i, field := range fields {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || n < 0 || (i >= 2 && n == 0) {
+				return errors.New("crop must be x,y,w,h with a non-negative offset and a positive size")
+			}
+			v[i] = n
+		}
+		opts.crop = image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3])
+	}
+	return nil
+}
+
+// autoFormats lists, in order of preference, the formats served to clients
+// whose Accept header asks for them when the request names no format.
+var autoFormats []string
+
+// parseAutoFormats parses AUTO_FORMATS; "none" disables negotiation.
+func parseAutoFormats(value string) ([]string, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if _, known := outputFormats[format]; !known {
+			return nil, fmt.Errorf("AUTO_FORMATS: unsupported format %q", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// parseTransformOptions reads the transform query parameters of a request
+// for filename. Without ?format=, a JPEG or PNG is converted to the first
+// of autoFormats the client accepts; otherwise cropped, resized and ?q=
+// JPEG output keeps the source format. ?format=original opts out. ok is
+// false when the original should be served.
+func parseTransformOptions(c *gin.Context, filename string) (opts transformOptions, ok bool, err error) {
+	if q := c.Query("q"); q != "" {
+		if opts.quality, err = strconv.Atoi(q); err != nil || opts.quality < 1 || opts.quality > 100 {
+			return opts, false, errors.New("q must be between 1 and 100")
+		}
+		// Qualities below the floor would only save bytes by serving
+		// visibly broken images.
+		opts.quality = max(opts.quality, minQuality)
+	}
+
+	if err := parseGeometry(c, &opts); err != nil {
+		return opts, false, err
+	}
+	switch c.Query("watermark") {
+	case "", "0":
+	case "1":
+		if watermarkImage == nil {
+			return opts, false, errNoWatermark
+		}
+		opts.watermark = true
+	default:
+		return opts, false, errors.New("watermark must be 0 or 1")
+	}
+	if opts.recipient = c.Query("recipient"); opts.recipient != "" {
+		if traceKey == nil {
+			return opts, false, errNoTraceKey
+		}
+		if len(opts.recipient) > maxRecipientLength {
+			return opts, false, fmt.Errorf("recipient must be at most %d bytes", maxRecipientLength)
+		}
+	}
+	edits := opts.reshapes() || opts.watermark || opts.recipient != ""
+
+	opts.format = strings.ToLower(c.Query("format"))
+	switch opts.format {
+	case "original":
+		if edits {
+			return opts, false, errors.New("format=original can't be combined with rotate, flip, crop, w, h, watermark or recipient")
+		}
+		return transformOptions{}, false, nil
+	case "":
+		opts.format = negotiateFormat(c, filename)
+		if opts.format == "" && (edits || opts.quality > 0 && isJPEG(filename)) {
+			opts.format = sourceFormat(filename)
+		}
+		if opts.format == "" {
+			return transformOptions{}, false, nil
+		}
+	}
+	format, known := outputFormats[opts.format]
+	if !known {
+		return opts, false, fmt.Errorf("unsupported format %q", opts.format)
+	}
+	if format.quality == nil {
+		opts.quality = 0
+	} else if opts.quality == 0 {
+		opts.quality = *format.quality
+	}
+	// Enforced watermarks cover every derived image; originals are still
+	// served as stored.
+	if watermarkImage != nil && watermarkMode == watermarkAlways {
+		opts.watermark = true
+	}
+	return opts, true, nil
+}
+
+// negotiateFormat picks the output format from the Accept header, or
+// returns "" to keep the stored format. GIFs are left alone since
+// conversion would drop their animation.
+func negotiateFormat(c *gin.Context, filename string) string {
+	if len(autoFormats) == 0 {
+		return ""
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png":
+	default:
+		return ""
+	}
+
+	// The response now depends on Accept, for every client, so shared
+	// caches must key on it.
+	c.Header("Vary", "Accept")
+	accept := c.GetHeader("Accept")
+	for _, format := range autoFormats {
+		if acceptsType(accept, outputFormats[format].contentType) {
+			return format
+		}
+	}
+	return ""
+}
+
+// acceptsType reports whether an Accept header lists contentType explicitly
+// with a non-zero quality. Wildcards don't count: a client sending */*
+// hasn't said it can decode a newer format.
+func acceptsType(accept, contentType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), contentType) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if key, value, _ := strings.Cut(strings.TrimSpace(param), "="); key == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveTransformed converts the stored image to opts and serves the result,
+// from the cache when the same conversion was made before. Nothing is
+// written when the conversion fails, so the caller can still answer.
+func (s *fileStore) serveTransformed(c *gin.Context, body io.Reader, info ObjectInfo, opts transformOptions) error {
+	format := outputFormats[opts.format]
+	ctx := c.Request.Context()
+	key := s.cache.key(info, opts)
+
+	// A client holding the conversion since it last changed is answered
+	// before anything is read or encoded.
+	modTime := convertedModTime(info.ModTime)
+	if notModifiedSince(c.Request, modTime) {
+		setCacheControl(c, s.variantCacheControl)
+		setLastModified(c, modTime)
+		c.Status(http.StatusNotModified)
+		return nil
+	}
+
+	cached, cachedInfo, err := s.cache.get(ctx, key)
+	if err == nil {
+		defer cached.Close()
+		body, info.Size = cached, cachedInfo.Size
+		if content, ok := cached.(io.ReadSeeker); ok {
+			if etag, err := contentETag(cachedInfo, content); err == nil {
+				c.Header("ETag", etag)
+			}
+		}
+	} else {
+		data, err := s.renderTransform(ctx, body, info, opts, key)
+		if err != nil {
+			return err
+		}
+		body, info.Size = bytes.NewReader(data), int64(len(data))
+		c.Header("ETag", dataETag(data))
+	}
+
+	c.Header("Content-Type", format.contentType)
+	c.Header("Content-Disposition", "inline; filename="+strings.TrimSuffix(info.Name, filepath.Ext(info.Name))+format.ext)
+	c.Header("X-Content-Type-Options", "nosniff")
+	setCacheControl(c, s.variantCacheControl)
+	info.ModTime = modTime
+	writeObject(c, info.Name, format.contentType, body, info)
+	return nil
+}
+
+// renderTransform converts the stored image read from body to opts and
+// caches the result under key. Concurrent identical conversions share one
+// encode; followers wait for the leader's result instead of encoding again.
+func (s *fileStore) renderTransform(ctx context.Context, body io.Reader, info ObjectInfo, opts transformOptions, key string) ([]byte, error) {
+	leader := false
+	result, err, shared := transformFlight.Do(key, func() (any, error) {
+		leader = true
+		// The source is hashed on the way for the content credentials.
+		digest := sha256.New()
+		data, err := transformImage(io.TeeReader(body, digest), opts)
+		if err != nil {
+			return nil, err
+		}
+		if c2paSigner != nil {
+			io.Copy(digest, body)
+			source := c2paSource{info.Name, getMimeType(info.Name), digest.Sum(nil)}
+			if data, err = c2paSigner.sign(data, source, opts.c2paActions(sourceFormat(info.Name))); err != nil {
+				return nil, err
+			}
+		}
+		if opts.recipient != "" {
+			rememberRecipient(ctx, opts.recipient)
+		}
+		if err := s.cache.put(ctx, key, data); err != nil {
+			logger.Warn("failed to cache converted image", "file", info.Name, "error", err)
+			return data, nil
+		}
+		s.metadata.recordDerivative(ctx, derivative{
+			Source:      info.Name,
+			Name:        key,
+			Kind:        derivedTransform,
+			Variant:     opts.query(true, true),
+			ContentType: outputFormats[opts.format].contentType,
+			Size:        int64(len(data)),
+		})
+		return data, nil
+	})
+	if shared && !leader {
+		transformsDeduplicated.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.([]byte), nil
+}
+
+// transformImage decodes the image read from r and encodes it as opts asks,
+// within the configured pixel and byte limits. The pixel limits are checked
+// against the image header before anything is decoded. With
+// COPYRIGHT_METADATA on, the output carries the rights of the source as XMP.
+func transformImage(r io.Reader, opts transformOptions) ([]byte, error) {
+	var head bytes.Buffer
+	tiff, _ := readExif(io.TeeReader(r, &head))
+	config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head.Bytes()), io.TeeReader(r, &head)))
+	if err != nil {
+		return nil, err
+	}
+	if transformMaxInputPixels > 0 && int64(config.Width)*int64(config.Height) > transformMaxInputPixels {
+		transformsRejected.Add(1)
+		return nil, errSourceTooLarge
+	}
+	orientation := 1
+	if autoOrient.Load() {
+		orientation = exifOrientation(tiff)
+	}
+	w, h, err := transformedSize(config.Width, config.Height, orientation, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pixels := int64(w) * int64(h)
+	downscaled := false
+	if transformMaxPixels > 0 && pixels > transformMaxPixels {
+		if !transformDownscale {
+			transformsRejected.Add(1)
+			return nil, errTransformTooLarge
+		}
+		// Resizing to the scaled-down size is the last step of the geometry,
+		// so the full-size result is never built.
+		factor := math.Sqrt(float64(transformMaxPixels) / float64(pixels))
+		opts.width, opts.height = max(int(float64(w)*factor), 1), max(int(float64(h)*factor), 1)
+		downscaled = true
+	} else if transformMaxPixels > 0 && float64(pixels) >= nearLimit*float64(transformMaxPixels) {
+		transformsNearLimit.Add(1)
+	}
+
+	img, _, tiff, err := decodeWithExif(io.MultiReader(&head, r))
+	if err != nil {
+		return nil, err
+	}
+	if img, err = applyGeometry(img, opts); err != nil {
+		return nil, err
+	}
+	if opts.watermark {
+		img = applyWatermark(img)
+	}
+	if opts.recipient != "" {
+		if img, err = embedTraceMark(img, recipientCode(opts.recipient)); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var buf bytes.Buffer
+		if err := outputFormats[opts.format].encode(&buf, img, opts.quality); err != nil {
+			return nil, err
+		}
+		size := int64(buf.Len())
+		if transformMaxBytes <= 0 || size <= transformMaxBytes {
+			if transformMaxBytes > 0 && float64(size) >= nearLimit*float64(transformMaxBytes) {
+				transformsNearLimit.Add(1)
+			}
+			if downscaled {
+				transformsDownscaled.Add(1)
+			}
+			return embedRights(buf.Bytes(), sourceRights(tiff)), nil
+		}
+		if !transformDownscale || attempt == maxDownscaleAttempts {
+			transformsRejected.Add(1)
+			return nil, errTransformTooLarge
+		}
+		// Encoded size grows roughly with the pixel count; aim a little
+		// under the limit so one retry usually suffices.
+		img = scaleImage(img, 0.9*math.Sqrt(float64(transformMaxBytes)/float64(size)))
+		downscaled = true
+	}
+}
+
+// applyGeometry rotates, flips, crops and resizes img as opts asks.
+func applyGeometry(img image.Image, opts transformOptions) (image.Image, error) {
+	if opts.rotate != 0 {
+		img = rotateImage(img, opts.rotate)
+	}
+	if opts.flip != "" {
+		img = flipImage(img, opts.flip == "h")
+	}
+	if opts.crop != (image.Rectangle{}) {
+		b := img.Bounds()
+		rect := opts.crop.Add(b.Min).Intersect(b)
+		if rect.Empty() {
+			return nil, errCropOutside
+		}
+		img = cropImage(img, rect)
+	}
+	if opts.gravity != "" {
+		return fillImage(img, opts.width, opts.height, opts.gravity), nil
+	}
+	if opts.width > 0 || opts.height > 0 {
+		return fitImage(img, opts.width, opts.height), nil
+	}
+	return img, nil
+}
+
+// transformedSize returns the size of the image applyGeometry makes of a
+// w x h source with the given EXIF orientation, without decoding it.
+func transformedSize(w, h, orientation int, opts transformOptions) (int, int, error) {
+	if orientation >= 5 && orientation <= 8 {
+		w, h = h, w
+	}
+	if opts.rotate == 90 || opts.rotate == 270 {
+		w, h = h, w
+	}
+	if opts.crop != (image.Rectangle{}) {
+		rect := opts.crop.Intersect(image.Rect(0, 0, w, h))
+		if rect.Empty() {
+			return 0, 0, errCropOutside
+		}
+		w, h = rect.Dx(), rect.Dy()
+	}
+	if opts.gravity != "" {
+		cw, ch := w, w*opts.height/opts.width
+		if ch > h {
+			cw, ch = h*opts.width/opts.height, h
+		}
+		cw, ch = max(cw, 1), max(ch, 1)
+		if cw <= opts.width {
+			return cw, ch, nil
+		}
+		return opts.width, opts.height, nil
+	}
+	scale := 1.0
+	if opts.width > 0 && w > opts.width {
+		scale = float64(opts.width) / float64(w)
+	}
+	if opts.height > 0 && h > opts.height {
+		scale = min(scale, float64(opts.height)/float64(h))
+	}
+	if scale == 1 {
+		return w, h, nil
+	}
+	return max(int(float64(w)*scale+0.5), 1), max(int(float64(h)*scale+0.5), 1), nil
+}
+
+// scaleImage resizes img by factor, keeping at least one pixel per side.
+func scaleImage(img image.Image, factor float64) image.Image {
+	b := img.Bounds()
+	return resizeImage(img, max(int(float64(b.Dx())*factor), 1), max(int(float64(b.Dy())*factor), 1))
+}
+
+// purgeTransforms drops the cached conversions of filename after it changed.
+func (s *fileStore) purgeTransforms(filename string) {
+	if s.cache != nil {
+		s.cache.purge(filename)
+	}
+}
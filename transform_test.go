@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func pngImage(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func useTransformLimits(t *testing.T, maxPixels, maxInputPixels int64, downscale bool) {
+	t.Helper()
+	previousPixels, previousInput, previousBytes, previousDownscale := transformMaxPixels, transformMaxInputPixels, transformMaxBytes, transformDownscale
+	transformMaxPixels, transformMaxInputPixels, transformMaxBytes, transformDownscale = maxPixels, maxInputPixels, 0, downscale
+	t.Cleanup(func() {
+		transformMaxPixels, transformMaxInputPixels, transformMaxBytes, transformDownscale = previousPixels, previousInput, previousBytes, previousDownscale
+	})
+}
+
+func TestTransformedSizeMatchesGeometry(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 120, 80))
+	for _, tc := range []struct {
+		name        string
+		orientation int
+		opts        transformOptions
+	}{
+		{"unchanged", 1, transformOptions{}},
+		{"rotated", 1, transformOptions{rotate: 90}},
+		{"oriented", 6, transformOptions{}},
+		{"oriented and rotated", 8, transformOptions{rotate: 270}},
+		{"fit width", 1, transformOptions{width: 50}},
+		{"fit box", 1, transformOptions{width: 50, height: 50}},
+		{"fit larger box", 1, transformOptions{width: 500, height: 500}},
+		{"crop", 1, transformOptions{crop: image.Rect(10, 10, 70, 50)}},
+		{"crop past the edge", 1, transformOptions{crop: image.Rect(100, 60, 200, 200)}},
+		{"crop and fit", 6, transformOptions{crop: image.Rect(0, 0, 60, 100), width: 30}},
+		{"fill", 1, transformOptions{gravity: "center", width: 40, height: 40}},
+		{"fill larger box", 1, transformOptions{gravity: "top", width: 300, height: 100}},
+	} {
+		img, err := applyGeometry(orientImage(src, tc.orientation), tc.opts)
+		if err != nil {
+			t.Fatalf("%s: applyGeometry: %v", tc.name, err)
+		}
+		w, h, err := transformedSize(120, 80, tc.orientation, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: transformedSize: %v", tc.name, err)
+		}
+		if b := img.Bounds(); w != b.Dx() || h != b.Dy() {
+			t.Errorf("%s: transformedSize = %dx%d, want %dx%d", tc.name, w, h, b.Dx(), b.Dy())
+		}
+	}
+	if _, _, err := transformedSize(120, 80, 1, transformOptions{crop: image.Rect(200, 200, 300, 300)}); !errors.Is(err, errCropOutside) {
+		t.Errorf("crop outside: transformedSize = %v, want errCropOutside", err)
+	}
+}
+
+func TestTransformImageLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		maxPixels      int64
+		maxInputPixels int64
+		downscale      bool
+		opts           transformOptions
+		wantErr        error
+		wantPixels     int
+	}{
+		{"within limits", 10_000, 10_000, false, transformOptions{}, nil, 8000},
+		{"no limits", 0, 0, false, transformOptions{}, nil, 8000},
+		{"output too large", 5000, 0, false, transformOptions{}, errTransformTooLarge, 0},
+		{"resized under the limit", 5000, 0, false, transformOptions{width: 50}, nil, 2000},
+		{"downscaled", 2000, 0, true, transformOptions{}, nil, 2000},
+		{"downscaled fill", 2000, 0, true, transformOptions{gravity: "center", width: 80, height: 80}, nil, 2000},
+		{"source too large", 0, 5000, true, transformOptions{width: 10}, errSourceTooLarge, 0},
+	} {
+		useTransformLimits(t, tc.maxPixels, tc.maxInputPixels, tc.downscale)
+		tc.opts.format = "png"
+		data, err := transformImage(bytes.NewReader(pngImage(t, 100, 80)), tc.opts)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: transformImage = %v, want %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: decoding the output: %v", tc.name, err)
+		}
+		if pixels := config.Width * config.Height; pixels > tc.wantPixels || pixels < tc.wantPixels*9/10 {
+			t.Errorf("%s: output is %dx%d, want about %d pixels", tc.name, config.Width, config.Height, tc.wantPixels)
+		}
+	}
+}
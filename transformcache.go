@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// transformCacheMaxBytes caps the disk used by cached conversions; the least
+// recently served are evicted beyond it. 0 leaves the cache unbounded.
+var transformCacheMaxBytes int64
+
+// imageTransforms is the conversion cache of /images, for the admin API.
+var imageTransforms *transformCache
+
+var (
+	transformCacheHits      = expvar.NewInt("transform_cache_hits_total")
+	transformCacheMisses    = expvar.NewInt("transform_cache_misses_total")
+	transformCacheEvictions = expvar.NewInt("transform_cache_evictions_total")
+)
+
+// transformCache keeps converted images on local disk, one directory per
+// source file, so they can be dropped together when the source changes.
+// Entries are tracked in least-recently-used order to keep the cache within
+// maxBytes.
+type transformCache struct {
+	storage  *localStorage
+	maxBytes int64
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	bytes   int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// newTransformCache opens the cache in dir. Entries left by an earlier run
+// are indexed by modification time, which hits refresh, so their recency
+// carries over restarts.
+func newTransformCache(dir string, maxBytes int64) *transformCache {
+	t := &transformCache{
+		storage:  newLocalStorage(dir),
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+	objects, err := t.storage.List(context.Background(), "")
+	if err != nil {
+		logger.Warn("failed to index transform cache", "dir", dir, "error", err)
+	}
+	slices.SortFunc(objects, func(a, b ObjectInfo) int { return b.ModTime.Compare(a.ModTime) })
+	for _, object := range objects {
+		t.entries[object.Name] = t.order.PushBack(&cacheEntry{key: object.Name, size: object.Size})
+		t.bytes += object.Size
+	}
+	t.mu.Lock()
+	t.evict()
+	t.mu.Unlock()
+	return t
+}
+
+// key names the cached result of opts applied to the source described by
+// info. It covers the source's size and modification time, so replacing
+// the source never serves a stale conversion.
+func (t *transformCache) key(info ObjectInfo, opts transformOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s", info.Name, info.Size, info.ModTime.UnixNano(), opts.query(true, true))
+	if rights := rightsCacheKey(); rights != "" {
+		fmt.Fprintf(h, "\x00%s", rights)
+	}
+	if c2paSigner != nil {
+		fmt.Fprintf(h, "\x00c2pa %s", c2paSigner.fingerprint)
+	}
+	return info.Name + "/" + hex.EncodeToString(h.Sum(nil))[:32] + outputFormats[opts.format].ext
+}
+
+// get opens a cached conversion and marks it as recently used.
+func (t *transformCache) get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	body, info, err := t.storage.Get(ctx, key)
+	if err != nil {
+		transformCacheMisses.Add(1)
+		return nil, info, err
+	}
+	transformCacheHits.Add(1)
+	t.mu.Lock()
+	if element, ok := t.entries[key]; ok {
+		t.order.MoveToFront(element)
+	} else {
+		t.entries[key] = t.order.PushFront(&cacheEntry{key: key, size: info.Size})
+		t.bytes += info.Size
+	}
+	t.mu.Unlock()
+	if path, err := t.storage.path(key); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return body, info, nil
+}
+
+// has reports whether key is cached, without counting a hit.
+func (t *transformCache) has(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.entries[key]
+	return ok
+}
+
+// put stores a conversion and evicts the least recently used entries while
+// the cache exceeds its cap.
+func (t *transformCache) put(ctx context.Context, key string, data []byte) error {
+	if _, err := t.storage.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(key)
+	t.entries[key] = t.order.PushFront(&cacheEntry{key: key, size: int64(len(data))})
+	t.bytes += int64(len(data))
+	t.evict()
+	return nil
+}
+
+// remove forgets key; t.mu must be held.
+func (t *transformCache) remove(key string) {
+	if element, ok := t.entries[key]; ok {
+		t.bytes -= element.Value.(*cacheEntry).size
+		t.order.Remove(element)
+		delete(t.entries, key)
+	}
+}
+
+// evict deletes entries from the least recently used end until the cache
+// fits its cap; t.mu must be held. The newest entry is kept even when it
+// alone exceeds the cap.
+func (t *transformCache) evict() {
+	for t.maxBytes > 0 && t.bytes > t.maxBytes && t.order.Len() > 1 {
+		entry := t.order.Back().Value.(*cacheEntry)
+		t.remove(entry.key)
+		t.storage.Delete(context.Background(), entry.key)
+		transformCacheEvictions.Add(1)
+	}
+}
+
+// purge drops every cached conversion of filename and returns how many there
+// were.
+func (t *transformCache) purge(filename string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	purged := 0
+	for key := range t.entries {
+		if strings.HasPrefix(key, filename+"/") {
+			t.remove(key)
+			purged++
+		}
+	}
+	if dir, err := t.storage.path(filename); err == nil {
+		os.RemoveAll(dir)
+	}
+	return purged
+}
+
+// purgeAll empties the cache and returns how many entries it held.
+func (t *transformCache) purgeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	purged := t.order.Len()
+	for key := range t.entries {
+		t.remove(key)
+		t.storage.Delete(context.Background(), key)
+	}
+	return purged
+}
+
+func (t *transformCache) stats() gin.H {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return gin.H{
+		"entries":   t.order.Len(),
+		"bytes":     t.bytes,
+		"max_bytes": t.maxBytes,
+		"hits":      transformCacheHits.Value(),
+		"misses":    transformCacheMisses.Value(),
+		"evictions": transformCacheEvictions.Value(),
+	}
+}
+
+// getTransformCache reports the size and hit rate of the conversion cache.
+func getTransformCache(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, imageTransforms.stats())
+}
+
+// purgeTransformCache drops the cached conversions of one image, or of all
+// images when no filename is given.
+func purgeTransformCache(c *gin.Context) {
+	var purged int
+	if filename := c.Param("filename"); filename != "" {
+		purged = imageTransforms.purge(filename)
+	} else {
+		purged = imageTransforms.purgeAll()
+	}
+	logger.Info("transform cache purged", "user", c.GetString("adminUser"), "file", c.Param("filename"), "entries", purged)
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Cache purged", "purged": purged})
+}
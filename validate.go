@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Secrets shorter than this are reported as weak by --validate.
+const minSecretLength = 32
+
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "ok"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+)
+
+type validationCheck struct {
+	Check  string      `json:"check"`
+	Status checkStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+type validationReport struct {
+	OK     bool              `json:"ok"`
+	Checks []validationCheck `json:"checks"`
+}
+
+func (r *validationReport) add(check string, status checkStatus, detail string) {
+	r.Checks = append(r.Checks, validationCheck{Check: check, Status: status, Detail: detail})
+	if status == checkFail {
+		r.OK = false
+	}
+}
+
+// runValidation checks the loaded configuration and the environment it
+// depends on, writes a JSON report to w and returns the process exit code:
+// non-zero when any check failed, so deploy pipelines can gate on it.
+func runValidation(w io.Writer, configErrs []error) int {
+	report := &validationReport{OK: true, Checks: []validationCheck{}}
+
+	if len(configErrs) == 0 {
+		report.add("config", checkOK, "")
+	}
+	for _, err := range configErrs {
+		report.add("config", checkFail, err.Error())
+	}
+
+	checkSecret(report, "secret_key", secretKey.Get(), true)
+	if apiKey.Get() != "" {
+		checkSecret(report, "api_key", apiKey.Get(), false)
+	}
+	if emailIngestToken.Get() != "" {
+		checkSecret(report, "email_ingest_token", emailIngestToken.Get(), false)
+	}
+	for _, cred := range adminUsers {
+		checkSecret(report, "admin_token:"+cred.name, cred.token, false)
+	}
+	if traceKey != nil {
+		checkSecret(report, "invisible_watermark_key", string(traceKey), false)
+	}
+	if referenceWebhookSecret != "" {
+		checkSecret(report, "reference_webhook_secret", referenceWebhookSecret, false)
+	}
+
+	if storageBackend == storageLocal {
+		checkWritableDir(report, "upload_dir", uploadDirPath)
+		checkWritableDir(report, "files_dir", filesDirPath)
+	} else if len(configErrs) == 0 {
+		checkStorage(report, "storage:images", uploadDirPath, "images/")
+		checkStorage(report, "storage:files", filesDirPath, "files/")
+	}
+	checkWritableDir(report, "transform_cache_dir", transformCacheDir)
+	checkMetadataStore(report)
+	if accessLogDir != "" {
+		checkWritableDir(report, "access_log_dir", accessLogDir)
+	}
+	if ingestDirPath != "" {
+		// The watcher moves files out of the drop directory, so it has to be
+		// writable too.
+		checkWritableDir(report, "ingest_dir", ingestDirPath)
+	}
+	if assetsDirPath != "" {
+		if info, err := os.Stat(assetsDirPath); err != nil || !info.IsDir() {
+			report.add("assets_dir", checkFail, assetsDirPath+" is not a readable directory")
+		} else {
+			report.add("assets_dir", checkOK, assetsDirPath)
+		}
+	}
+
+	if command := getEnv("ACCESS_LOG_SHIP_COMMAND", ""); command != "" {
+		checkCommand(report, "sh")
+		if fields := strings.Fields(command); len(fields) > 0 {
+			checkCommand(report, fields[0])
+		}
+	}
+
+	if chaos != (chaosConfig{}) {
+		report.add("chaos", checkWarn, "CHAOS_ENABLED is set; faults will be injected into image routes")
+	}
+
+	out, _ := json.MarshalIndent(report, "", "    ")
+	fmt.Fprintln(w, string(out))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// checkSecret reports missing, placeholder and short secrets. A missing
+// secret is only a failure when the setting is required.
+func checkSecret(report *validationReport, name, value string, required bool) {
+	switch {
+	case value == "" && required:
+		report.add(name, checkFail, "not set")
+	case value == "secret-key" || value == "changeme":
+		report.add(name, checkFail, "still set to the example value")
+	case len(value) < minSecretLength:
+		report.add(name, checkWarn, fmt.Sprintf("shorter than %d characters", minSecretLength))
+	default:
+		report.add(name, checkOK, "")
+	}
+}
+
+// checkWritableDir creates dir if needed and proves it is writable by
+// creating and removing a temporary file in it.
+func checkWritableDir(report *validationReport, name, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		report.add(name, checkFail, err.Error())
+		return
+	}
+	probe, err := os.CreateTemp(dir, ".validate-*")
+	if err != nil {
+		report.add(name, checkFail, dir+" is not writable: "+err.Error())
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	report.add(name, checkOK, dir)
+}
+
+// checkStorage proves the bucket is reachable with the configured
+// credentials by listing a prefix that shouldn't match anything.
+func checkStorage(report *validationReport, name, dir, keyPrefix string) {
+	storage, err := openStorage(dir, keyPrefix)
+	if err != nil {
+		report.add(name, checkFail, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := storage.List(ctx, ".validate-probe"); err != nil {
+		report.add(name, checkFail, err.Error())
+		return
+	}
+	report.add(name, checkOK, storageBackend)
+}
+
+// checkMetadataStore opens the metadata database, creating it and its
+// schema when missing. A disabled store isn't reported.
+func checkMetadataStore(report *validationReport) {
+	store, err := openMetadataStore()
+	if err != nil {
+		report.add("metadata_db", checkFail, err.Error())
+		return
+	}
+	if store == nil {
+		return
+	}
+	store.db.Close()
+	detail := metadataDBPath
+	if metadataBackend == metadataPostgres {
+		detail = metadataPostgres
+	}
+	report.add("metadata_db", checkOK, detail)
+}
+
+func checkCommand(report *validationReport, command string) {
+	if path, err := exec.LookPath(command); err != nil {
+		report.add("command:"+command, checkFail, "not found in PATH")
+	} else {
+		report.add("command:"+command, checkOK, path)
+	}
+}
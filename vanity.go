@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// vanityPresets maps hostnames to the transform query every image GET on
+// that host is served with (VANITY_HOSTS).
+var vanityPresets map[string]string
+
+// vanityParams are the query parameters a preset may set.
+var vanityParams = []string{"format", "q", "w", "h", "crop", "gravity", "rotate", "flip", "watermark"}
+
+// parseVanityHosts parses VANITY_HOSTS, semicolon-separated
+// host=query entries such as "thumbs.example.com=w=256&h=256&format=webp".
+func parseVanityHosts(value string) (map[string]string, error) {
+	presets := map[string]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, preset, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" || preset == "" {
+			return nil, fmt.Errorf("VANITY_HOSTS: %q must be host=query", entry)
+		}
+		query, err := url.ParseQuery(preset)
+		if err != nil {
+			return nil, fmt.Errorf("VANITY_HOSTS: invalid preset for %s: %v", host, err)
+		}
+		for param := range query {
+			if !slices.Contains(vanityParams, param) {
+				return nil, fmt.Errorf("VANITY_HOSTS: unsupported parameter %q for %s", param, host)
+			}
+		}
+		// Serving originals unsigned would defeat the point of a preset.
+		if query.Get("format") == "original" {
+			return nil, fmt.Errorf("VANITY_HOSTS: the preset for %s can't serve originals", host)
+		}
+		presets[host] = query.Encode()
+	}
+	return presets, nil
+}
+
+// vanityHost returns the host of the request without its port.
+func vanityHost(c *gin.Context) string {
+	host := strings.ToLower(c.Request.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// VanityHostMiddleware serves image GETs on a VANITY_HOSTS hostname with
+// that host's preset: the client's query string is replaced by the
+// preset, so the URL needs no signature and can't ask for other transforms.
+// It must run before anything reads the query.
+func VanityHostMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if preset, ok := vanityPresets[vanityHost(c)]; ok {
+			c.Request.URL.RawQuery = preset
+			c.Set("vanityPreset", true)
+		}
+		c.Next()
+	}
+}
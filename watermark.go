@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"slices"
+
+	"golang.org/x/image/draw"
+)
+
+// Watermark modes: applied on ?watermark=1, or to every derived image.
+const (
+	watermarkOnRequest = "request"
+	watermarkAlways    = "always"
+)
+
+var (
+	// watermarkImage is the overlay; nil disables watermarking.
+	watermarkImage    image.Image
+	watermarkMode     string
+	watermarkPosition string
+	watermarkOpacity  float64
+	// watermarkScale is the overlay's width as a fraction of the image's.
+	watermarkScale float64
+)
+
+var watermarkPositions = []string{"center", "top-left", "top-right", "bottom-left", "bottom-right"}
+
+// errNoWatermark reports ?watermark=1 without a configured overlay.
+var errNoWatermark = errors.New("watermarking is not configured")
+
+// loadWatermark decodes the overlay at path; an empty path disables
+// watermarking.
+func loadWatermark(path string) error {
+	watermarkImage = nil
+	if path == "" {
+		return nil
+	}
+	img, _, err := decodeImage(path)
+	if err != nil {
+		return errors.New("WATERMARK_IMAGE: " + err.Error())
+	}
+	watermarkImage = img
+	return nil
+}
+
+// validWatermarkPosition reports whether position is a WATERMARK_POSITION value.
+func validWatermarkPosition(position string) bool {
+	return slices.Contains(watermarkPositions, position)
+}
+
+// applyWatermark draws the overlay onto a copy of img at the configured
+// position and opacity, scaled to watermarkScale of its width and never
+// beyond its bounds.
+func applyWatermark(img image.Image) image.Image {
+	b := img.Bounds()
+	mb := watermarkImage.Bounds()
+	w := min(int(float64(b.Dx())*watermarkScale), b.Dx())
+	h := mb.Dy() * w / max(mb.Dx(), 1)
+	if h > b.Dy() {
+		w, h = w*b.Dy()/h, b.Dy()
+	}
+	if w < 1 || h < 1 {
+		return img
+	}
+	mark := resizeImage(watermarkImage, w, h)
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	margin := min(b.Dx(), b.Dy()) / 50
+	x, y := (b.Dx()-w)/2, (b.Dy()-h)/2
+	switch watermarkPosition {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = b.Dx()-w-margin, margin
+	case "bottom-left":
+		x, y = margin, b.Dy()-h-margin
+	case "bottom-right":
+		x, y = b.Dx()-w-margin, b.Dy()-h-margin
+	}
+	opacity := image.NewUniform(color.Alpha{A: uint8(watermarkOpacity * 255)})
+	draw.DrawMask(dst, image.Rect(x, y, x+w, y+h), mark, image.Point{}, opacity, image.Point{}, draw.Over)
+	return dst
+}